@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"gopkg.in/yaml.v3"
+)
+
+// The configuration is built up in layers. Each layer overrides the one before it:
+//
+//  1. the default values of the command-line flags;
+//  2. the values in the JSON or YAML file given by -config-file (if any);
+//  3. environment variables named GREENLIGHT_<FLAG>, such as GREENLIGHT_PORT or
+//     GREENLIGHT_DB_MAX_OPEN_CONNS;
+//  4. flags which were explicitly set on the command line.
+//
+// Both the config file keys and the environment variable names are derived from the
+// flag names, so every flag can be set in any layer without extra code.
+
+// The nonConfigFlags are flags which control the program itself rather than the
+// application configuration, so they can't be set by the config file or environment.
+var nonConfigFlags = map[string]bool{
+	"config-file":	true,
+	"version":		true,
+}
+
+// The envVarName() function returns the name of the environment variable for a flag,
+// e.g. "db-max-open-conns" becomes "GREENLIGHT_DB_MAX_OPEN_CONNS".
+func envVarName(flagName string) string {
+	return "GREENLIGHT_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// The applyConfigLayers() function applies the config file and environment variable
+// layers to the flags in the given flag set. It must be called after the flag set has
+// been parsed, so that it can leave any explicitly set flags untouched.
+func applyConfigLayers(fs *flag.FlagSet, configFile string) error {
+	// Record which flags were explicitly set on the command line.
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if configFile != "" {
+		values, err := readConfigFile(fs, configFile)
+		if err != nil {
+			return err
+		}
+
+		for name, value := range values {
+			if explicit[name] {
+				continue
+			}
+
+			err := fs.Set(name, value)
+			if err != nil {
+				return fmt.Errorf("config file %s: invalid value %q for %q: %w", configFile, value, name, err)
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || nonConfigFlags[f.Name] {
+			return
+		}
+
+		value, ok := os.LookupEnv(envVarName(f.Name))
+		if !ok {
+			return
+		}
+
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", value, envVarName(f.Name), setErr)
+		}
+	})
+
+	return err
+}
+
+// The readConfigFile() function reads a config file whose keys are flag names, and
+// returns the values as strings which can be passed to flag.Set(). Files ending in
+// .yaml or .yml are decoded as YAML, and anything else as JSON. Arrays (such as the
+// list of trusted CORS origins) are joined with spaces. If the file contains any keys
+// which don't match a flag, an error listing all of them is returned.
+func readConfigFile(fs *flag.FlagSet, path string) (map[string]string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(contents, &raw)
+	default:
+		// Decode numbers as json.Number, so that large integers like 2097152 aren't
+		// formatted in exponent form (which flag.Set() would reject) via float64.
+		dec := json.NewDecoder(bytes.NewReader(contents))
+		dec.UseNumber()
+		err = dec.Decode(&raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	var unknown []string
+
+	for key, value := range raw {
+		if fs.Lookup(key) == nil || nonConfigFlags[key] {
+			unknown = append(unknown, key)
+			continue
+		}
+
+		switch value := value.(type) {
+		case []any:
+			parts := make([]string, len(value))
+			for i, part := range value {
+				parts[i] = fmt.Sprint(part)
+			}
+			values[key] = strings.Join(parts, " ")
+		default:
+			values[key] = fmt.Sprint(value)
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("config file %s: unknown keys: %s", path, strings.Join(unknown, ", "))
+	}
+
+	return values, nil
+}
+
+// The effectiveConfig() function returns the final value of every flag, suitable for
+// logging. Passwords are redacted, including the password in the database DSN.
+func effectiveConfig(fs *flag.FlagSet) map[string]any {
+	properties := make(map[string]any)
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if nonConfigFlags[f.Name] {
+			return
+		}
+
+		value := f.Value.String()
+
+		switch {
+		case strings.HasSuffix(f.Name, "password") && value != "":
+			value = "xxxxx"
+		case strings.HasSuffix(f.Name, "dsn"):
+			value = redactDSN(value)
+		}
+
+		properties[f.Name] = value
+	})
+
+	return properties
+}
+
+// The redactDSN() function replaces the password in a URL-style DSN with "xxxxx". If
+// the DSN can't be parsed as a URL, it's redacted entirely rather than risk leaking it.
+func redactDSN(dsn string) string {
+	if dsn == "" {
+		return dsn
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil || u.Scheme == "" {
+		return "xxxxx"
+	}
+
+	return u.Redacted()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The newTestFlagSet() helper returns a flag set with a few flags of each kind, which
+// stands in for the application's flags.
+func newTestFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int("port", 4000, "")
+	fs.String("env", "development", "")
+	fs.Bool("db-migrate", false, "")
+	fs.String("db-max-idle-time", "15m", "")
+	fs.Int64("max-body-bytes", 1_048_576, "")
+	fs.String("cors-trusted-origins", "", "")
+	fs.String("config-file", "", "")
+	return fs
+}
+
+func TestReadConfigFile(t *testing.T) {
+	want := map[string]string{
+		"port":					"8080",
+		"env":					"production",
+		"db-migrate":			"true",
+		"db-max-idle-time":		"5m",
+		"max-body-bytes":		"2097152",
+		"cors-trusted-origins":	"https://a.example https://b.example",
+	}
+
+	files := map[string]string{
+		"config.json": `{
+			"port": 8080,
+			"env": "production",
+			"db-migrate": true,
+			"db-max-idle-time": "5m",
+			"max-body-bytes": 2097152,
+			"cors-trusted-origins": ["https://a.example", "https://b.example"]
+		}`,
+		"config.yaml": "port: 8080\n" +
+			"env: production\n" +
+			"db-migrate: true\n" +
+			"db-max-idle-time: 5m\n" +
+			"max-body-bytes: 2097152\n" +
+			"cors-trusted-origins:\n" +
+			"  - https://a.example\n" +
+			"  - https://b.example\n",
+		"config.yml": "{port: 8080, env: production, db-migrate: true, db-max-idle-time: 5m, max-body-bytes: 2097152, cors-trusted-origins: [https://a.example, https://b.example]}\n",
+	}
+
+	for name, contents := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			err := os.WriteFile(path, []byte(contents), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readConfigFile(newTestFlagSet(), path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(want) {
+				t.Errorf("got %d values; want %d", len(got), len(want))
+			}
+			for key, value := range want {
+				if got[key] != value {
+					t.Errorf("got %s = %q; want %q", key, got[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestReadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name		string
+		file		string
+		contents	string
+		wantErr		string
+	}{
+		{name: "unknown JSON keys", file: "config.json", contents: `{"port": 1, "smtp-host": "x", "colour": "red"}`, wantErr: "unknown keys: colour, smtp-host"},
+		{name: "unknown YAML keys", file: "config.yaml", contents: "port: 1\ncolour: red\n", wantErr: "unknown keys: colour"},
+		{name: "non-config flag", file: "config.yaml", contents: "config-file: other.yaml\n", wantErr: "unknown keys: config-file"},
+		{name: "invalid JSON", file: "config.json", contents: `{"port": `, wantErr: "config file"},
+		{name: "invalid YAML", file: "config.yml", contents: "port: [1\n", wantErr: "config file"},
+		{name: "YAML in a JSON file", file: "config.json", contents: "port: 1\n", wantErr: "config file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			err := os.WriteFile(path, []byte(tt.contents), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = readConfigFile(newTestFlagSet(), path)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v; want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
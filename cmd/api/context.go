@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"greenlight.nursultandias.net/internal/jsonlog"
+)
+
+// Define a custom contextKey type, with the underlying type string. Using our own type
+// for the keys avoids collisions with context keys set by other packages.
+type contextKey string
+
+// The loggerContextKey constant is used as the key for getting and setting the
+// request-scoped logger in the request context.
+const loggerContextKey = contextKey("logger")
+
+// The requestIDContextKey constant is used as the key for getting and setting the
+// request ID in the request context.
+const requestIDContextKey = contextKey("request_id")
+
+// The contextSetRequestID() method returns a new copy of the request with the provided
+// request ID added to the context.
+func (app *application) contextSetRequestID(request *http.Request, requestID string) *http.Request {
+	ctx := context.WithValue(request.Context(), requestIDContextKey, requestID)
+	return request.WithContext(ctx)
+}
+
+// The contextGetRequestID() method retrieves the request ID from the request context.
+// It returns the empty string if no request ID has been set.
+func (app *application) contextGetRequestID(request *http.Request) string {
+	requestID, ok := request.Context().Value(requestIDContextKey).(string)
+	if !ok {
+		return ""
+	}
+
+	return requestID
+}
+
+// The contextSetLogger() method returns a new copy of the request with the provided
+// logger added to the context.
+func (app *application) contextSetLogger(request *http.Request, logger *jsonlog.Logger) *http.Request {
+	ctx := context.WithValue(request.Context(), loggerContextKey, logger)
+	return request.WithContext(ctx)
+}
+
+// The loggerFromContext() method returns the request-scoped logger stored in the
+// request context. If there isn't one (for example, if the middleware which sets it
+// hasn't run) it falls back to the application logger.
+func (app *application) loggerFromContext(request *http.Request) *jsonlog.Logger {
+	logger, ok := request.Context().Value(loggerContextKey).(*jsonlog.Logger)
+	if !ok {
+		return app.logger
+	}
+
+	return logger
+}
+
+// The routeContextKey constant is used as the key for getting and setting the matched
+// route in the request context.
+const routeContextKey = contextKey("route")
+
+// A matchedRoute holds the route pattern (such as "/v1/movies/:id") which a request was
+// routed to. The middleware which wraps the router adds an empty matchedRoute to the
+// request context, and the handler for the route fills it in, so that the middleware
+// can read it once the request has been handled.
+type matchedRoute struct {
+	pattern string
+}
+
+// The contextSetRoute() method returns a new copy of the request with an empty
+// matchedRoute added to the context, along with the matchedRoute itself.
+func (app *application) contextSetRoute(request *http.Request) (*http.Request, *matchedRoute) {
+	route := &matchedRoute{}
+	ctx := context.WithValue(request.Context(), routeContextKey, route)
+	return request.WithContext(ctx), route
+}
+
+// The contextGetRoute() method retrieves the matchedRoute from the request context. It
+// returns nil if there isn't one.
+func (app *application) contextGetRoute(request *http.Request) *matchedRoute {
+	route, ok := request.Context().Value(routeContextKey).(*matchedRoute)
+	if !ok {
+		return nil
+	}
+
+	return route
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"greenlight.nursultandias.net/internal/data"
+	"greenlight.nursultandias.net/internal/validator"
 )
 
 // The logError() method is a genereric helper for logging an error message.
@@ -10,24 +14,118 @@ import (
 // about the request including the HTTP method and URL.
 func (app *application) logError(request *http.Request, err error) {
 	// Use the PrintError() method to log the error message, and include the current
-	// request method and URL as properties in the log entry.
-	app.logger.PrintError(err, map[string]string{
+	// request method and URL as properties in the log entry. We use the request-scoped
+	// logger so that any properties attached to it are included too.
+	app.loggerFromContext(request).PrintError(err, map[string]any{
 		"request_method":	request.Method,
 		"request_url":		request.URL.String(),
 	})
 }
 
+// Every error response includes a stable, machine-readable code so that clients can
+// branch on the type of error without parsing the (English) message. Each code is
+// always sent with the same HTTP status:
+//
+//	code                          status
+//	bad_request                   400 Bad Request
+//	invalid_credentials           401 Unauthorized
+//	record_not_found              404 Not Found
+//	method_not_allowed            405 Method Not Allowed
+//	edit_conflict                 409 Conflict
+//	duplicate_record              409 Conflict
+//	idempotency_key_in_progress   409 Conflict
+//	validation_failed             422 Unprocessable Entity
+//	idempotency_key_mismatch      422 Unprocessable Entity
+//	server_error                  500 Internal Server Error
+//	timeout                       503 Service Unavailable
+const (
+	errCodeBadRequest				= "bad_request"
+	errCodeInvalidCredentials		= "invalid_credentials"
+	errCodeNotFound					= "record_not_found"
+	errCodeMethodNotAllowed			= "method_not_allowed"
+	errCodeEditConflict				= "edit_conflict"
+	errCodeDuplicateRecord			= "duplicate_record"
+	errCodeIdempotencyKeyInProgress	= "idempotency_key_in_progress"
+	errCodeValidationFailed			= "validation_failed"
+	errCodeIdempotencyKeyMismatch	= "idempotency_key_mismatch"
+	errCodeServerError				= "server_error"
+	errCodeTimeout					= "timeout"
+)
+
+// The fieldErrorsMessage is sent as the error message when the response carries a map
+// of errors for individual fields.
+const fieldErrorsMessage = "one or more fields are invalid"
+
 // The errorResponse() method is generic helper for sending JSON-formatted error
 // messages to the client with a given status code. Note that we're using an interface{}
 // type for the message parameter, rather than just a string type, as this gives us
 // more flexibility over the values that we can include in the response.
-func (app *application) errorResponse(response http.ResponseWriter, request *http.Request, status int, message interface{}) {
-	env := envelope{"error": message}
+// The code parameter should be one of the errCode constants above.
+func (app *application) errorResponse(response http.ResponseWriter, request *http.Request, status int, code string, message interface{}) {
+	app.writeError(response, request, status, code, message, nil, nil)
+}
+
+// The writeError() method is the single place where error responses are rendered. All
+// of the other error helpers route through it. Depending on the -error-format flag it
+// renders either our usual {"code": ..., "error": ...} envelope, or an RFC 7807
+// application/problem+json document. If the message is a map of errors for individual
+// fields, it's sent in a "fields" member (or an "errors" extension member for problem
+// details) alongside a generic message. The extra parameter holds any additional
+// members to include in the response, and headers any additional response headers.
+func (app *application) writeError(response http.ResponseWriter, request *http.Request, status int, code string, message interface{}, extra envelope, headers http.Header) {
+	var env envelope
+
+	// The field errors hold a list of messages for each field.
+	var fields interface{}
+	switch message.(type) {
+	case map[string][]string:
+		fields = message
+		message = fieldErrorsMessage
+	}
+	isFieldErrors := fields != nil
+
+	switch app.config.errorFormat {
+	case "problem":
+		// Build the problem details document, with the code as an extension member.
+		env = envelope{
+			"type":		"about:blank",
+			"title":	http.StatusText(status),
+			"status":	status,
+			"detail":	message,
+			"instance":	request.URL.Path,
+			"code":		code,
+		}
+
+		if isFieldErrors {
+			env["errors"] = fields
+		}
+
+		if headers == nil {
+			headers = make(http.Header)
+		}
+		headers.Set("Content-Type", "application/problem+json")
+	default:
+		env = envelope{"code": code, "error": message}
+
+		if isFieldErrors {
+			env["fields"] = fields
+		}
+	}
+
+	for key, value := range extra {
+		env[key] = value
+	}
+
+	// Include the request ID (if there is one) so that clients can quote it when
+	// reporting a problem, and we can find the matching log entries.
+	if requestID := app.contextGetRequestID(request); requestID != "" {
+		env["request_id"] = requestID
+	}
 
 	// Write the response using the writeJSON helper. If this happens to return an
 	// error then log it, and fall back to sending the client an empty response
 	// with a 500 Internal Server Error status code.
-	err := app.writeJSON(response, status, env, nil)
+	err := app.writeJSON(response, status, env, headers)
 	if err != nil {
 		app.logError(request, err)
 		response.WriteHeader(500)
@@ -38,38 +136,131 @@ func (app *application) errorResponse(response http.ResponseWriter, request *htt
 // unexpected problem at runtime. It logs the detailed error message, then uses the
 // errorResponse() helper to send a 500 Internal Server Error status code and JSON
 // response (containing a generic error message) to the client.
+// If the error was caused by the client disconnecting (so the request context has been
+// cancelled) it isn't a problem with our application, so we log it at the INFO level
+// instead of ERROR. If a database query timed out, a 503 is sent instead, as the
+// request may well succeed if it's retried. Likewise a write which was rejected by a
+// database constraint is the client's problem, so it gets a 422 (or 409) response.
 func (app *application) serverErrorResponse(response http.ResponseWriter, request *http.Request, err error){
-	app.logError(request, err)
+	if data.IsQueryTimeout(err) && request.Context().Err() == nil {
+		app.timeoutResponse(response, request, err)
+		return
+	}
+
+	var constraintErr *data.ConstraintError
+	if errors.As(err, &constraintErr) {
+		app.constraintViolationResponse(response, request, constraintErr)
+		return
+	}
+
+	if errors.Is(err, context.Canceled) && errors.Is(request.Context().Err(), context.Canceled) {
+		app.loggerFromContext(request).PrintInfo("request cancelled by client", map[string]any{
+			"request_method":	request.Method,
+			"request_url":		request.URL.String(),
+			"error":			err.Error(),
+		})
+	} else {
+		app.logError(request, err)
+	}
 
 	message := "the server ecnountered a problem and could not process your request"
-	app.errorResponse(response, request, http.StatusInternalServerError, message)
+	app.errorResponse(response, request, http.StatusInternalServerError, errCodeServerError, message)
+}
+
+// The timeoutResponse() method will be used to send a 503 Service Unavailable status
+// code and JSON response to the client when a database query takes longer than the
+// -db-query-timeout setting allows. The error is logged, as a query which times out
+// may need an index or a longer timeout.
+func (app *application) timeoutResponse(response http.ResponseWriter, request *http.Request, err error) {
+	app.logError(request, err)
+
+	message := "the server took too long to respond"
+	app.errorResponse(response, request, http.StatusServiceUnavailable, errCodeTimeout, message)
+}
+
+// The constraintViolationResponse() method will be used when a write is rejected by a
+// database constraint which the validation didn't catch. When the field which the
+// constraint applies to is known, the error is reported against it with a 422
+// Unprocessable Entity response, in the same way as a validation error. Otherwise a
+// duplicate gets a 409 Conflict response, and any other violation a 422 response.
+func (app *application) constraintViolationResponse(response http.ResponseWriter, request *http.Request, err *data.ConstraintError) {
+	// The message is for the field, and the fallback is used if the field isn't known.
+	var message, fallback string
+	switch {
+	case errors.Is(err, data.ErrDuplicateRecord):
+		message, fallback = "already exists", "a record with the same values already exists"
+	case errors.Is(err, data.ErrInvalidReference):
+		message, fallback = "refers to a record which doesn't exist", "the request refers to a record which doesn't exist"
+	case errors.Is(err, data.ErrValueTooLong):
+		message, fallback = "is too long", "a value in the request is too long"
+	default:
+		message, fallback = "is not a valid value", "a value in the request is not valid"
+	}
+
+	if err.Field == "" {
+		if errors.Is(err, data.ErrDuplicateRecord) {
+			app.errorResponse(response, request, http.StatusConflict, errCodeDuplicateRecord, fallback)
+			return
+		}
+		app.errorResponse(response, request, http.StatusUnprocessableEntity, errCodeValidationFailed, fallback)
+		return
+	}
+
+	app.errorResponse(response, request, http.StatusUnprocessableEntity, errCodeValidationFailed, map[string][]string{err.Field: {message}})
 }
 
 // The notFoundResponse() method will be used to send a 404 Not Found status code and
 // JSON response to the client.
 func (app *application) notFoundResponse(response http.ResponseWriter, request *http.Request) {
 	message := "the requested resource could not be found"
-	app.errorResponse(response, request, http.StatusNotFound, message)
+	app.errorResponse(response, request, http.StatusNotFound, errCodeNotFound, message)
 }
 
 // The methodNotAllowedResponse() method will be used to send a 405 Method Not Allowed
 // status code and JSON response to the client.
 func (app *application) methodNotAllowedResponse(response http.ResponseWriter, request *http.Request) {
 	message := fmt.Sprintf("the %s method is not supported for this resource", request.Method)
-	app.errorResponse(response, request, http.StatusMethodNotAllowed, message)
+	app.errorResponse(response, request, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, message)
+}
+
+// The invalidCredentialsResponse() method will be used to send a 401 Unauthorized
+// status code and JSON response when the client's basic auth credentials are missing or
+// wrong. The WWW-Authenticate header tells the client which scheme to use.
+func (app *application) invalidCredentialsResponse(response http.ResponseWriter, request *http.Request) {
+	headers := make(http.Header)
+	headers.Set("WWW-Authenticate", `Basic realm="greenlight", charset="UTF-8"`)
+
+	message := "invalid or missing authentication credentials"
+	app.writeError(response, request, http.StatusUnauthorized, errCodeInvalidCredentials, message, nil, headers)
 }
 
 func (app *application) badRequestResponse(response http.ResponseWriter, request *http.Request, err error) { 
-	app.errorResponse(response, request, http.StatusBadRequest, err.Error())
+	app.errorResponse(response, request, http.StatusBadRequest, errCodeBadRequest, err.Error())
 }
 
-// Note that the errors parameter here has the type map[string]string, which is exactly
-// the same as the errors map contained in our Validator type.
-func (app *application) failedValidationResponse(response http.ResponseWriter, request *http.Request, errors map[string]string) {
-	app.errorResponse(response, request, http.StatusUnprocessableEntity, errors)
+// The failedValidationResponse() method sends the errors from a Validator in the
+// "fields" member of the response, with an array of error messages for each field.
+func (app *application) failedValidationResponse(response http.ResponseWriter, request *http.Request, v *validator.Validator) {
+	app.errorResponse(response, request, http.StatusUnprocessableEntity, errCodeValidationFailed, v.Errors)
 }
 
 func (app *application) editConflictResponse(response http.ResponseWriter, request *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
-	app.errorResponse(response, request, http.StatusConflict, message)
-}
\ No newline at end of file
+	app.errorResponse(response, request, http.StatusConflict, errCodeEditConflict, message)
+}
+
+// The duplicateMovieMessage is the validation error reported against the title field
+// when a movie with the same title and year already exists.
+const duplicateMovieMessage = "a movie with this title and year already exists"
+
+// The duplicateMovieResponse() method sends a 422 Unprocessable Entity response, with a
+// validation error for the title field, when a movie with the same title and year
+// already exists. The response includes the ID of the existing movie, and a Location
+// header pointing at it.
+func (app *application) duplicateMovieResponse(response http.ResponseWriter, request *http.Request, existingID int64) {
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", existingID))
+
+	fields := map[string][]string{"title": {duplicateMovieMessage}}
+	app.writeError(response, request, http.StatusUnprocessableEntity, errCodeValidationFailed, fields, envelope{"existing_id": existingID}, headers)
+}
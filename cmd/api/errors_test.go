@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"greenlight.nursultandias.net/internal/data"
+	"greenlight.nursultandias.net/internal/validator"
+)
+
+var snakeCaseRX = regexp.MustCompile(`^[a-z]+(_[a-z]+)*$`)
+
+func TestErrorResponseCodes(t *testing.T) {
+	v := validator.New()
+	v.AddError("title", "must be provided")
+
+	tests := []struct {
+		name		string
+		send		func(app *application, response http.ResponseWriter, request *http.Request)
+		wantStatus	int
+		wantCode	string
+	}{
+		{
+			name: "bad request",
+			send: func(app *application, response http.ResponseWriter, request *http.Request) {
+				app.badRequestResponse(response, request, errors.New("body contains badly-formed JSON"))
+			},
+			wantStatus:	http.StatusBadRequest,
+			wantCode:	errCodeBadRequest,
+		},
+		{
+			name:		"invalid credentials",
+			send:		(*application).invalidCredentialsResponse,
+			wantStatus:	http.StatusUnauthorized,
+			wantCode:	errCodeInvalidCredentials,
+		},
+		{
+			name:		"not found",
+			send:		(*application).notFoundResponse,
+			wantStatus:	http.StatusNotFound,
+			wantCode:	errCodeNotFound,
+		},
+		{
+			name:		"method not allowed",
+			send:		(*application).methodNotAllowedResponse,
+			wantStatus:	http.StatusMethodNotAllowed,
+			wantCode:	errCodeMethodNotAllowed,
+		},
+		{
+			name:		"edit conflict",
+			send:		(*application).editConflictResponse,
+			wantStatus:	http.StatusConflict,
+			wantCode:	errCodeEditConflict,
+		},
+		{
+			name: "duplicate movie",
+			send: func(app *application, response http.ResponseWriter, request *http.Request) {
+				app.duplicateMovieResponse(response, request, 7)
+			},
+			wantStatus:	http.StatusUnprocessableEntity,
+			wantCode:	errCodeValidationFailed,
+		},
+		{
+			name: "duplicate constraint",
+			send: func(app *application, response http.ResponseWriter, request *http.Request) {
+				app.constraintViolationResponse(response, request, &data.ConstraintError{Err: data.ErrDuplicateRecord, Field: "title"})
+			},
+			wantStatus:	http.StatusUnprocessableEntity,
+			wantCode:	errCodeValidationFailed,
+		},
+		{
+			name: "duplicate constraint without a field",
+			send: func(app *application, response http.ResponseWriter, request *http.Request) {
+				app.constraintViolationResponse(response, request, &data.ConstraintError{Err: data.ErrDuplicateRecord})
+			},
+			wantStatus:	http.StatusConflict,
+			wantCode:	errCodeDuplicateRecord,
+		},
+		{
+			name: "check constraint",
+			send: func(app *application, response http.ResponseWriter, request *http.Request) {
+				app.constraintViolationResponse(response, request, &data.ConstraintError{Err: data.ErrConstraintViolation})
+			},
+			wantStatus:	http.StatusUnprocessableEntity,
+			wantCode:	errCodeValidationFailed,
+		},
+		{
+			name: "failed validation",
+			send: func(app *application, response http.ResponseWriter, request *http.Request) {
+				app.failedValidationResponse(response, request, v)
+			},
+			wantStatus:	http.StatusUnprocessableEntity,
+			wantCode:	errCodeValidationFailed,
+		},
+		{
+			name: "idempotency key mismatch",
+			send: func(app *application, response http.ResponseWriter, request *http.Request) {
+				app.errorResponse(response, request, http.StatusUnprocessableEntity, errCodeIdempotencyKeyMismatch, "mismatch")
+			},
+			wantStatus:	http.StatusUnprocessableEntity,
+			wantCode:	errCodeIdempotencyKeyMismatch,
+		},
+		{
+			name: "idempotency key in progress",
+			send: func(app *application, response http.ResponseWriter, request *http.Request) {
+				app.errorResponse(response, request, http.StatusConflict, errCodeIdempotencyKeyInProgress, "in progress")
+			},
+			wantStatus:	http.StatusConflict,
+			wantCode:	errCodeIdempotencyKeyInProgress,
+		},
+		{
+			name: "server error",
+			send: func(app *application, response http.ResponseWriter, request *http.Request) {
+				app.serverErrorResponse(response, request, errors.New("boom"))
+			},
+			wantStatus:	http.StatusInternalServerError,
+			wantCode:	errCodeServerError,
+		},
+		{
+			name: "timeout",
+			send: func(app *application, response http.ResponseWriter, request *http.Request) {
+				app.serverErrorResponse(response, request, context.DeadlineExceeded)
+			},
+			wantStatus:	http.StatusServiceUnavailable,
+			wantCode:	errCodeTimeout,
+		},
+	}
+
+	for _, format := range []string{"envelope", "problem"} {
+		for _, tt := range tests {
+			t.Run(format+"/"+tt.name, func(t *testing.T) {
+				app := newTestApplication(t)
+				app.config.errorFormat = format
+
+				rr := httptest.NewRecorder()
+				tt.send(app, rr, httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil))
+
+				if rr.Code != tt.wantStatus {
+					t.Errorf("got status %d; want %d", rr.Code, tt.wantStatus)
+				}
+
+				var body struct {
+					Code	string	`json:"code"`
+				}
+				err := json.Unmarshal(rr.Body.Bytes(), &body)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !snakeCaseRX.MatchString(body.Code) {
+					t.Errorf("got code %q; want a non-empty snake_case code", body.Code)
+				}
+				if body.Code != tt.wantCode {
+					t.Errorf("got code %q; want %q", body.Code, tt.wantCode)
+				}
+			})
+		}
+	}
+}
+
+func TestDuplicateMovieResponse(t *testing.T) {
+	app := newTestApplication(t)
+
+	movie := &data.Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	err := app.models.Movies.Insert(context.Background(), movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The title differs only in case, which still clashes with the existing movie.
+	body := `{"title": "MOANA", "year": 2016, "runtime": "107 mins", "genres": ["animation"]}`
+
+	rr := httptest.NewRecorder()
+	app.createMovieHandler(rr, httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(body)))
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+	if got := rr.Header().Get("Location"); got != "/v1/movies/1" {
+		t.Errorf("got Location %q; want /v1/movies/1", got)
+	}
+
+	var response struct {
+		Code		string				`json:"code"`
+		Fields		map[string][]string	`json:"fields"`
+		ExistingID	int64				`json:"existing_id"`
+	}
+	err = json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Code != errCodeValidationFailed {
+		t.Errorf("got code %q; want %q", response.Code, errCodeValidationFailed)
+	}
+	if got := response.Fields["title"]; len(got) != 1 || got[0] != duplicateMovieMessage {
+		t.Errorf("got title errors %q; want [%q]", got, duplicateMovieMessage)
+	}
+	if response.ExistingID != movie.ID {
+		t.Errorf("got existing_id %d; want %d", response.ExistingID, movie.ID)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The eventBufferSize is the number of recent events which are kept so that clients
+// which reconnect with a Last-Event-ID header can catch up. The subscriberBufferSize is
+// the number of events which can be queued for a subscriber; a subscriber which falls
+// further behind than that is disconnected, and can reconnect to catch up.
+const (
+	eventBufferSize			= 256
+	subscriberBufferSize	= 32
+	eventKeepaliveInterval	= 15 * time.Second
+)
+
+// A movieEvent is a change to a movie, as sent to the event stream.
+type movieEvent struct {
+	id			uint64
+	eventType	string
+	data		[]byte
+}
+
+// The eventHub type is an in-process publish/subscribe hub for movie events. It keeps
+// the most recent events in a ring buffer so that they can be replayed. The zero value
+// is ready to use.
+type eventHub struct {
+	mu			sync.Mutex
+	nextID		uint64
+	buffer		[]movieEvent
+	start		int
+	subscribers	map[chan movieEvent]struct{}
+	closed		bool
+}
+
+// The publish() method sends an event to every subscriber, and adds it to the buffer.
+func (hub *eventHub) publish(eventType string, data []byte) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	hub.nextID++
+	event := movieEvent{id: hub.nextID, eventType: eventType, data: data}
+
+	if len(hub.buffer) < eventBufferSize {
+		hub.buffer = append(hub.buffer, event)
+	} else {
+		hub.buffer[hub.start] = event
+		hub.start = (hub.start + 1) % eventBufferSize
+	}
+
+	for ch := range hub.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// The subscriber isn't keeping up, so drop it.
+			delete(hub.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// The subscribe() method registers a new subscriber. If replay is true, the buffered
+// events with an ID greater than lastID are returned, so that no events are missed or
+// repeated between the replay and the live events. The channel is closed if the
+// subscriber falls behind or the hub is closed, and the returned function must be called
+// to unsubscribe.
+func (hub *eventHub) subscribe(replay bool, lastID uint64) ([]movieEvent, chan movieEvent, func()) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	var missed []movieEvent
+	if replay {
+		for i := range hub.buffer {
+			event := hub.buffer[(hub.start+i)%len(hub.buffer)]
+			if event.id > lastID {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	ch := make(chan movieEvent, subscriberBufferSize)
+
+	if hub.closed {
+		close(ch)
+		return missed, ch, func() {}
+	}
+
+	if hub.subscribers == nil {
+		hub.subscribers = make(map[chan movieEvent]struct{})
+	}
+	hub.subscribers[ch] = struct{}{}
+
+	unsubscribe := func() {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+
+		if _, ok := hub.subscribers[ch]; ok {
+			delete(hub.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return missed, ch, unsubscribe
+}
+
+// The close() method disconnects every subscriber, and stops new subscribers from
+// waiting for events. It's called when the server shuts down, as the streams would
+// otherwise hold up the shutdown.
+func (hub *eventHub) close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	hub.closed = true
+	for ch := range hub.subscribers {
+		delete(hub.subscribers, ch)
+		close(ch)
+	}
+}
+
+// The movieChanged() method is called by the movie handlers after a successful change.
+// It publishes the event to the event stream and notifies the webhooks. The movie
+// parameter is the movie data to include in the event (just the ID for a deleted movie).
+func (app *application) movieChanged(event string, movie any) {
+	payload, err := json.Marshal(envelope{"movie": movie})
+	if err != nil {
+		app.logger.PrintError(err, map[string]any{"event": event})
+	} else {
+		app.events.publish(event, payload)
+	}
+
+	app.notifyWebhooks(event, movie)
+}
+
+// The movieEventsHandler() handler streams movie events to the client as Server-Sent
+// Events until the client disconnects or the server shuts down. A comment is sent every
+// eventKeepaliveInterval so that proxies don't close an idle connection. If the client
+// sends a Last-Event-ID header (as browsers do when reconnecting), any buffered events
+// after that ID are sent first.
+func (app *application) movieEventsHandler(response http.ResponseWriter, request *http.Request) {
+	// A HEAD request only gets the headers, rather than a stream which never ends.
+	if request.Method == http.MethodHead {
+		response.Header().Set("Content-Type", "text/event-stream")
+		response.Header().Set("Cache-Control", "no-cache")
+		response.WriteHeader(http.StatusOK)
+		return
+	}
+
+	lastEventID := request.Header.Get("Last-Event-ID")
+	lastID, err := strconv.ParseUint(lastEventID, 10, 64)
+	replay := lastEventID != "" && err == nil
+
+	// The stream stays open for much longer than the server's write timeout, so remove
+	// the deadline for this response.
+	controller := http.NewResponseController(response)
+	err = controller.SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverErrorResponse(response, request, err)
+		return
+	}
+
+	missed, events, unsubscribe := app.events.subscribe(replay, lastID)
+	defer unsubscribe()
+
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.Header().Set("X-Accel-Buffering", "no")
+	response.WriteHeader(http.StatusOK)
+
+	send := func(event movieEvent) error {
+		_, err := fmt.Fprintf(response, "id: %d\nevent: %s\ndata: %s\n\n", event.id, event.eventType, event.data)
+		if err != nil {
+			return err
+		}
+		return controller.Flush()
+	}
+
+	for _, event := range missed {
+		if send(event) != nil {
+			return
+		}
+	}
+
+	err = controller.Flush()
+	if err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(eventKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if send(event) != nil {
+				return
+			}
+		case <-keepalive.C:
+			_, err := fmt.Fprint(response, ":keepalive\n\n")
+			if err != nil || controller.Flush() != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+	"github.com/julienschmidt/httprouter"
+	"greenlight.nursultandias.net/internal/data"
+	"greenlight.nursultandias.net/internal/validator"
+)
+
+// The genresCacheTTL is how long the list of genres is cached in memory for. Genres
+// change rarely, so there's no need to hit the database on every request.
+const genresCacheTTL = 60 * time.Second
+
+// The genresCache type holds the most recently fetched list of genres along with the
+// time that it expires. The mutex protects the fields from concurrent access.
+type genresCache struct {
+	mu		sync.Mutex
+	genres	[]*data.Genre
+	expires	time.Time
+}
+
+func (app *application) listGenresHandler(response http.ResponseWriter, request *http.Request) {
+	genres, err := app.cachedGenres(request)
+	if err != nil {
+		app.serverErrorResponse(response, request, err)
+		return
+	}
+
+	err = app.writeJSON(response, http.StatusOK, envelope{"genres": genres}, nil)
+	if err != nil {
+		app.serverErrorResponse(response, request, err)
+	}
+}
+
+// The cachedGenres() method returns the cached list of genres, each with its movie
+// count. If the cache has expired (or was never populated), a fresh copy is fetched from
+// the database and cached.
+func (app *application) cachedGenres(request *http.Request) ([]*data.Genre, error) {
+	app.genresCache.mu.Lock()
+	defer app.genresCache.mu.Unlock()
+
+	if time.Now().After(app.genresCache.expires) {
+		genres, err := app.models.Movies.AllGenres(request.Context())
+		if err != nil {
+			return nil, err
+		}
+
+		app.genresCache.genres = genres
+		app.genresCache.expires = time.Now().Add(genresCacheTTL)
+	}
+
+	return app.genresCache.genres, nil
+}
+
+// The addMovieGenreHandler() handler for POST /v1/movies/:id/genres adds a single genre
+// to a movie, so that clients don't have to send the whole genres array (and risk
+// overwriting someone else's change). Adding a genre which the movie already has
+// succeeds without changing the movie. The client can send the version it expects to be
+// editing in the same ways as for a PATCH request.
+func (app *application) addMovieGenreHandler(response http.ResponseWriter, request *http.Request) {
+	movie, ok := app.readMovieForGenres(response, request)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Genre	string	`json:"genre"`
+		Version	*int32	`json:"version,string"`
+	}
+
+	if !app.readJSONValidated(response, request, &input) {
+		return
+	}
+
+	if !app.checkMovieVersion(response, request, movie, input.Version) {
+		return
+	}
+
+	if slices.Contains(movie.Genres, input.Genre) {
+		app.writeUpdatedMovie(response, request, movie)
+		return
+	}
+
+	// Validate the movie with the new genre added, which checks that it won't have too
+	// many genres.
+	v := validator.New()
+
+	v.Check(validator.NotBlank(input.Genre), "genre", "must be provided")
+
+	updated := *movie
+	updated.Genres = append(slices.Clone(movie.Genres), input.Genre)
+
+	if data.ValidateMovie(v, &updated); !v.Valid() {
+		app.failedValidationResponse(response, request, v)
+		return
+	}
+
+	err := app.models.Movies.AddGenre(request.Context(), movie, input.Genre)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(response, request)
+		default:
+			app.serverErrorResponse(response, request, err)
+		}
+		return
+	}
+
+	app.movieChanged(data.EventMovieUpdated, movie)
+
+	app.writeUpdatedMovie(response, request, movie)
+}
+
+// The removeMovieGenreHandler() handler for DELETE /v1/movies/:id/genres/:genre removes
+// a single genre from a movie. A 404 Not Found response is sent if the movie doesn't
+// have the genre, and a 422 response if it's the movie's only genre. The expected
+// version can be sent in the If-Match or X-Expected-Version header.
+func (app *application) removeMovieGenreHandler(response http.ResponseWriter, request *http.Request) {
+	movie, ok := app.readMovieForGenres(response, request)
+	if !ok {
+		return
+	}
+
+	if !app.checkMovieVersion(response, request, movie, nil) {
+		return
+	}
+
+	genre := httprouter.ParamsFromContext(request.Context()).ByName("genre")
+
+	if !slices.Contains(movie.Genres, genre) {
+		app.notFoundResponse(response, request)
+		return
+	}
+
+	// Validate the movie with the genre removed, which checks that it will still have
+	// at least one genre.
+	v := validator.New()
+
+	updated := *movie
+	updated.Genres = slices.DeleteFunc(slices.Clone(movie.Genres), func(g string) bool { return g == genre })
+
+	if data.ValidateMovie(v, &updated); !v.Valid() {
+		app.failedValidationResponse(response, request, v)
+		return
+	}
+
+	err := app.models.Movies.RemoveGenre(request.Context(), movie, genre)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(response, request)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(response, request)
+		default:
+			app.serverErrorResponse(response, request, err)
+		}
+		return
+	}
+
+	app.movieChanged(data.EventMovieUpdated, movie)
+
+	app.writeUpdatedMovie(response, request, movie)
+}
+
+// The readMovieForGenres() helper reads the movie named by the :id URL parameter. It
+// returns false if a response has been sent, in which case the handler should return.
+func (app *application) readMovieForGenres(response http.ResponseWriter, request *http.Request) (*data.Movie, bool) {
+	id, err := app.readIDParam(request)
+	if err != nil {
+		app.notFoundResponse(response, request)
+		return nil, false
+	}
+
+	movie, err := app.models.Movies.Get(request.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(response, request)
+		default:
+			app.serverErrorResponse(response, request, err)
+		}
+		return nil, false
+	}
+
+	return movie, true
+}
+
+// The checkMovieVersion() helper checks the client's expected version of the movie
+// with expectedVersionMatches(), sending a 400 or 409 response if needed. It returns
+// false if a response has been sent.
+func (app *application) checkMovieVersion(response http.ResponseWriter, request *http.Request, movie *data.Movie, bodyVersion *int32) bool {
+	ok, err := app.expectedVersionMatches(request, movie, bodyVersion)
+	if err != nil {
+		app.badRequestResponse(response, request, err)
+		return false
+	}
+	if !ok {
+		app.editConflictResponse(response, request)
+		return false
+	}
+
+	return true
+}
@@ -1,21 +1,80 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"time"
+	"greenlight.nursultandias.net/migrations"
 )
 
 func (app *application) healthcheckHandler(response http.ResponseWriter, request *http.Request) {
+	// Check that the database is reachable by pinging the connection pool. We use a
+	// short timeout so that a hung database doesn't make the health check itself hang.
+	ctx, cancel := context.WithTimeout(request.Context(), 2*time.Second)
+	defer cancel()
+
+	status := "available"
+	database := "ok"
+	httpStatus := http.StatusOK
+
+	err := app.db.PingContext(ctx)
+	if err != nil {
+		// Log the error so that we know why the instance is reporting as unhealthy,
+		// then send a 503 Service Unavailable status so that load balancers stop
+		// routing traffic to this instance.
+		app.logError(request, err)
+
+		status = "degraded"
+		database = "unavailable"
+		httpStatus = http.StatusServiceUnavailable
+	}
+
+	// Include the connection pool statistics so that it's easy to spot when the pool
+	// is exhausted or connections are being waited on.
+	stats := app.db.Stats()
+
+	// Include the schema version, so that it's easy to check which migrations a
+	// deployment has. It's left null if the database couldn't be queried.
+	var migration any
+	if database == "ok" {
+		version, dirty, err := migrations.Version(ctx, app.db)
+		if err != nil {
+			app.logError(request, err)
+		} else {
+			migration = map[string]any{"version": version, "dirty": dirty}
+		}
+	}
+
 	// Create a map which holds the information that we want to send in the response. 
 	env := envelope{
-		"status": "available", 
-		"system_info": map[string]string{
+		"status": status, 
+		"database": database,
+		"system_info": map[string]any{
 						"environment": app.config.env,
 						"version": version,
+						"db": map[string]any{
+							"open_connections": stats.OpenConnections,
+							"in_use": stats.InUse,
+							"idle": stats.Idle,
+							"wait_count": stats.WaitCount,
+						},
+						"migration": migration,
 					},
 		}
 
+	err = app.writeJSON(response, httpStatus, env, nil)
+	if err != nil {
+		app.serverErrorResponse(response, request, err)
+	}
+}
+
+// The liveHandler is a lightweight liveness check. It never touches the database, so a
+// briefly unreachable database won't cause an orchestrator to restart the process.
+func (app *application) liveHandler(response http.ResponseWriter, request *http.Request) {
+	env := envelope{"status": "alive"}
+
 	err := app.writeJSON(response, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(response, request, err)
 	}
-}
\ No newline at end of file
+}
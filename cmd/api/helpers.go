@@ -1,15 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"net/url"
+	"reflect"
+	"sort"
 	"strconv"
 	"io"
 	"fmt"
 	"strings"
+	"time"
 	"github.com/julienschmidt/httprouter"
+	"greenlight.nursultandias.net/internal/data"
 	"greenlight.nursultandias.net/internal/validator"
 )
 
@@ -44,8 +49,18 @@ type envelope map[string]interface{}
 // header map containing any additional HTTP headers we want to include in the response.
 func (app *application) writeJSON(response http.ResponseWriter, status int, data envelope, headers http.Header) error {
 
-	// Encode the data to JSON, returning the error if there was one.
-	js, err := json.Marshal(data) 
+	// Encode the data to JSON, returning the error if there was one. If the client asked
+	// for pretty output (with ?pretty=true) we indent the JSON with two spaces, and in
+	// development we indent it with tabs to make it easier to read. Otherwise we use the
+	// compact form to keep response sizes down.
+	var js []byte
+	var err error
+
+	if indent := app.jsonIndent(response); indent != "" {
+		js, err = json.MarshalIndent(data, "", indent)
+	} else {
+		js, err = json.Marshal(data)
+	}
 	if err != nil {
 		return err 
 	}
@@ -61,32 +76,124 @@ func (app *application) writeJSON(response http.ResponseWriter, status int, data
 		response.Header()[key] = value
 	}
 
-	// Add the "Content-Type: application/json" header, then write the status code and 
+	// Add the "Content-Type: application/json" header (unless a more specific JSON
+	// content type was provided in the header map), then write the status code and 
 	// JSON response.
-	response.Header().Set("Content-Type", "application/json")
+	if headers.Get("Content-Type") == "" {
+		response.Header().Set("Content-Type", "application/json")
+	}
 	response.WriteHeader(status)
 	response.Write(js)
 	return nil
 }
 
+// The jsonIndent() helper returns the indentation to use for a JSON response: two
+// spaces if the client asked for pretty output, a tab in development, or the empty
+// string for compact output.
+// Other middleware may have wrapped the prettyResponseWriter, so we unwrap the writer
+// until we find it (or run out of writers).
+func (app *application) jsonIndent(response http.ResponseWriter) string {
+	for response != nil {
+		if _, ok := response.(*prettyResponseWriter); ok {
+			return "  "
+		}
+
+		unwrapper, ok := response.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		response = unwrapper.Unwrap()
+	}
+
+	if app.config.env == "development" {
+		return "\t"
+	}
+	return ""
+}
+
+// The writeJSONStream() helper is a variant of writeJSON() for large responses. Rather
+// than marshaling the data into a []byte first, it sends the headers and status code
+// and then encodes the data directly to the http.ResponseWriter. Because the status
+// code has already been sent by the time an encoding error could occur, there's no way
+// to report it to the client; instead we log the error and abort the connection, so
+// that the client sees a truncated response rather than invalid JSON with a 200 status.
+func (app *application) writeJSONStream(response http.ResponseWriter, request *http.Request, status int, data envelope, headers http.Header) {
+	for key, value := range headers {
+		response.Header()[key] = value
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+
+	// Like writeJSON(), indent the JSON when asked to or in development. The encoder
+	// adds a trailing newline after the value for us.
+	enc := json.NewEncoder(response)
+	if indent := app.jsonIndent(response); indent != "" {
+		enc.SetIndent("", indent)
+	}
+
+	err := enc.Encode(data)
+	if err != nil {
+		app.logError(request, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// The readJSON() helper decodes the JSON request body into dst. Keys which don't match a
+// field of dst are rejected, so that clients find out about typos straight away.
 func (app *application) readJSON(response http.ResponseWriter, request *http.Request, dst interface{}) error {
+	return app.decodeJSON(response, request, dst, false)
+}
+
+// The readJSONLenient() helper works like readJSON(), except that keys which don't match
+// a field of dst are ignored. Use it for endpoints which should accept requests from
+// newer clients that send fields this version doesn't know about.
+func (app *application) readJSONLenient(response http.ResponseWriter, request *http.Request, dst interface{}) error {
+	return app.decodeJSON(response, request, dst, true)
+}
+
+// The decodeJSON() helper does the work for readJSON() and readJSONLenient().
+func (app *application) decodeJSON(response http.ResponseWriter, request *http.Request, dst interface{}, allowUnknownFields bool) error {
+
+	// Use http.MaxBytesReader() to limit the size of the request body to the configured
+	// maximum (1MB by default, see the -max-body-bytes flag).
+	maxBytes := app.config.maxBodyBytes
+	request.Body = http.MaxBytesReader(response, request.Body, maxBytes)
 
-	// Use http.MaxBytesReader() to limit the size of the request body to 1MB.
-	maxBytes := 1_048_576
-	request.Body = http.MaxBytesReader(response, request.Body, int64(maxBytes))
+	// Read the whole body up front, so that we can go over it a second time to collect
+	// every problem with it if the first decode fails.
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+		}
+		return err
+	}
 
 	// Initialize the json.Decoder, and call the DisallowUnknownFields() method on it
-	// before decoding. This means that if the JSON from the client now includes any
-	// field which cannot be mapped to the target destination, the decoder will return
-	// an error instead of just ignoring the field.
-	dec := json.NewDecoder(request.Body) 
-	dec.DisallowUnknownFields()
+	// before decoding (unless unknown fields are allowed). This means that if the JSON
+	// from the client now includes any field which cannot be mapped to the target
+	// destination, the decoder will return an error instead of just ignoring the field.
+	dec := json.NewDecoder(bytes.NewReader(body)) 
+	if !allowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
 
 	// Decode the request body into the target destination.
-	err := dec.Decode(dst)
+	err = dec.Decode(dst)
 	if err != nil {
-		// If there is an error during decoding, start the triage/picking/sorting...
+		// If the body is a JSON object and the problem is with its fields (incorrect
+		// types, unknown keys or invalid values), decode it again field by field so
+		// that we can report all of the problems at once, instead of just the first.
 		var syntaxError *json.SyntaxError
+		if !errors.As(err, &syntaxError) && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			if fieldErrors := collectFieldErrors(body, dst, allowUnknownFields); len(fieldErrors) > 0 {
+				return fieldErrors
+			}
+		}
+
+		// Otherwise start the triage/picking/sorting...
 		var unmarshalTypeError *json.UnmarshalTypeError
 		var invalidUnmarshalError *json.InvalidUnmarshalError
 
@@ -126,11 +233,6 @@ func (app *application) readJSON(response http.ResponseWriter, request *http.Req
 				fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ") 
 				return fmt.Errorf("body contains unknown key %s", fieldName)
 			
-			// If the request body exceeds 1MB in size the decode will now fail with the
-			// error "http: request body too large".
-			case err.Error() == "http: request body too large":
-				return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
-
 			// A json.InvalidUnmarshalError error will be returned if we pass a non-nil
 			// pointer to Decode(). We catch this and panic, rather than returning an error
 			// to our handler. At the end of this chapter we'll talk about panicking
@@ -156,6 +258,153 @@ func (app *application) readJSON(response http.ResponseWriter, request *http.Req
 	return nil
 }
 
+// The jsonFieldErrors type holds the problems found with the individual fields of a
+// JSON request body, keyed by field name. It's returned as an error by readJSON().
+type jsonFieldErrors map[string]string
+
+func (e jsonFieldErrors) Error() string {
+	keys := make([]string, 0, len(e))
+	for key := range e {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return fmt.Sprintf("body contains invalid values for %s", strings.Join(keys, ", "))
+}
+
+// The collectFieldErrors() function decodes a JSON object into the struct that dst
+// points to one field at a time, and returns a problem for every field which couldn't
+// be decoded (including keys which don't match a field, unless allowUnknownFields is
+// set). It returns nil if the body isn't a JSON object or dst isn't a pointer to a
+// struct, in which case readJSON() falls back to reporting a single error.
+func collectFieldErrors(body []byte, dst interface{}, allowUnknownFields bool) jsonFieldErrors {
+	var raw map[string]json.RawMessage
+	if json.Unmarshal(body, &raw) != nil {
+		return nil
+	}
+
+	value := reflect.ValueOf(dst)
+	if value.Kind() != reflect.Pointer || value.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	value = value.Elem()
+
+	fieldErrors := make(jsonFieldErrors)
+
+	for key, rawValue := range raw {
+		field, quoted, ok := jsonField(value, key)
+		if !ok {
+			if !allowUnknownFields {
+				fieldErrors[key] = "is not a recognised key"
+			}
+			continue
+		}
+
+		// Fields with the ",string" tag option are sent as a JSON string containing the
+		// value, so unwrap the string before decoding it.
+		if quoted {
+			var s string
+			if json.Unmarshal(rawValue, &s) == nil {
+				rawValue = json.RawMessage(s)
+			}
+		}
+
+		err := json.Unmarshal(rawValue, field.Addr().Interface())
+		if err != nil {
+			var unmarshalTypeError *json.UnmarshalTypeError
+			var syntaxError *json.SyntaxError
+			switch {
+			case errors.As(err, &unmarshalTypeError), errors.As(err, &syntaxError):
+				fieldErrors[key] = "has an incorrect JSON type"
+			default:
+				fieldErrors[key] = err.Error()
+			}
+		}
+	}
+
+	return fieldErrors
+}
+
+// The jsonField() function finds the field of a struct which the given JSON key decodes
+// into, using the same rules as encoding/json: the name in the json tag if there is one,
+// otherwise the field name, matched case-insensitively. It also reports whether the
+// field has the ",string" tag option.
+func jsonField(value reflect.Value, key string) (reflect.Value, bool, bool) {
+	structType := value.Type()
+
+	for i := 0; i < structType.NumField(); i++ {
+		structField := structType.Field(i)
+		if !structField.IsExported() {
+			continue
+		}
+
+		name := structField.Name
+		quoted := false
+
+		tag := structField.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if tag != "" {
+			parts := strings.Split(tag, ",")
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, option := range parts[1:] {
+				quoted = quoted || option == "string"
+			}
+		}
+
+		if strings.EqualFold(name, key) {
+			return value.Field(i), quoted, true
+		}
+	}
+
+	return reflect.Value{}, false, false
+}
+
+// The readJSONValidated() helper decodes the request body into dst using readJSON(). If
+// there are problems with individual fields it sends a 422 Unprocessable Entity response
+// listing all of them, and for any other problem a 400 Bad Request response. It returns
+// false if a response has been sent, in which case the handler should return.
+func (app *application) readJSONValidated(response http.ResponseWriter, request *http.Request, dst interface{}) bool {
+	err := app.readJSON(response, request, dst)
+	if err != nil {
+		app.readJSONErrorResponse(response, request, err)
+		return false
+	}
+
+	return true
+}
+
+// The readJSONLenientValidated() helper is the same as readJSONValidated(), but decodes
+// the request body with readJSONLenient(), so unknown keys are ignored.
+func (app *application) readJSONLenientValidated(response http.ResponseWriter, request *http.Request, dst interface{}) bool {
+	err := app.readJSONLenient(response, request, dst)
+	if err != nil {
+		app.readJSONErrorResponse(response, request, err)
+		return false
+	}
+
+	return true
+}
+
+// The readJSONErrorResponse() helper sends the response for an error returned by
+// readJSON() or readJSONLenient().
+func (app *application) readJSONErrorResponse(response http.ResponseWriter, request *http.Request, err error) {
+	var fieldErrors jsonFieldErrors
+	switch {
+	case errors.As(err, &fieldErrors):
+		v := validator.New()
+		for key, message := range fieldErrors {
+			v.AddError(key, message)
+		}
+		app.failedValidationResponse(response, request, v)
+	default:
+		app.badRequestResponse(response, request, err)
+	}
+}
+
 // The readString() helper returns a string value from the query string, or the provided
 // default value if no matching key could be found.
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
@@ -173,8 +422,10 @@ func (app *application) readString(qs url.Values, key string, defaultValue strin
 }
 
 // The readCSV() helper reads a string value from the query string and then splits it
-// into a slice on the comma character. If no matching key could be found, it returns
-// the provided default value.
+// into a slice on the comma character. Whitespace around each value is trimmed, empty
+// values are dropped and duplicates are removed (keeping the first occurrence). If no
+// matching key could be found, or no values remain, it returns the provided default
+// value.
 func (app *application) readCSV(qs url.Values, key string, defaultValue []string) []string {
 	// Extract the value from the query string.
 	csv := qs.Get(key)
@@ -184,8 +435,25 @@ func (app *application) readCSV(qs url.Values, key string, defaultValue []string
 		return defaultValue
 	}
 
-	// Otherwise parse the value into a []string slice and return it.
-	return strings.Split(csv, ",")
+	// Otherwise parse the value into a []string slice, cleaning up each value.
+	values := []string{}
+	seen := make(map[string]bool)
+
+	for _, value := range strings.Split(csv, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" || seen[value] {
+			continue
+		}
+
+		seen[value] = true
+		values = append(values, value)
+	}
+
+	if len(values) == 0 {
+		return defaultValue
+	}
+
+	return values
 }
 
 // The readInt() helper reads a string value from the query string and converts it to an
@@ -212,3 +480,178 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	// Otherwise, return the converted integer value.
 	return i
 }
+
+// The readIntCSV() helper reads a comma-separated list of integers from the query
+// string, such as "1,5,9". Whitespace around each value is trimmed and empty values are
+// ignored. If no matching key could be found it returns the provided default value. If
+// any of the values couldn't be converted to an integer, then we record an error
+// message in the provided Validator instance and return the default value.
+func (app *application) readIntCSV(qs url.Values, key string, defaultValue []int64, v *validator.Validator) []int64 {
+	// Use readCSV() to split the value, which also trims and de-duplicates the values.
+	values := app.readCSV(qs, key, nil)
+	if values == nil {
+		return defaultValue
+	}
+
+	ints := make([]int64, 0, len(values))
+	for _, value := range values {
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			v.AddError(key, "must be a comma-separated list of integers")
+			return defaultValue
+		}
+		ints = append(ints, i)
+	}
+
+	return ints
+}
+
+// The readBool() helper reads a string value from the query string and converts it to a
+// boolean before returning. The values "true", "false", "1" and "0" are accepted. If no
+// matching key could be found it returns the provided default value. If the value isn't
+// one of the accepted values, then we record an error message in the provided Validator
+// instance.
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	// Extract the value from the query string.
+	s := qs.Get(key)
+
+	// If no key exists (or the value is empty) then return the default value.
+	if s == "" {
+		return defaultValue
+	}
+
+	// Convert the value to a bool. If it isn't one of the accepted values, add an error
+	// message to the validator instance and return the default value.
+	switch s {
+	case "true", "1":
+		return true
+	case "false", "0":
+		return false
+	default:
+		v.AddError(key, "must be a boolean value (true, false, 1 or 0)")
+		return defaultValue
+	}
+}
+
+// The readDate() helper reads a string value from the query string and parses it as a
+// date in the format YYYY-MM-DD. If no matching key could be found it returns the
+// provided default value. If the value couldn't be parsed, then we record an error
+// message in the provided Validator instance.
+func (app *application) readDate(qs url.Values, key string, defaultValue time.Time, v *validator.Validator) time.Time {
+	// Extract the value from the query string.
+	s := qs.Get(key)
+
+	// If no key exists (or the value is empty) then return the default value.
+	if s == "" {
+		return defaultValue
+	}
+
+	// Try to parse the value as a date. If this fails, add an error message to the
+	// validator instance and return the default value.
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		v.AddError(key, "must be a valid date (YYYY-MM-DD)")
+		return defaultValue
+	}
+
+	// Otherwise, return the parsed date.
+	return t
+}
+
+// The readTime() helper reads a string value from the query string and parses it as an
+// RFC 3339 timestamp (e.g. 2024-01-01T00:00:00Z). If no matching key could be found it
+// returns the provided default value. If the value couldn't be parsed, then we record an
+// error message in the provided Validator instance.
+func (app *application) readTime(qs url.Values, key string, defaultValue time.Time, v *validator.Validator) time.Time {
+	// Extract the value from the query string.
+	s := qs.Get(key)
+
+	// If no key exists (or the value is empty) then return the default value.
+	if s == "" {
+		return defaultValue
+	}
+
+	// Try to parse the value as a timestamp. If this fails, add an error message to the
+	// validator instance and return the default value.
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v.AddError(key, "must be a valid RFC 3339 timestamp (e.g. 2006-01-02T15:04:05Z)")
+		return defaultValue
+	}
+
+	// Otherwise, return the parsed timestamp.
+	return t
+}
+
+// The background() helper accepts an arbitrary function as a parameter and executes it
+// in a background goroutine. The goroutine is tracked by the application's WaitGroup so
+// that serve() can wait for it to complete during a graceful shutdown, and any panic
+// inside it is recovered and logged rather than terminating the application.
+func (app *application) background(fn func()) {
+	// Increment the WaitGroup counter (and the count of running tasks, which is used in
+	// the shutdown report).
+	app.wg.Add(1)
+	app.backgroundTasks.Add(1)
+
+	// Launch a background goroutine.
+	go func() {
+		// Use defer to decrement the WaitGroup counter and the running task count
+		// before the goroutine returns.
+		defer app.wg.Done()
+		defer app.backgroundTasks.Add(-1)
+
+		// Recover any panic.
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.PrintError(fmt.Errorf("%s", err), nil)
+			}
+		}()
+
+		// Execute the arbitrary function that we passed as the parameter.
+		fn()
+	}()
+}
+
+// The movieETag() helper returns a strong entity tag for a movie, derived from its ID
+// and version number (e.g. "42-7"). Because the version is incremented on every
+// update, the ETag changes whenever the movie data changes.
+func movieETag(movie *data.Movie) string {
+	return fmt.Sprintf(`"%d-%d"`, movie.ID, movie.Version)
+}
+
+// The etagMatches() helper reports whether an If-None-Match or If-Match request header
+// value matches the given entity tag. The header can contain a comma-separated list of
+// tags, or "*" to match any tag. When weak is true the weak comparison function is used
+// (so W/"42-7" matches "42-7"), otherwise weak tags in the header never match.
+func etagMatches(header string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if candidate == "*" {
+			return true
+		}
+
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+
+		if candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// The writeNotModified() helper sends a 304 Not Modified response with the provided
+// headers and no body. It's a sibling of writeJSON() for conditional requests, where
+// we can short-circuit before marshalling anything.
+func (app *application) writeNotModified(response http.ResponseWriter, headers http.Header) {
+	for key, value := range headers {
+		response.Header()[key] = value
+	}
+
+	response.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+	"greenlight.nursultandias.net/internal/data"
+)
+
+func TestReadCSV(t *testing.T) {
+	app := newTestApplication(t)
+	defaultValue := []string{"default"}
+
+	tests := []struct {
+		name	string
+		query	string
+		want	[]string
+	}{
+		{name: "missing", query: "", want: defaultValue},
+		{name: "empty", query: "genres=", want: defaultValue},
+		{name: "single value", query: "genres=drama", want: []string{"drama"}},
+		{name: "several values", query: "genres=drama,comedy,action", want: []string{"drama", "comedy", "action"}},
+		{name: "whitespace trimmed", query: "genres=+drama+,%09comedy", want: []string{"drama", "comedy"}},
+		{name: "empty values dropped", query: "genres=drama,,comedy,", want: []string{"drama", "comedy"}},
+		{name: "only separators", query: "genres=,,+,", want: defaultValue},
+		{name: "duplicates removed", query: "genres=drama,comedy,drama", want: []string{"drama", "comedy"}},
+		{name: "duplicates after trimming", query: "genres=drama,+drama+", want: []string{"drama"}},
+		{name: "case sensitive", query: "genres=Drama,drama", want: []string{"Drama", "drama"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qs, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := app.readCSV(qs, "genres", defaultValue)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// The discardResponseWriter type is a http.ResponseWriter which throws the body away,
+// so that the benchmarks below only measure the cost of encoding the response.
+type discardResponseWriter struct {
+	header	http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(status int) {}
+
+// The benchmarkMovies() helper returns an envelope holding a page of n movies, like the
+// one sent by listMoviesHandler.
+func benchmarkMovies(n int) envelope {
+	movies := make([]*data.Movie, n)
+	for i := range movies {
+		movies[i] = &data.Movie{
+			ID:			int64(i + 1),
+			CreatedAt:	time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			UpdatedAt:	time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			Title:		fmt.Sprintf("Movie %d", i+1),
+			Year:		2000 + int32(i%25),
+			Runtime:	data.Runtime(90 + i%60),
+			Genres:		[]string{"drama", "comedy"},
+			Version:	1,
+		}
+	}
+
+	total := n
+	return envelope{"movies": movies, "metadata": data.Metadata{CurrentPage: 1, PageSize: n, FirstPage: 1, LastPage: 1, TotalRecords: &total}}
+}
+
+// BenchmarkWriteJSON and BenchmarkWriteJSONStream compare the memory used to send a
+// page of 10,000 movies. Run them with:
+//
+//	go test ./cmd/api -run '^$' -bench WriteJSON
+func BenchmarkWriteJSON(b *testing.B) {
+	app := newTestApplication(b)
+	app.config.env = "production"
+	env := benchmarkMovies(10_000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := app.writeJSON(&discardResponseWriter{header: make(http.Header)}, http.StatusOK, env, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteJSONStream(b *testing.B) {
+	app := newTestApplication(b)
+	app.config.env = "production"
+	env := benchmarkMovies(10_000)
+	request := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		app.writeJSONStream(&discardResponseWriter{header: make(http.Header)}, request, http.StatusOK, env, nil)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"greenlight.nursultandias.net/internal/data"
+)
+
+// The idempotencyKeyHeader is the request header which clients set to make a request
+// safe to retry. The maxIdempotencyKeyLength is the longest key that we accept.
+const (
+	idempotencyKeyHeader	= "Idempotency-Key"
+	maxIdempotencyKeyLength	= 255
+)
+
+// The idempotencyReplayedHeaders are the response headers which are stored along with
+// the response body, and sent again when the response is replayed.
+var idempotencyReplayedHeaders = []string{"Content-Type", "Location"}
+
+// The idempotent() middleware honours the Idempotency-Key request header. The first
+// request with a key is processed as usual, and its response is stored. When a request
+// with the same key and body arrives again (within data.IdempotencyKeyTTL) the stored
+// response is sent instead, with an Idempotency-Replayed: true header, so that retrying
+// a request doesn't repeat its effects. Reusing a key with a different body is an
+// error. Requests without the header are passed straight through.
+func (app *application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		key := request.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next(response, request)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			app.badRequestResponse(response, request, errors.New("Idempotency-Key header must not be more than 255 bytes long"))
+			return
+		}
+
+		// Read the body so that we can hash it, then replace it for the handler. We read
+		// at most one byte more than the maximum body size, so that readJSON() still
+		// sees (and rejects) a body which is too large.
+		body, err := io.ReadAll(io.LimitReader(request.Body, app.config.maxBodyBytes+1))
+		if err != nil {
+			app.badRequestResponse(response, request, err)
+			return
+		}
+		request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), request.Body))
+
+		hash := sha256.Sum256(body)
+
+		record, err := app.models.IdempotencyKeys.Reserve(request.Context(), key, hex.EncodeToString(hash[:]))
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrIdempotencyKeyMismatch):
+				app.errorResponse(response, request, http.StatusUnprocessableEntity, errCodeIdempotencyKeyMismatch, "the Idempotency-Key header has already been used with a different request body")
+			case errors.Is(err, data.ErrIdempotencyKeyInProgress):
+				app.errorResponse(response, request, http.StatusConflict, errCodeIdempotencyKeyInProgress, "a request with this Idempotency-Key header is still being processed, please try again")
+			default:
+				app.serverErrorResponse(response, request, err)
+			}
+			return
+		}
+
+		// If there's a stored response, replay it.
+		if record != nil {
+			for name, values := range record.Headers {
+				response.Header()[name] = values
+			}
+			response.Header().Set("Idempotency-Replayed", "true")
+			response.WriteHeader(record.Status)
+			response.Write(record.Body)
+			return
+		}
+
+		// The key must be released or completed even if the client has gone away, so we
+		// use a context which isn't cancelled along with the request.
+		ctx := context.WithoutCancel(request.Context())
+
+		// If the handler panics, release the key before the panic is passed on to the
+		// recoverPanic() middleware, so that the client can retry.
+		defer func() {
+			if pv := recover(); pv != nil {
+				app.models.IdempotencyKeys.Release(ctx, key)
+				panic(pv)
+			}
+		}()
+
+		recorder := &idempotencyResponseWriter{ResponseWriter: response, statusCode: http.StatusOK}
+		next(recorder, request)
+
+		// Server errors aren't stored, so that the client can retry the request with the
+		// same key. Otherwise we store the response for replaying. The client has already
+		// received its response, so we can only log any errors here.
+		if recorder.statusCode >= http.StatusInternalServerError {
+			err = app.models.IdempotencyKeys.Release(ctx, key)
+			if err != nil {
+				app.logError(request, err)
+			}
+			return
+		}
+
+		headers := make(map[string][]string)
+		for _, name := range idempotencyReplayedHeaders {
+			if values := response.Header().Values(name); len(values) > 0 {
+				headers[name] = values
+			}
+		}
+
+		err = app.models.IdempotencyKeys.Complete(ctx, &data.IdempotencyRecord{
+			Key:		key,
+			Status:		recorder.statusCode,
+			Headers:	headers,
+			Body:		recorder.body.Bytes(),
+		})
+		if err != nil {
+			app.logError(request, err)
+		}
+	}
+}
+
+// The idempotencyResponseWriter type wraps an http.ResponseWriter and keeps a copy of
+// the status code and body which were written, so that they can be stored.
+type idempotencyResponseWriter struct {
+	http.ResponseWriter
+	statusCode		int
+	headerWritten	bool
+	body			bytes.Buffer
+}
+
+func (iw *idempotencyResponseWriter) WriteHeader(statusCode int) {
+	iw.ResponseWriter.WriteHeader(statusCode)
+
+	if !iw.headerWritten {
+		iw.statusCode = statusCode
+		iw.headerWritten = true
+	}
+}
+
+func (iw *idempotencyResponseWriter) Write(b []byte) (int, error) {
+	iw.headerWritten = true
+	iw.body.Write(b)
+	return iw.ResponseWriter.Write(b)
+}
+
+func (iw *idempotencyResponseWriter) Unwrap() http.ResponseWriter {
+	return iw.ResponseWriter
+}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"expvar"
 	"flag"
+	"errors"
 	"fmt" 
-	"net/http"
 	"os" 
+	"net/netip"
+	"net/url"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"context"
 	"database/sql"
@@ -15,12 +24,15 @@ import (
 	_ "github.com/lib/pq"
 	"greenlight.nursultandias.net/internal/data"
 	"greenlight.nursultandias.net/internal/jsonlog"
+	"greenlight.nursultandias.net/internal/vcs"
+	"greenlight.nursultandias.net/migrations"
 )
 
-// application version number. 
-// Later it will generate this automatically at build time
-// but for now it is hard-coded
-const version = "1.0.0"
+// Read the application version from the build information (with a hard-coded
+// fallback) once at startup.
+var (
+	version = vcs.Version()
+)
 
 // The config structure holds port number(port) and stage(env) of the application.
 // Add a db struct field to hold the configuration settings for our database connection
@@ -28,13 +40,58 @@ const version = "1.0.0"
 // maxOpenConns, maxIdleConns and maxIdleTime fields to hold the configuration
 // settings for the connection pool.
 type config struct {
-	port	int
-	env		string
+	port			int
+	env				string
+	maxBodyBytes	int64
+	maxPageSize		int
+	errorFormat		string
 	db		struct {
 		dsn				string
+		readDSN			string
 		maxOpenConns	int
 		maxIdleConns	int
 		maxIdleTime		string
+		queryTimeout	time.Duration
+		legacyTimeout	time.Duration
+		connectRetries	int
+		connectBackoff	time.Duration
+		migrate			bool
+	}
+	cors	struct {
+		trustedOrigins	[]string
+	}
+	log		struct {
+		level		string
+		file		string
+		maxSizeMB	int
+		maxBackups	int
+		requests	bool
+		infoSample	int
+	}
+	gzip	struct {
+		minSize	int
+	}
+	server	struct {
+		idleTimeout		time.Duration
+		readTimeout		time.Duration
+		writeTimeout	time.Duration
+	}
+	pprof	struct {
+		enabled	bool
+		allow	[]netip.Prefix
+	}
+	metrics	struct {
+		enabled		bool
+		username	string
+		password	string
+	}
+	admin	struct {
+		username	string
+		password	string
+	}
+	tls		struct {
+		certFile	string
+		keyFile		string
 	}
 }
 
@@ -48,10 +105,22 @@ type config struct {
 // ⭐ Keep track of important operations (like database changes)
 // ⭐ Record who did what and when
 // Add a models field to hold our new Models struct.
+// The db field holds the connection pool itself, which is used by the healthcheck.
+// The wg, inFlight and backgroundTasks fields are used during graceful shutdown to
+// track the requests and background goroutines which are still running. The events
+// field is the hub which feeds the movie event stream, and the prometheus field holds
+// the Prometheus collectors (or nil if they're disabled).
 type application struct {
-	config	config
-	logger	*jsonlog.Logger
-	models data.Models
+	config			config
+	logger			*jsonlog.Logger
+	db				*sql.DB
+	models			data.Models
+	wg				sync.WaitGroup
+	inFlight		atomic.Int64
+	backgroundTasks	atomic.Int64
+	genresCache		genresCache
+	events			eventHub
+	prometheus		*promMetrics
 }
 
 func main() {
@@ -66,72 +135,468 @@ func main() {
 	// for our db-dsn command-line flag.
 	flag.StringVar(&cfg.db.dsn, "db-dsn",  os.Getenv("GREENLIGHT_DB_DSN"), "PostgreSQL DSN")
 
+	// Optionally read the DSN of a read replica, which serves the read-only movie
+	// queries. If it's empty, every query goes to the -db-dsn database.
+	flag.StringVar(&cfg.db.readDSN, "db-read-dsn", "", "PostgreSQL read replica DSN (optional)")
+
 	// Read the connection pool settings from command-line flags into the config struct.
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
 
+	// Read the maximum time allowed for each database query. The older -db-timeout name
+	// is still accepted for existing deployments, but it's deprecated and is folded into
+	// -db-query-timeout by resolveQueryTimeout().
+	flag.DurationVar(&cfg.db.queryTimeout, "db-query-timeout", data.DefaultQueryTimeout, "PostgreSQL query timeout")
+	flag.DurationVar(&cfg.db.legacyTimeout, "db-timeout", 0, "PostgreSQL query timeout (deprecated, use -db-query-timeout)")
+
+	// Read how many times to retry connecting to the database at startup, and how long
+	// to wait before the first retry (the wait doubles for each retry after that). This
+	// gives the database time to start when both are started together.
+	flag.IntVar(&cfg.db.connectRetries, "db-connect-retries", 10, "PostgreSQL connection retries at startup")
+	flag.DurationVar(&cfg.db.connectBackoff, "db-connect-backoff", 250*time.Millisecond, "PostgreSQL wait before the first connection retry")
+
+	// Apply any pending database migrations (which are embedded in the binary) at
+	// startup, before the models are used.
+	flag.BoolVar(&cfg.db.migrate, "db-migrate", false, "Apply pending PostgreSQL migrations at startup")
+
+	// Use the flag.Func() function to process the -cors-trusted-origins command line
+	// flag. In this we use the strings.Fields() function to split the flag value into a
+	// slice based on whitespace characters and assign it to our config struct.
+	// Importantly, if the -cors-trusted-origins flag is not present, contains the empty
+	// string, or contains only whitespace, then strings.Fields() will return an empty
+	// []string slice.
+	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
+		cfg.cors.trustedOrigins = strings.Fields(val)
+		return nil
+	})
+
+	// Read the maximum size (in bytes) of request bodies accepted by readJSON().
+	flag.Int64Var(&cfg.maxBodyBytes, "max-body-bytes", 1_048_576, "Maximum request body size in bytes")
+
+	// Read the largest page_size which clients can ask for when listing movies.
+	flag.IntVar(&cfg.maxPageSize, "max-page-size", data.DefaultMaxPageSize, "Maximum page_size for paginated lists")
+
+	// Read the format used for error responses: our own {"error": ...} envelope, or
+	// RFC 7807 problem details.
+	flag.StringVar(&cfg.errorFormat, "error-format", "envelope", "Error response format (envelope|problem)")
+
+	// Read the minimum response size (in bytes) which will be gzip compressed.
+	flag.IntVar(&cfg.gzip.minSize, "gzip-min-size", defaultGzipMinSize, "Minimum response size in bytes to gzip compress")
+
+	// Read the HTTP server timeouts. These may need raising for clients on slow
+	// connections.
+	flag.DurationVar(&cfg.server.idleTimeout, "idle-timeout", time.Minute, "HTTP server idle connection timeout")
+	flag.DurationVar(&cfg.server.readTimeout, "read-timeout", 10*time.Second, "HTTP server request read timeout")
+	flag.DurationVar(&cfg.server.writeTimeout, "write-timeout", 30*time.Second, "HTTP server response write timeout")
+
+	// Optionally serve the pprof profiling endpoints under /debug/pprof/, restricted to
+	// the given IP addresses and CIDR ranges (space separated) if any are given.
+	flag.BoolVar(&cfg.pprof.enabled, "debug-pprof", false, "Serve the pprof profiling endpoints at /debug/pprof/")
+	flag.Func("debug-pprof-allow", "IP addresses and CIDR ranges allowed to use /debug/pprof/ (space separated)", func(val string) error {
+		prefixes, err := parseIPAllowlist(val)
+		if err != nil {
+			return err
+		}
+		cfg.pprof.allow = prefixes
+		return nil
+	})
+
+	// Optionally export Prometheus metrics at /metrics, protected with basic auth if a
+	// username and password are given.
+	flag.BoolVar(&cfg.metrics.enabled, "metrics-enabled", false, "Export Prometheus metrics at /metrics")
+	flag.StringVar(&cfg.metrics.username, "metrics-username", "", "Basic auth username for /metrics (optional)")
+	flag.StringVar(&cfg.metrics.password, "metrics-password", "", "Basic auth password for /metrics (optional)")
+
+	// Read the basic auth credentials for the administrative endpoints (the webhooks).
+	// There are no user accounts yet, so those endpoints are only registered when both
+	// are set.
+	flag.StringVar(&cfg.admin.username, "admin-username", "", "Basic auth username for the admin endpoints (enables /v1/webhooks)")
+	flag.StringVar(&cfg.admin.password, "admin-password", "", "Basic auth password for the admin endpoints")
+
+	// Optionally serve HTTPS directly, using the given certificate and private key
+	// files. Both flags must be set together.
+	flag.StringVar(&cfg.tls.certFile, "tls-cert", "", "TLS certificate file (enables HTTPS along with -tls-key)")
+	flag.StringVar(&cfg.tls.keyFile, "tls-key", "", "TLS private key file (enables HTTPS along with -tls-cert)")
+
+	// Read the minimum severity level for log entries. This is checked with
+	// jsonlog.ParseLevel() once all of the configuration layers have been applied.
+	flag.StringVar(&cfg.log.level, "log-level", "info", "Minimum log level (debug|info|warning|error|fatal|off)")
+
+	// Optionally write the logs to a file (rather than standard out) which is rotated
+	// once it reaches the given size.
+	flag.StringVar(&cfg.log.file, "log-file", "", "Write logs to this file instead of standard out")
+	flag.IntVar(&cfg.log.maxSizeMB, "log-max-size-mb", 100, "Maximum log file size in megabytes before rotation")
+	flag.IntVar(&cfg.log.maxBackups, "log-max-backups", 5, "Number of rotated log files to keep")
+
+	// Write an access log entry for every request unless -log-requests=false is given.
+	flag.BoolVar(&cfg.log.requests, "log-requests", true, "Log every completed request")
+
+	// Optionally write only 1 in every N INFO entries, which is useful when the request
+	// log gets very busy. Errors are never sampled.
+	flag.IntVar(&cfg.log.infoSample, "log-info-sample", 1, "Write only 1 in every N INFO log entries")
+
+	// Create a new version boolean flag with the default value of false.
+	displayVersion := flag.Bool("version", false, "Display version and exit")
+
+	// The -config-file flag points at an optional JSON or YAML file containing
+	// configuration values, keyed by flag name. See config.go for how the layers are
+	// combined.
+	configFile := flag.String("config-file", "", "Path to a JSON or YAML (.yaml/.yml) configuration file")
+
 	flag.Parse()
 
+	// If the version flag value is true, then print out the version number and
+	// immediately exit, before any connection to the database is attempted.
+	if *displayVersion {
+		fmt.Printf("Version:\t%s\n", version)
+		os.Exit(exitOK)
+	}
+
 	// Initialize a new jsonlog.Logger which writes any messages *at or above* the INFO
-	// severity level to the standard out stream.
+	// severity level to the standard out stream. This is used to report problems with
+	// the configuration itself, before the configured log level is known.
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
-	// Call the openDB() helper function (see below after main function) to create the connection pool,
-	// passing in the config struct. If this returns an error, we log it and exit the
-	// application immediately.
-	db, err := openDB(cfg)
+	// Apply the config file and environment variable layers. Flags which were set
+	// explicitly on the command line keep their values.
+	err := applyConfigLayers(flag.CommandLine, *configFile)
+	if err != nil {
+		logger.PrintError(err, nil)
+		os.Exit(exitConfigInvalid)
+	}
+
+	// Fold the deprecated -db-timeout flag into -db-query-timeout, refusing to guess if
+	// both were given different values.
+	usedLegacyTimeout, err := resolveQueryTimeout(flag.CommandLine, &cfg)
+	if err != nil {
+		logger.PrintError(err, nil)
+		os.Exit(exitConfigInvalid)
+	}
+
+	// Now that the configuration is final, parse the log level and recreate the logger
+	// with it.
+	level, err := jsonlog.ParseLevel(cfg.log.level)
 	if err != nil {
-		// Use the PrintFatal() method to write a log entry containing the error at the
-		// FATAL level and exit. We have no additional properties to include in the log
-		// entry, so we pass nil as the second parameter.
-		logger.PrintFatal(err, nil)
+		logger.PrintError(err, nil)
+		os.Exit(exitConfigInvalid)
+	}
+	opts := []jsonlog.Option{jsonlog.WithInfoSampling(cfg.log.infoSample)}
+	if cfg.log.file != "" {
+		opts = append(opts, jsonlog.WithRotatingFile(cfg.log.file, cfg.log.maxSizeMB, cfg.log.maxBackups))
+	}
+	logger = jsonlog.New(os.Stdout, level, opts...)
+
+	// Include the service name and operating environment in every log entry, so that
+	// entries from different deployments can be told apart once they're aggregated.
+	logger = logger.With(map[string]any{
+		"service":	"greenlight",
+		"env":		cfg.env,
+	})
+
+	if usedLegacyTimeout {
+		logger.PrintWarning("the -db-timeout flag is deprecated, use -db-query-timeout instead", nil)
 	}
 
-	// Defer a call to db.Close() so that the connection pool is closed before the
-	// main() function exits.
-	defer db.Close()
+	// Reopen the log file whenever a SIGHUP signal is received, so that logrotate can
+	// move the file without needing the copytruncate option.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			err := logger.Reopen()
+			if err != nil {
+				logger.PrintError(err, nil)
+			}
+		}
+	}()
+
+	// Log the effective configuration as a single entry, with any passwords redacted.
+	properties := effectiveConfig(flag.CommandLine)
+	properties["cors-trusted-origins"] = cfg.cors.trustedOrigins
+	properties["debug-pprof-allow"] = cfg.pprof.allow
+	logger.PrintInfo("configuration loaded", properties)
+
+	// Call run() to start the application and translate its result into the process
+	// exit code. main() is the only place in the application which calls os.Exit(), so
+	// that every other code path simply returns and can be exercised in isolation.
+	code := run(cfg, logger, newLifecycle())
+
+	// Close the log file (if any) so that everything is flushed before exiting.
+	logger.Close()
+	os.Exit(code)
+}
+
+// The lifecycle type holds the functions which run() calls to open the database
+// connection pools, apply the migrations and serve requests. main() uses the real
+// implementations from newLifecycle(), while the tests swap them out so that every exit
+// code can be reached without a database or a network listener.
+type lifecycle struct {
+	openDB	func(ctx context.Context, cfg config, logger *jsonlog.Logger) (*sql.DB, *sql.DB, error)
+	migrate	func(ctx context.Context, db *sql.DB) (int64, int, error)
+	serve	func(app *application) (shutdownReport, error)
+}
+
+// The newLifecycle() function returns the lifecycle used in production.
+func newLifecycle() lifecycle {
+	return lifecycle{
+		openDB:		openDB,
+		migrate:	migrations.Up,
+		serve:		(*application).serve,
+	}
+}
+
+// The publishVars variable makes sure that the expvar variables are only published
+// once, as expvar panics if the same name is published twice.
+var publishVars sync.Once
+
+// The run() function validates the configuration, opens the database connection pool,
+// serves requests until a shutdown signal is received, and then returns the exit code
+// which describes how the application stopped.
+func run(cfg config, logger *jsonlog.Logger, lc lifecycle) int {
+	// Check that the configuration values are sensible before doing anything else.
+	err := validateConfig(cfg)
+	if err != nil {
+		logger.PrintError(err, nil)
+		return exitConfigInvalid
+	}
+
+	// Call the openDB() helper function (see below after main function) to create the connection pools,
+	// passing in the config struct. If this returns an error, we log it and return the
+	// "database unavailable" exit code. The context is cancelled by a SIGINT or SIGTERM
+	// signal, so that the connection retries can be interrupted.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	db, readDB, err := lc.openDB(ctx, cfg, logger)
+	stop()
+	if err != nil {
+		logger.PrintError(err, nil)
+		return exitDatabaseUnavailable
+	}
+
+	// The closeDB() function closes both connection pools (the replica pool is the
+	// primary pool when there's no replica).
+	closeDB := func() error {
+		if readDB != db {
+			readDB.Close()
+		}
+		return db.Close()
+	}
 
 	// Likewise use the PrintInfo() method to write a message at the INFO level.
-	logger.PrintInfo("database connection pool established", nil)
+	logger.PrintInfo("database connection pool established", map[string]any{
+		"read_replica":	readDB != db,
+	})
+
+	// If the -db-migrate flag is set, bring the schema up to date before anything uses
+	// the database. A dirty schema needs fixing by hand, so we refuse to start.
+	if cfg.db.migrate {
+		version, applied, err := lc.migrate(context.Background(), db)
+		if err != nil {
+			logger.PrintError(err, map[string]any{"schema_version": version})
+			closeDB()
+			return exitMigrationFailed
+		}
+
+		logger.PrintInfo("database migrations applied", map[string]any{
+			"schema_version":	version,
+			"applied":			applied,
+		})
+	}
+
+	// Publish the application version and operating environment as expvar strings, and
+	// the current Unix timestamp as a function so that it's evaluated on every request
+	// to /debug/vars.
+	publishVars.Do(func() {
+		expvar.NewString("version").Set(version)
+		expvar.NewString("env").Set(cfg.env)
+		expvar.Publish("timestamp", expvar.Func(func() interface{} {
+			return time.Now().Unix()
+		}))
+
+		// Publish the database connection pool statistics under a "database" key in
+		// the expvar handler output. The function is called each time /debug/vars is
+		// hit, so the values are always current.
+		expvar.Publish("database", expvar.Func(func() interface{} {
+			return db.Stats()
+		}))
+	})
 
 	// Use the data.NewModels() function to initialize a Models struct, passing in the
 	// connection pool as a parameter.
 	app := &application{
 		config: cfg,
 		logger: logger,
-		models: data.NewModels(db),
-	}
-
-	// Declare a HTTP server with some sensible timeout settings, which listens on the 
-	// port provided in the config struct and uses the servemux we created above as the 
-	// handler
-	srv := &http.Server{
-		Addr:	fmt.Sprintf(":%d", cfg.port),
-		Handler: app.routes(),
-		IdleTimeout: time.Minute,
-		ReadTimeout: 10 * time.Second,
-		WriteTimeout: 30 * time.Second,
-	}
-
-	// Again, we use the PrintInfo() method to write a "starting server" message at the
-	// INFO level. But this time we pass a map containing additional properties (the
-	// operating environment and server address) as the final parameter.
-	logger.PrintInfo("starting server", map[string]string{
-		"addr":	srv.Addr,
-		"env":	cfg.env,
+		db:		db,
+		models: data.NewModels(db, readDB, cfg.db.queryTimeout),
+	}
+
+	// Create the Prometheus collectors if the metrics are enabled. If they're not, the
+	// prometheus field is left nil and the /metrics endpoint isn't registered.
+	if cfg.metrics.enabled {
+		app.prometheus = newPromMetrics(db, readDB)
+	}
+
+	// Call the serve function (app.serve() outside of the tests) to start the server.
+	// This blocks until the server has been shut down, and returns a report describing
+	// how the shutdown went.
+	report, err := lc.serve(app)
+	if err != nil {
+		logger.PrintError(err, nil)
+		closeDB()
+		return exitServerError
+	}
+
+	// Stop the remaining components (currently just the database connection pools) and
+	// record how long this took.
+	start := time.Now()
+	err = closeDB()
+	if err != nil {
+		logger.PrintError(err, nil)
+	}
+	report.componentStopDuration = time.Since(start)
+
+	// Emit a final log entry summarizing the shutdown, then return the matching exit code.
+	logger.PrintInfo("shutdown complete", report.properties())
+
+	return report.exitCode()
+}
+
+// The resolveQueryTimeout() function copies the value of the deprecated -db-timeout
+// flag into cfg.db.queryTimeout, and reports whether -db-timeout was used so that a
+// deprecation warning can be logged. Flags set through the config file or environment
+// variables count as set, since applyConfigLayers() sets them on the flag set. It's an
+// error to give both flags with different values.
+func resolveQueryTimeout(fs *flag.FlagSet, cfg *config) (bool, error) {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
 	})
 
-	err = srv.ListenAndServe()
-	// Use the PrintFatal() method to log the error and exit.
-	logger.PrintFatal(err, nil)
+	if !set["db-timeout"] {
+		return false, nil
+	}
+
+	if set["db-query-timeout"] && cfg.db.queryTimeout != cfg.db.legacyTimeout {
+		return true, fmt.Errorf("conflicting -db-timeout (%s) and -db-query-timeout (%s) values: remove the deprecated -db-timeout", cfg.db.legacyTimeout, cfg.db.queryTimeout)
+	}
+
+	cfg.db.queryTimeout = cfg.db.legacyTimeout
+	return true, nil
+}
+
+// The validateConfig() function checks the configuration values which would otherwise
+// only fail later on (or not at all), so that a bad deployment is caught immediately.
+func validateConfig(cfg config) error {
+	if cfg.port < 1 || cfg.port > 65535 {
+		return fmt.Errorf("invalid -port value %d: must be between 1 and 65535", cfg.port)
+	}
+
+	switch cfg.env {
+	case "development", "staging", "production":
+	default:
+		return fmt.Errorf("invalid -env value %q: must be development, staging or production", cfg.env)
+	}
+
+	switch cfg.errorFormat {
+	case "envelope", "problem":
+	default:
+		return fmt.Errorf("invalid -error-format value %q: must be envelope or problem", cfg.errorFormat)
+	}
+
+	if cfg.db.dsn == "" {
+		return errors.New("missing -db-dsn value")
+	}
+
+	if cfg.db.queryTimeout <= 0 {
+		return fmt.Errorf("invalid -db-query-timeout value %s: must be positive", cfg.db.queryTimeout)
+	}
+
+	if cfg.maxBodyBytes < 1 {
+		return fmt.Errorf("invalid -max-body-bytes value %d: must be positive", cfg.maxBodyBytes)
+	}
+
+	if cfg.db.connectRetries < 0 {
+		return fmt.Errorf("invalid -db-connect-retries value %d: must not be negative", cfg.db.connectRetries)
+	}
+
+	if cfg.db.connectBackoff <= 0 {
+		return fmt.Errorf("invalid -db-connect-backoff value %s: must be positive", cfg.db.connectBackoff)
+	}
+
+	if cfg.server.idleTimeout <= 0 {
+		return fmt.Errorf("invalid -idle-timeout value %s: must be positive", cfg.server.idleTimeout)
+	}
+
+	if cfg.server.readTimeout <= 0 {
+		return fmt.Errorf("invalid -read-timeout value %s: must be positive", cfg.server.readTimeout)
+	}
+
+	if cfg.server.writeTimeout <= 0 {
+		return fmt.Errorf("invalid -write-timeout value %s: must be positive", cfg.server.writeTimeout)
+	}
+
+	if cfg.maxPageSize < 1 {
+		return fmt.Errorf("invalid -max-page-size value %d: must be positive", cfg.maxPageSize)
+	}
+
+	if cfg.gzip.minSize < 0 {
+		return fmt.Errorf("invalid -gzip-min-size value %d: must not be negative", cfg.gzip.minSize)
+	}
+
+	if (cfg.metrics.username == "") != (cfg.metrics.password == "") {
+		return errors.New("-metrics-username and -metrics-password must be set together")
+	}
+
+	if (cfg.admin.username == "") != (cfg.admin.password == "") {
+		return errors.New("-admin-username and -admin-password must be set together")
+	}
+
+	if (cfg.tls.certFile == "") != (cfg.tls.keyFile == "") {
+		return errors.New("-tls-cert and -tls-key must be set together")
+	}
+
+	_, err := time.ParseDuration(cfg.db.maxIdleTime)
+	if err != nil {
+		return fmt.Errorf("invalid -db-max-idle-time value %q", cfg.db.maxIdleTime)
+	}
+
+	return nil
 }
 
+// The dbConnectMaxBackoff is the longest that openPool() waits between connection
+// attempts. With the default flags, the attempts are spread over roughly 30 seconds.
+const dbConnectMaxBackoff = 5 * time.Second
 
-// The openDB() function returns a sql.DB connection pool.
-func openDB(cfg config) (*sql.DB, error) {
-	// Use sql.Open() to create an empty connection pool, using the DSN from the config struct.
-	db, err := sql.Open("postgres", cfg.db.dsn)
+// The openDB() function returns the sql.DB connection pools for the primary database
+// and the read replica. If no -db-read-dsn was given, the primary pool is returned for
+// both.
+func openDB(ctx context.Context, cfg config, logger *jsonlog.Logger) (*sql.DB, *sql.DB, error) {
+	db, err := openPool(ctx, cfg, cfg.db.dsn, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.db.readDSN == "" {
+		return db, db, nil
+	}
+
+	readDB, err := openPool(ctx, cfg, cfg.db.readDSN, logger.With(map[string]any{"pool": "replica"}))
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	return db, readDB, nil
+}
+
+// The openPool() function returns a sql.DB connection pool for a DSN. If the database
+// can't be reached, it retries up to cfg.db.connectRetries times with exponential
+// backoff, logging each failed attempt. The retries stop early if the context is
+// cancelled.
+func openPool(ctx context.Context, cfg config, dsn string, logger *jsonlog.Logger) (*sql.DB, error) {
+	// Use sql.Open() to create an empty connection pool, using the DSN with a
+	// statement_timeout added, so that PostgreSQL enforces the query timeout too.
+	db, err := sql.Open("postgres", withStatementTimeout(dsn, cfg.db.queryTimeout))
 	if err != nil {
 		return nil, err
 	}
@@ -154,17 +619,71 @@ func openDB(cfg config) (*sql.DB, error) {
 	// Set the maximum idle timeout.
 	db.SetConnMaxIdleTime(duration)
 
+	backoff := cfg.db.connectBackoff
+	for attempt := 1; ; attempt++ {
+		err = pingDB(ctx, db)
+		if err == nil {
+			// Return the sql.DB connection pool.
+			return db, nil
+		}
+
+		if attempt > cfg.db.connectRetries || ctx.Err() != nil {
+			db.Close()
+			return nil, err
+		}
+
+		logger.PrintWarning("database connection failed, retrying", map[string]any{
+			"attempt":		attempt,
+			"max_attempts":	cfg.db.connectRetries + 1,
+			"backoff":		backoff.String(),
+			"error":		err.Error(),
+		})
+
+		select {
+		case <-ctx.Done():
+			db.Close()
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, dbConnectMaxBackoff)
+	}
+}
+
+// The pingDB() function makes a single attempt to connect to the database.
+func pingDB(ctx context.Context, db *sql.DB) error {
 	// Create a context with a 5-second timeout deadline.
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	// Use PingContext() to establish a new connection to the database, passing in the
 	// context we created above as a parameter. If the connection couldn't be
 	// established successfully within the 5 second deadline, then this will return an error.
-	err = db.PingContext(ctx)
-	if err != nil {
-		return nil, err
+	return db.PingContext(ctx)
+}
+
+// The withStatementTimeout() function adds a statement_timeout setting to a DSN, unless
+// it already has one. The pq driver sends any settings which it doesn't recognize to
+// PostgreSQL as run-time parameters, so every connection in the pool is given the
+// timeout. Both URL-style and keyword/value DSNs are supported.
+func withStatementTimeout(dsn string, timeout time.Duration) string {
+	if strings.Contains(dsn, "statement_timeout") {
+		return dsn
 	}
-	// Return the sql.DB connection pool.
-	return db, nil
+
+	value := strconv.FormatInt(timeout.Milliseconds(), 10)
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			// Leave the DSN alone, so that sql.Open() reports the problem with it.
+			return dsn
+		}
+		query := u.Query()
+		query.Set("statement_timeout", value)
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+
+	return dsn + " statement_timeout=" + value
 }
\ No newline at end of file
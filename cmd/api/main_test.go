@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"io"
+	"testing"
+	"time"
+	"greenlight.nursultandias.net/internal/jsonlog"
+)
+
+// The testConfig() function returns a configuration which passes validateConfig().
+func testConfig() config {
+	var cfg config
+	cfg.port = 4000
+	cfg.env = "development"
+	cfg.errorFormat = "envelope"
+	cfg.maxBodyBytes = 1_048_576
+	cfg.maxPageSize = 100
+	cfg.db.dsn = "postgres://greenlight@localhost/greenlight"
+	cfg.db.maxIdleTime = "15m"
+	cfg.db.queryTimeout = 3 * time.Second
+	cfg.db.connectBackoff = time.Second
+	cfg.server.idleTimeout = time.Minute
+	cfg.server.readTimeout = 10 * time.Second
+	cfg.server.writeTimeout = 30 * time.Second
+	return cfg
+}
+
+// The testLifecycle() function returns a lifecycle whose database is never connected
+// to (sql.Open() doesn't dial) and whose server returns the given report straight away.
+func testLifecycle(t *testing.T, report shutdownReport, serveErr error) lifecycle {
+	return lifecycle{
+		openDB: func(ctx context.Context, cfg config, logger *jsonlog.Logger) (*sql.DB, *sql.DB, error) {
+			db, err := sql.Open("postgres", cfg.db.dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db, db, nil
+		},
+		migrate: func(ctx context.Context, db *sql.DB) (int64, int, error) {
+			return 10, 0, nil
+		},
+		serve: func(app *application) (shutdownReport, error) {
+			return report, serveErr
+		},
+	}
+}
+
+func TestRunExitCodes(t *testing.T) {
+	tests := []struct {
+		name	string
+		modify	func(cfg *config, lc *lifecycle)
+		want	int
+	}{
+		{
+			name:	"clean shutdown",
+			modify:	func(cfg *config, lc *lifecycle) {},
+			want:	exitOK,
+		},
+		{
+			name: "server error",
+			modify: func(cfg *config, lc *lifecycle) {
+				lc.serve = func(app *application) (shutdownReport, error) {
+					return shutdownReport{}, errors.New("listen tcp :4000: bind: address already in use")
+				}
+			},
+			want: exitServerError,
+		},
+		{
+			name: "invalid config",
+			modify: func(cfg *config, lc *lifecycle) {
+				cfg.port = 0
+			},
+			want: exitConfigInvalid,
+		},
+		{
+			name: "database unavailable",
+			modify: func(cfg *config, lc *lifecycle) {
+				lc.openDB = func(ctx context.Context, cfg config, logger *jsonlog.Logger) (*sql.DB, *sql.DB, error) {
+					return nil, nil, errors.New("connection refused")
+				}
+			},
+			want: exitDatabaseUnavailable,
+		},
+		{
+			name: "drain timeout",
+			modify: func(cfg *config, lc *lifecycle) {
+				lc.serve = func(app *application) (shutdownReport, error) {
+					return shutdownReport{signal: "terminated", drainTimedOut: true, abandonedRequests: 2}, nil
+				}
+			},
+			want: exitDrainTimeout,
+		},
+		{
+			name: "drain timeout and abandoned tasks",
+			modify: func(cfg *config, lc *lifecycle) {
+				lc.serve = func(app *application) (shutdownReport, error) {
+					return shutdownReport{signal: "terminated", drainTimedOut: true, abandonedTasks: 1}, nil
+				}
+			},
+			want: exitDrainTimeout,
+		},
+		{
+			name: "background tasks abandoned",
+			modify: func(cfg *config, lc *lifecycle) {
+				lc.serve = func(app *application) (shutdownReport, error) {
+					return shutdownReport{signal: "interrupt", abandonedTasks: 3}, nil
+				}
+			},
+			want: exitBackgroundAbandoned,
+		},
+		{
+			name: "migration failed",
+			modify: func(cfg *config, lc *lifecycle) {
+				cfg.db.migrate = true
+				lc.migrate = func(ctx context.Context, db *sql.DB) (int64, int, error) {
+					return 7, 0, errors.New("database schema version 7 is dirty")
+				}
+			},
+			want: exitMigrationFailed,
+		},
+		{
+			name: "migrations applied",
+			modify: func(cfg *config, lc *lifecycle) {
+				cfg.db.migrate = true
+			},
+			want: exitOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			lc := testLifecycle(t, shutdownReport{signal: "interrupt"}, nil)
+			tt.modify(&cfg, &lc)
+
+			logger := jsonlog.New(io.Discard, jsonlog.LevelOff)
+
+			got := run(cfg, logger, lc)
+			if got != tt.want {
+				t.Errorf("got exit code %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveQueryTimeout(t *testing.T) {
+	tests := []struct {
+		name		string
+		args		[]string
+		wantTimeout	time.Duration
+		wantLegacy	bool
+		wantErr		bool
+	}{
+		{name: "default", args: nil, wantTimeout: 3 * time.Second},
+		{name: "new flag", args: []string{"-db-query-timeout=5s"}, wantTimeout: 5 * time.Second},
+		{name: "deprecated flag", args: []string{"-db-timeout=7s"}, wantTimeout: 7 * time.Second, wantLegacy: true},
+		{name: "same values", args: []string{"-db-timeout=7s", "-db-query-timeout=7s"}, wantTimeout: 7 * time.Second, wantLegacy: true},
+		{name: "conflicting values", args: []string{"-db-timeout=7s", "-db-query-timeout=5s"}, wantLegacy: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.DurationVar(&cfg.db.queryTimeout, "db-query-timeout", 3*time.Second, "")
+			fs.DurationVar(&cfg.db.legacyTimeout, "db-timeout", 0, "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			legacy, err := resolveQueryTimeout(fs, &cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+			}
+			if legacy != tt.wantLegacy {
+				t.Errorf("got legacy %t; want %t", legacy, tt.wantLegacy)
+			}
+			if !tt.wantErr && cfg.db.queryTimeout != tt.wantTimeout {
+				t.Errorf("got timeout %s; want %s", cfg.db.queryTimeout, tt.wantTimeout)
+			}
+		})
+	}
+}
@@ -1,8 +1,20 @@
 package main
 
 import (
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"expvar"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"greenlight.nursultandias.net/internal/validator"
 )
 
 func (app *application) recoverPanic(next http.Handler) http.Handler { 
@@ -12,6 +24,13 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 		defer func() {
 			// Use the builtin recover function to check if there has been a panic or not.
 			if err := recover(); err != nil {
+				// A panic with http.ErrAbortHandler is a deliberate request to abort the
+				// response (see writeJSONStream()), so re-panic and let the HTTP server
+				// close the connection without logging a stack trace.
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
 				// If there was a panic, set a "Connection: close" header on the
 				// response. This acts as a trigger to make Go's HTTP server
 				// automatically close the current connection after a response has been sent.
@@ -27,3 +46,483 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 		next.ServeHTTP(response, request) 
 	})
 }
+
+// The metricsResponseWriter type wraps an existing http.ResponseWriter and records
+// the HTTP status code that was sent and the number of body bytes written, so that the
+// metrics() and logRequest() middleware can report on them after the handler chain
+// has returned.
+type metricsResponseWriter struct {
+	wrapped			http.ResponseWriter
+	statusCode		int
+	headerWritten	bool
+	bytesWritten	int
+}
+
+// Return a new metricsResponseWriter wrapping the given http.ResponseWriter. The status
+// code defaults to 200 OK, which is what Go will send if the handler calls Write()
+// without calling WriteHeader() first.
+func newMetricsResponseWriter(response http.ResponseWriter) *metricsResponseWriter {
+	return &metricsResponseWriter{
+		wrapped:	response,
+		statusCode:	http.StatusOK,
+	}
+}
+
+// The Header() method is a simple 'pass through' to the wrapped http.ResponseWriter.
+func (mw *metricsResponseWriter) Header() http.Header {
+	return mw.wrapped.Header()
+}
+
+// The WriteHeader() method records the status code (the first time it is called) and
+// then passes it through to the wrapped http.ResponseWriter.
+func (mw *metricsResponseWriter) WriteHeader(statusCode int) {
+	mw.wrapped.WriteHeader(statusCode)
+
+	if !mw.headerWritten {
+		mw.statusCode = statusCode
+		mw.headerWritten = true
+	}
+}
+
+// The Write() method passes the data through to the wrapped http.ResponseWriter,
+// marking the header as written so that later WriteHeader() calls aren't recorded.
+func (mw *metricsResponseWriter) Write(b []byte) (int, error) {
+	mw.headerWritten = true
+	n, err := mw.wrapped.Write(b)
+	mw.bytesWritten += n
+	return n, err
+}
+
+// The Unwrap() method returns the wrapped http.ResponseWriter, so that the
+// http.ResponseController type can reach the underlying writer if needed.
+func (mw *metricsResponseWriter) Unwrap() http.ResponseWriter {
+	return mw.wrapped
+}
+
+// The logRequest() middleware writes an INFO log entry for every completed request,
+// including the response status, the number of bytes written and how long it took.
+// It runs outside recoverPanic() so that requests which panic are still logged (with
+// the 500 status sent by recoverPanic()). Logging can be disabled with the
+// -log-requests=false flag.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		// The profiling endpoints aren't logged, so that a profiling session doesn't
+		// fill the request log.
+		if !app.config.log.requests || strings.HasPrefix(request.URL.Path, pprofPathPrefix) {
+			next.ServeHTTP(response, request)
+			return
+		}
+
+		start := time.Now()
+		mw := newMetricsResponseWriter(response)
+
+		next.ServeHTTP(mw, request)
+
+		app.loggerFromContext(request).PrintInfo("request completed", map[string]any{
+			"method":		request.Method,
+			"url":			request.URL.RequestURI(),
+			"proto":		request.Proto,
+			"remote_addr":	request.RemoteAddr,
+			"status":		mw.statusCode,
+			"bytes":		mw.bytesWritten,
+			"duration_ms":	float64(time.Since(start).Microseconds()) / 1000,
+		})
+	})
+}
+
+// The expvar variables updated by the metrics() middleware. They're published once at
+// package initialization rather than when the middleware chain is built, as expvar
+// panics if the same name is published twice and routes() may be called more than once
+// (in the tests, for example).
+var (
+	totalRequestsReceived			= expvar.NewInt("total_requests_received")
+	totalResponsesSent				= expvar.NewInt("total_responses_sent")
+	totalProcessingTimeMicroseconds	= expvar.NewInt("total_processing_time_μs")
+	totalResponsesSentByStatus		= expvar.NewMap("total_responses_sent_by_status")
+)
+
+func (app *application) metrics(next http.Handler) http.Handler {
+	// The following code will be run for every request...
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		// Record the time that we started to process the request.
+		start := time.Now()
+
+		// Use the Add() method to increment the number of requests received by 1.
+		totalRequestsReceived.Add(1)
+
+		// Wrap the response writer so that we can capture the status code, then call
+		// the next handler in the chain.
+		mw := newMetricsResponseWriter(response)
+		next.ServeHTTP(mw, request)
+
+		// On the way back up the middleware chain, increment the number of responses
+		// sent by 1.
+		totalResponsesSent.Add(1)
+
+		// Increment the count for the given status code by 1. Note that the expvar map
+		// is string-keyed, so we need to use the strconv.Itoa() function to convert
+		// the status code (which is an integer) to a string.
+		totalResponsesSentByStatus.Add(strconv.Itoa(mw.statusCode), 1)
+
+		// Calculate the number of microseconds since we began to process the request,
+		// then increment the total processing time by this amount.
+		duration := time.Since(start).Microseconds()
+		totalProcessingTimeMicroseconds.Add(duration)
+	})
+}
+
+// The trackInFlight() middleware counts the number of requests which are currently
+// being processed, so that serve() can report how many were abandoned if the graceful
+// shutdown drain timeout expires.
+func (app *application) trackInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		app.inFlight.Add(1)
+		defer app.inFlight.Add(-1)
+
+		next.ServeHTTP(response, request)
+	})
+}
+
+func (app *application) enableCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		// Add the "Vary: Origin" header, so that any caches know that the response may
+		// be different depending on the value of the request's Origin header. We also
+		// add "Vary: Access-Control-Request-Method" for preflight requests.
+		response.Header().Add("Vary", "Origin")
+		response.Header().Add("Vary", "Access-Control-Request-Method")
+
+		// Get the value of the request's Origin header.
+		origin := request.Header.Get("Origin")
+
+		// Only run this if there's an Origin request header present.
+		if origin != "" {
+			// Loop through the list of trusted origins, checking to see if the request
+			// origin exactly matches one of them. If there are no trusted origins, then
+			// the loop won't be iterated.
+			for i := range app.config.cors.trustedOrigins {
+				if origin == app.config.cors.trustedOrigins[i] {
+					// If there is a match, then set a "Access-Control-Allow-Origin"
+					// response header with the request origin as the value and break
+					// out of the loop.
+					response.Header().Set("Access-Control-Allow-Origin", origin)
+
+					// Check if the request has the HTTP method OPTIONS and contains the
+					// "Access-Control-Request-Method" header. If it does, then we treat
+					// it as a preflight request.
+					if request.Method == http.MethodOptions && request.Header.Get("Access-Control-Request-Method") != "" {
+						// Set the necessary preflight response headers, then write the
+						// headers along with a 200 OK status and return from the
+						// middleware with no further action.
+						response.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
+						response.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+
+						response.WriteHeader(http.StatusOK)
+						return
+					}
+
+					break
+				}
+			}
+		}
+
+		// Call the next handler in the chain.
+		next.ServeHTTP(response, request)
+	})
+}
+
+// The defaultGzipMinSize constant is the default minimum response body size (in bytes)
+// that we compress. Below this the gzip overhead outweighs the savings. It can be
+// changed with the -gzip-min-size flag.
+const defaultGzipMinSize = 1024
+
+// Use a sync.Pool to reuse gzip writers between requests, rather than allocating a new
+// one (and its internal buffers) for every compressed response.
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(io.Discard)
+	},
+}
+
+// The gzipResponseWriter type wraps an http.ResponseWriter and buffers the start of the
+// response body. Once the buffered body reaches the minimum size (or the handler
+// finishes or flushes) it decides whether to compress the response, and from then on
+// writes either through a gzip.Writer or straight to the wrapped writer.
+type gzipResponseWriter struct {
+	wrapped		http.ResponseWriter
+	minSize		int
+	statusCode	int
+	buf			[]byte
+	decided		bool
+	gz			*gzip.Writer
+}
+
+func (gw *gzipResponseWriter) Header() http.Header {
+	return gw.wrapped.Header()
+}
+
+// The WriteHeader() method only records the status code. The header is sent later,
+// once we know whether the response will be compressed, because the Content-Encoding
+// header has to be set before the status line is written.
+func (gw *gzipResponseWriter) WriteHeader(statusCode int) {
+	if gw.statusCode == 0 {
+		gw.statusCode = statusCode
+	}
+}
+
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	if gw.decided {
+		if gw.gz != nil {
+			return gw.gz.Write(b)
+		}
+		return gw.wrapped.Write(b)
+	}
+
+	// Buffer the data until we have enough of it to make a decision.
+	gw.buf = append(gw.buf, b...)
+	if len(gw.buf) >= gw.minSize {
+		err := gw.decide()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// The decide() method works out whether to compress the response, sends the header and
+// writes out any buffered data.
+func (gw *gzipResponseWriter) decide() error {
+	gw.decided = true
+
+	if gw.statusCode == 0 {
+		gw.statusCode = http.StatusOK
+	}
+
+	// Only compress non-empty JSON responses which are large enough and which haven't
+	// already been encoded by the handler (so we never double-compress).
+	header := gw.wrapped.Header()
+	if len(gw.buf) > 0 && len(gw.buf) >= gw.minSize &&
+		header.Get("Content-Encoding") == "" &&
+		(strings.HasPrefix(header.Get("Content-Type"), "application/json") ||
+			strings.HasPrefix(header.Get("Content-Type"), "application/problem+json")) {
+		header.Set("Content-Encoding", "gzip")
+		// The Content-Length (if any) refers to the uncompressed body, so remove it.
+		header.Del("Content-Length")
+
+		gw.gz = gzipWriterPool.Get().(*gzip.Writer)
+		gw.gz.Reset(gw.wrapped)
+	}
+
+	gw.wrapped.WriteHeader(gw.statusCode)
+
+	if len(gw.buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if gw.gz != nil {
+		_, err = gw.gz.Write(gw.buf)
+	} else {
+		_, err = gw.wrapped.Write(gw.buf)
+	}
+	gw.buf = nil
+
+	return err
+}
+
+// The Flush() method forces a decision (so a handler which calls WriteHeader() and then
+// flushes still sends its header), flushes any compressed data and then flushes the
+// wrapped writer if it supports it. We use a ResponseController for that, as the
+// wrapped writer may itself be wrapping the writer which supports flushing.
+func (gw *gzipResponseWriter) Flush() {
+	if !gw.decided {
+		gw.decide()
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	http.NewResponseController(gw.wrapped).Flush()
+}
+
+// The close() method is called once the handler has returned. It makes sure the header
+// and any buffered data are written, and closes the gzip writer (which writes the gzip
+// footer) before returning it to the pool.
+func (gw *gzipResponseWriter) close() error {
+	if !gw.decided {
+		err := gw.decide()
+		if err != nil {
+			return err
+		}
+	}
+
+	if gw.gz == nil {
+		return nil
+	}
+
+	err := gw.gz.Close()
+	gw.gz.Reset(io.Discard)
+	gzipWriterPool.Put(gw.gz)
+	gw.gz = nil
+
+	return err
+}
+
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.wrapped
+}
+
+// The acceptsGzip() helper reports whether the client's Accept-Encoding header includes
+// gzip (and hasn't explicitly disabled it with a q=0 weight).
+func acceptsGzip(request *http.Request) bool {
+	for _, part := range strings.Split(request.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		if strings.TrimSpace(fields[0]) != "gzip" {
+			continue
+		}
+
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// The gzipResponse() middleware compresses JSON responses of at least the configured
+// minimum size for clients which accept gzip encoding.
+func (app *application) gzipResponse(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		// The response depends on the Accept-Encoding header, so let caches know.
+		response.Header().Add("Vary", "Accept-Encoding")
+
+		if !acceptsGzip(request) {
+			next.ServeHTTP(response, request)
+			return
+		}
+
+		gw := &gzipResponseWriter{
+			wrapped:	response,
+			minSize:	app.config.gzip.minSize,
+		}
+
+		next.ServeHTTP(gw, request)
+
+		err := gw.close()
+		if err != nil {
+			app.logError(request, err)
+		}
+	})
+}
+
+// The newRequestID() function generates a random (version 4) UUID to use as a request ID.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+
+	// Set the version (4) and variant (RFC 4122) bits.
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// The validRequestID() function reports whether a client-supplied request ID is safe to
+// use: it must be between 1 and 64 characters long, and contain only ASCII letters,
+// digits, hyphens, underscores and dots. This stops clients from injecting arbitrary
+// content into our logs and response headers.
+func validRequestID(requestID string) bool {
+	if len(requestID) == 0 || len(requestID) > 64 {
+		return false
+	}
+
+	for _, r := range requestID {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// The requestID() middleware makes sure every request has an ID. If the client sent a
+// valid X-Request-Id header we use its value, otherwise we generate a new one. The ID is
+// echoed in the response, stored in the request context, and attached to a
+// request-scoped logger so that it's included in every log entry for the request.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requestID := request.Header.Get("X-Request-Id")
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+
+		response.Header().Set("X-Request-Id", requestID)
+
+		request = app.contextSetRequestID(request, requestID)
+		request = app.contextSetLogger(request, app.logger.With(map[string]any{
+			"request_id": requestID,
+		}))
+
+		next.ServeHTTP(response, request)
+	})
+}
+
+// The prettyResponseWriter type marks a response as one which should contain indented
+// JSON. It's created by the prettyJSON() middleware, and writeJSON() checks for it.
+type prettyResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (pw *prettyResponseWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
+
+// The prettyJSON() middleware checks for a ?pretty=true query string parameter and, if
+// it's present, wraps the http.ResponseWriter so that writeJSON() indents the JSON it
+// writes. Doing it this way means that none of the handlers need to change. Invalid
+// values for the parameter are ignored rather than rejected.
+func (app *application) prettyJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if app.readBool(request.URL.Query(), "pretty", false, validator.New()) {
+			response = &prettyResponseWriter{response}
+		}
+
+		next.ServeHTTP(response, request)
+	})
+}
+
+// The requireBasicAuth() middleware only lets through requests which supply the given
+// username and password with HTTP basic auth. Other requests get a 401 Unauthorized
+// response.
+func (app *application) requireBasicAuth(username, password string, next http.HandlerFunc) http.HandlerFunc {
+	// Compare SHA-256 hashes of the credentials, so that the comparisons take the same
+	// time whatever the lengths of the values.
+	wantUsername := sha256.Sum256([]byte(username))
+	wantPassword := sha256.Sum256([]byte(password))
+
+	return func(response http.ResponseWriter, request *http.Request) {
+		u, p, ok := request.BasicAuth()
+		if ok {
+			givenUsername := sha256.Sum256([]byte(u))
+			givenPassword := sha256.Sum256([]byte(p))
+
+			usernameMatch := subtle.ConstantTimeCompare(givenUsername[:], wantUsername[:]) == 1
+			passwordMatch := subtle.ConstantTimeCompare(givenPassword[:], wantPassword[:]) == 1
+
+			if usernameMatch && passwordMatch {
+				next(response, request)
+				return
+			}
+		}
+
+		app.invalidCredentialsResponse(response, request)
+	}
+}
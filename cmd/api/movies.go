@@ -1,9 +1,15 @@
 package main
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"errors"
+	"strconv"
+	"strings"
+	"time"
 	"greenlight.nursultandias.net/internal/data"
 	"greenlight.nursultandias.net/internal/validator"
 )
@@ -20,12 +26,10 @@ func (app *application) createMovieHandler(response http.ResponseWriter, request
 		Genres	[]string		`json:"genres"`
 	}
 
-	// Use the new readJSON() helper to decode the request body into the input struct.
-	// If this returns an error we send the client the error message along with a 400
-	// Bad Request status code, just like before.
-	err := app.readJSON(response, request, &input)
-	if err != nil {
-		app.badRequestResponse(response, request, err)
+	// Use the readJSONValidated() helper to decode the request body into the input
+	// struct. If there's a problem it sends the client an error response (listing
+	// every invalid field, where possible) and we return.
+	if !app.readJSONValidated(response, request, &input) {
 		return 
 	}
 
@@ -43,16 +47,21 @@ func (app *application) createMovieHandler(response http.ResponseWriter, request
 
 	// Call the ValidateMovie() function and return a response containing the errors if // any of the checks fail.
 	if data.ValidateMovie(v, movie); !v.Valid() {
-		app.failedValidationResponse(response, request, v.Errors)
+		app.failedValidationResponse(response, request, v)
 		return
 	}
 
 	// Call the Insert() method on our movies model, passing in a pointer to the
 	// validated movie struct. This will create a record in the database and update the
 	// movie struct with the system-generated information.
-	err = app.models.Movies.Insert(movie)
+	err := app.models.Movies.Insert(request.Context(), movie)
 	if err != nil {
-		app.serverErrorResponse(response, request, err)
+		switch {
+		case errors.Is(err, data.ErrDuplicateMovie):
+			app.handleDuplicateMovie(response, request, movie)
+		default:
+			app.serverErrorResponse(response, request, err)
+		}
 		return
 	}
 
@@ -60,6 +69,8 @@ func (app *application) createMovieHandler(response http.ResponseWriter, request
 	// client know which URL they can find the newly-created resource at. We make an
 	// empty http.Header map and then use the Set() method to add a new Location header,
 	// interpolating the system-generated ID for our new movie in the URL.
+	app.movieChanged(data.EventMovieCreated, movie)
+
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
 
@@ -71,6 +82,99 @@ func (app *application) createMovieHandler(response http.ResponseWriter, request
 	}
 }
 
+// The maxBatchSize constant is the maximum number of movies which can be created in a
+// single request to the batch endpoint.
+const maxBatchSize = 100
+
+func (app *application) createMoviesBatchHandler(response http.ResponseWriter, request *http.Request) {
+	// The request body is a JSON array of movie objects, each with the same fields as
+	// the body for createMovieHandler.
+	var input []struct {
+		Title	string			`json:"title"`
+		Year	int32			`json:"year"`
+		Runtime	data.Runtime	`json:"runtime"`
+		Genres	[]string		`json:"genres"`
+	}
+
+	err := app.readJSON(response, request, &input)
+	if err != nil {
+		app.badRequestResponse(response, request, err)
+		return
+	}
+
+	v := validator.New()
+
+	// Check the size of the batch before validating the individual movies.
+	v.Check(validator.Min(len(input), 1), "movies", "must contain at least 1 movie")
+	v.Check(validator.Max(len(input), maxBatchSize), "movies", fmt.Sprintf("must not contain more than %d movies", maxBatchSize))
+
+	if !v.Valid() {
+		app.failedValidationResponse(response, request, v)
+		return
+	}
+
+	// Validate each movie with a child of the main Validator, which prefixes the keys
+	// with the movie's index (e.g. "movies[3].title"), so the client can see exactly
+	// which movies need fixing.
+	movies := make([]*data.Movie, len(input))
+
+	for i, in := range input {
+		movies[i] = &data.Movie{
+			Title:		in.Title,
+			Year:		in.Year,
+			Runtime:	in.Runtime,
+			Genres:		in.Genres,
+		}
+
+		data.ValidateMovie(v.Child(fmt.Sprintf("movies[%d]", i)), movies[i])
+	}
+
+	// Check that the batch doesn't contain the same movie (title and year) more than
+	// once, as the second insert would violate the unique index.
+	seen := make(map[string]int)
+	for i, movie := range movies {
+		key := fmt.Sprintf("%s|%d", strings.ToLower(movie.Title), movie.Year)
+		if j, exists := seen[key]; exists {
+			v.AddError(fmt.Sprintf("movies[%d].title", i), fmt.Sprintf("duplicates the title and year of movies[%d]", j))
+			continue
+		}
+		seen[key] = i
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(response, request, v)
+		return
+	}
+
+	// Insert all of the movies in a single transaction. If any of them already exist,
+	// work out which ones so that we can report the conflicting indexes.
+	err = app.models.Movies.InsertBatch(request.Context(), movies)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateMovie):
+			app.batchDuplicateMoviesResponse(response, request, movies)
+		default:
+			app.serverErrorResponse(response, request, err)
+		}
+		return
+	}
+
+	// Collect the IDs of the created movies so that clients which only need to know
+	// what was created don't have to dig through the full movie objects.
+	ids := make([]int64, len(movies))
+	for i, movie := range movies {
+		ids[i] = movie.ID
+		app.movieChanged(data.EventMovieCreated, movie)
+	}
+
+	// Send a 201 Created response containing the created movies and their IDs, in the
+	// same order they were submitted.
+	err = app.writeJSON(response, http.StatusCreated, envelope{"ids": ids, "movies": movies}, nil)
+	if err != nil {
+		app.serverErrorResponse(response, request, err)
+	}
+}
+
 func (app *application) showMovieHandler(response http.ResponseWriter, request *http.Request) {
 	id, err := app.readIDParam(request)
 	if err != nil {
@@ -78,10 +182,19 @@ func (app *application) showMovieHandler(response http.ResponseWriter, request *
 		return
 	}
 
+	// Read the optional fields query string parameter, which limits the movie fields
+	// included in the response.
+	v := validator.New()
+	fields := app.readMovieFields(request.URL.Query(), v)
+	if !v.Valid() {
+		app.failedValidationResponse(response, request, v)
+		return
+	}
+
 	// Call the Get() method to fetch the data for a specific movie. We also need to
 	// use the errors.Is() function to check if it returns a data.ErrRecordNotFound
 	// error, in which case we send a 404 Not Found response to the client.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(request.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -91,9 +204,26 @@ func (app *application) showMovieHandler(response http.ResponseWriter, request *
 		}
 		return
 	}
-	
 
-	err = app.writeJSON(response, http.StatusOK, envelope{"movie": movie}, nil)
+	// Set an ETag header derived from the movie's ID and version. If the client already
+	// has this version of the movie (i.e. it sent a matching If-None-Match header), send
+	// a 304 Not Modified response without a body.
+	headers := make(http.Header)
+	headers.Set("ETag", movieETag(movie))
+	headers.Set("X-Version", strconv.Itoa(int(movie.Version)))
+
+	if etagMatches(request.Header.Get("If-None-Match"), movieETag(movie), true) {
+		app.writeNotModified(response, headers)
+		return
+	}
+
+	selected, err := selectMovieFields(movie, fields)
+	if err != nil {
+		app.serverErrorResponse(response, request, err)
+		return
+	}
+
+	err = app.writeJSON(response, http.StatusOK, envelope{"movie": selected}, headers)
 	if err != nil {
 		app.serverErrorResponse(response, request, err)
 	}
@@ -109,7 +239,7 @@ func (app *application) updateMovieHandler(response http.ResponseWriter, request
 
 	// Fetch the existing movie record from the database, sending a 404 Not Found
 	// response to the client if we couldn't find a matching record.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(request.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -126,14 +256,25 @@ func (app *application) updateMovieHandler(response http.ResponseWriter, request
 		Year		*int32			`json:"year"`		// Likewise...
 		Runtime		*data.Runtime	`json:"runtime"`	// Likewise...
 		Genres		[]string		`json:"genres"`		// We don't need to change this because slices already have the zero-value nil.
+		Version		*int32			`json:"version,string"`	// The version the client expects to be editing (optional).
 	}
 
 	// Read the JSON request body data into the input struct.
-	err = app.readJSON(response, request, &input)
+	if !app.readJSONValidated(response, request, &input) {
+		return
+	}
+
+	// Check that the client is editing the current version of the movie, sending an
+	// edit conflict response if it isn't.
+	ok, err := app.expectedVersionMatches(request, movie, input.Version)
 	if err != nil {
 		app.badRequestResponse(response, request, err)
 		return
 	}
+	if !ok {
+		app.editConflictResponse(response, request)
+		return
+	}
 
 	// If the input.Title value is nil then we know that no corresponding "title" key/
 	// value pair was provided in the JSON request body. So we move on and leave the
@@ -156,32 +297,186 @@ func (app *application) updateMovieHandler(response http.ResponseWriter, request
 		movie.Genres = input.Genres // Note that we don't need to dereference a slice.
 	}
 
+	// Validate and save the updated movie record, then send it to the client.
+	app.saveMovie(response, request, movie)
+}
+
+func (app *application) replaceMovieHandler(response http.ResponseWriter, request *http.Request) {
+	// Extract the movie ID from the URL.
+	id, err := app.readIDParam(request)
+	if err != nil {
+		app.notFoundResponse(response, request)
+		return
+	}
+
+	// Fetch the existing movie record, sending a 404 Not Found response to the client
+	// if we couldn't find a matching record.
+	movie, err := app.models.Movies.Get(request.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(response, request)
+		default:
+			app.serverErrorResponse(response, request, err)
+		}
+		return
+	}
+
+	// A PUT request replaces the whole movie, so every field is required. We still use
+	// pointers so that we can tell the difference between a missing field and a zero
+	// value, and report missing fields as validation errors.
+	var input struct {
+		Title		*string			`json:"title"`
+		Year		*int32			`json:"year"`
+		Runtime		*data.Runtime	`json:"runtime"`
+		Genres		[]string		`json:"genres"`
+		Version		*int32			`json:"version,string"`
+	}
+
+	if !app.readJSONValidated(response, request, &input) {
+		return
+	}
+
+	ok, err := app.expectedVersionMatches(request, movie, input.Version)
+	if err != nil {
+		app.badRequestResponse(response, request, err)
+		return
+	}
+	if !ok {
+		app.editConflictResponse(response, request)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Title != nil, "title", "must be provided")
+	v.Check(input.Year != nil, "year", "must be provided")
+	v.Check(input.Runtime != nil, "runtime", "must be provided")
+	v.Check(input.Genres != nil, "genres", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(response, request, v)
+		return
+	}
+
+	// Replace every field on the movie record with the values from the request.
+	movie.Title = *input.Title
+	movie.Year = *input.Year
+	movie.Runtime = *input.Runtime
+	movie.Genres = input.Genres
+
+	app.saveMovie(response, request, movie)
+}
+
+// The expectedVersionMatches() helper checks the preconditions that a client can send
+// with an update: an If-Match header containing the movie's ETag, an X-Expected-Version
+// header, or a version field in the JSON body (passed in as bodyVersion). It returns
+// false if any of them don't match the movie's current version, in which case the
+// client is working from a stale copy. An error is returned if the X-Expected-Version
+// header isn't a valid integer.
+func (app *application) expectedVersionMatches(request *http.Request, movie *data.Movie, bodyVersion *int32) (bool, error) {
+	ifMatch := request.Header.Get("If-Match")
+	if ifMatch != "" && !etagMatches(ifMatch, movieETag(movie), false) {
+		return false, nil
+	}
+
+	// The X-Expected-Version header takes precedence over the version in the body.
+	expectedVersion := bodyVersion
+
+	if header := request.Header.Get("X-Expected-Version"); header != "" {
+		i, err := strconv.ParseInt(header, 10, 32)
+		if err != nil {
+			return false, errors.New("X-Expected-Version header must be an integer")
+		}
+		headerVersion := int32(i)
+		expectedVersion = &headerVersion
+	}
+
+	if expectedVersion != nil && *expectedVersion != movie.Version {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// The saveMovie() helper validates an updated movie record, saves it using the Update()
+// method and writes it in a JSON response. It's shared by the PATCH and PUT handlers.
+func (app *application) saveMovie(response http.ResponseWriter, request *http.Request, movie *data.Movie) {
 	// Validate the updated movie record, sending the client a 422 Unprocessable Entity
 	// response if any checks fail.
 	v := validator.New()
 
 	if data.ValidateMovie(v, movie); !v.Valid() {
-		app.failedValidationResponse(response, request, v.Errors)
+		app.failedValidationResponse(response, request, v)
 		return
 	}
 
 	// Pass the updated movie record to our new Update() method.
-	err = app.models.Movies.Update(movie)
+	err := app.models.Movies.Update(request.Context(), movie)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(response, request)
+		case errors.Is(err, data.ErrDuplicateMovie):
+			app.handleDuplicateMovie(response, request, movie)
 		default:
 			app.serverErrorResponse(response, request, err)
 		}
 		return
 	}
 
-	// Write the updated movie record in a JSON response.
-	err = app.writeJSON(response, http.StatusOK, envelope{"movie": movie}, nil)
+	app.movieChanged(data.EventMovieUpdated, movie)
+
+	app.writeUpdatedMovie(response, request, movie)
+}
+
+// The writeUpdatedMovie() helper writes an updated movie record in a JSON response,
+// including the new ETag and an X-Version header so that clients can chain further
+// edits safely.
+func (app *application) writeUpdatedMovie(response http.ResponseWriter, request *http.Request, movie *data.Movie) {
+	headers := make(http.Header)
+	headers.Set("ETag", movieETag(movie))
+	headers.Set("X-Version", strconv.Itoa(int(movie.Version)))
+
+	err := app.writeJSON(response, http.StatusOK, envelope{"movie": movie}, headers)
+	if err != nil {
+		app.serverErrorResponse(response, request, err)
+	}
+}
+
+// The handleDuplicateMovie() helper looks up the existing movie which clashed with the
+// given movie and sends a duplicateMovieResponse pointing at it.
+func (app *application) handleDuplicateMovie(response http.ResponseWriter, request *http.Request, movie *data.Movie) {
+	existing, err := app.models.Movies.GetDuplicate(request.Context(), movie.Title, movie.Year)
 	if err != nil {
 		app.serverErrorResponse(response, request, err)
+		return
 	}
+
+	app.duplicateMovieResponse(response, request, existing.ID)
+}
+
+// The batchDuplicateMoviesResponse() helper finds which movies in a batch already exist
+// and sends a 422 Unprocessable Entity response with a title error for each of their
+// indexes.
+func (app *application) batchDuplicateMoviesResponse(response http.ResponseWriter, request *http.Request, movies []*data.Movie) {
+	errs := make(map[string][]string)
+
+	for i, movie := range movies {
+		existing, err := app.models.Movies.GetDuplicate(request.Context(), movie.Title, movie.Year)
+		if err != nil {
+			if errors.Is(err, data.ErrRecordNotFound) {
+				continue
+			}
+			app.serverErrorResponse(response, request, err)
+			return
+		}
+
+		key := fmt.Sprintf("movies[%d].title", i)
+		errs[key] = append(errs[key], fmt.Sprintf("%s (id %d)", duplicateMovieMessage, existing.ID))
+	}
+
+	app.errorResponse(response, request, http.StatusUnprocessableEntity, errCodeValidationFailed, errs)
 }
 
 func (app *application) deleteMovieHandler(response http.ResponseWriter, request *http.Request) {
@@ -192,9 +487,25 @@ func (app *application) deleteMovieHandler(response http.ResponseWriter, request
 		return
 	}
 
+	// Read the hard query string parameter. By default movies are soft-deleted (and can
+	// be restored later), but ?hard=true permanently removes the record instead. Note
+	// that there are no user accounts or permissions yet, so hard deletes aren't
+	// restricted to any particular client.
+	v := validator.New()
+
+	hard := app.readBool(request.URL.Query(), "hard", false, v)
+	if !v.Valid() {
+		app.failedValidationResponse(response, request, v)
+		return
+	}
+
 	// Delete the movie from the database, sending a 404 Not Found response to the
 	// client if there isn't a matching record.
-	err = app.models.Movies.Delete(id)
+	if hard {
+		err = app.models.Movies.HardDelete(request.Context(), id)
+	} else {
+		err = app.models.Movies.Delete(request.Context(), id)
+	}
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -205,6 +516,8 @@ func (app *application) deleteMovieHandler(response http.ResponseWriter, request
 		return
 	}
 
+	app.movieChanged(data.EventMovieDeleted, envelope{"id": id})
+
 	// Return a 200 OK status code along with a success message.
 	err = app.writeJSON(response, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
 	if err != nil {
@@ -212,13 +525,122 @@ func (app *application) deleteMovieHandler(response http.ResponseWriter, request
 	}
 }
 
+// The restoreMovieHandler() handler restores a soft-deleted movie, and sends the
+// restored movie in the response. A 404 Not Found response is sent if the movie doesn't
+// exist or hasn't been deleted.
+func (app *application) restoreMovieHandler(response http.ResponseWriter, request *http.Request) {
+	id, err := app.readIDParam(request)
+	if err != nil {
+		app.notFoundResponse(response, request)
+		return
+	}
+
+	// Restoring the movie fails with ErrDuplicateMovie if another movie with the same
+	// title and year was created while it was deleted.
+	err = app.models.Movies.Restore(request.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(response, request)
+		case errors.Is(err, data.ErrDuplicateMovie):
+			app.errorResponse(response, request, http.StatusUnprocessableEntity, errCodeValidationFailed, map[string][]string{"title": {duplicateMovieMessage}})
+		default:
+			app.serverErrorResponse(response, request, err)
+		}
+		return
+	}
+
+	movie, err := app.models.Movies.Get(request.Context(), id)
+	if err != nil {
+		app.serverErrorResponse(response, request, err)
+		return
+	}
+
+	app.movieChanged(data.EventMovieRestored, movie)
+
+	err = app.writeJSON(response, http.StatusOK, envelope{"movie": movie}, nil)
+	if err != nil {
+		app.serverErrorResponse(response, request, err)
+	}
+}
+
+// The movieHistoryHandler() handler sends the audit trail for a movie, newest entry
+// first, paginated with the page and page_size query string parameters.
+func (app *application) movieHistoryHandler(response http.ResponseWriter, request *http.Request) {
+	id, err := app.readIDParam(request)
+	if err != nil {
+		app.notFoundResponse(response, request)
+		return
+	}
+
+	v := validator.New()
+	qs := request.URL.Query()
+
+	// The entries are always sorted newest first, so the sort isn't read from the
+	// query string.
+	filters := data.Filters{
+		Page:			app.readInt(qs, "page", 1, v),
+		PageSize:		app.readInt(qs, "page_size", app.defaultPageSize(), v),
+		Sort:			"-id",
+		SortSafelist:	[]string{"-id"},
+		MaxPageSize:	app.config.maxPageSize,
+	}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(response, request, v)
+		return
+	}
+
+	// Check whether the movie exists (and hasn't been deleted).
+	_, err = app.models.Movies.Get(request.Context(), id)
+	exists := err == nil
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(response, request, err)
+		return
+	}
+
+	entries, metadata, err := app.models.Movies.History(request.Context(), id, filters)
+	if err != nil {
+		app.serverErrorResponse(response, request, err)
+		return
+	}
+
+	// The audit trail outlives the movie, so the history of a deleted movie can still be
+	// read. We only send a 404 Not Found response when there's no movie and no history
+	// either, rather than an empty history.
+	if !exists && (metadata.TotalRecords == nil || *metadata.TotalRecords == 0) {
+		app.notFoundResponse(response, request)
+		return
+	}
+
+	err = app.writeJSON(response, http.StatusOK, envelope{"history": entries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(response, request, err)
+	}
+}
+
+// The defaultPageSize() method returns the page size to use when the client doesn't
+// give one. It's normally 20, but mustn't be more than the -max-page-size setting.
+func (app *application) defaultPageSize() int {
+	if app.config.maxPageSize > 0 && app.config.maxPageSize < 20 {
+		return app.config.maxPageSize
+	}
+	return 20
+}
+
+// The maxIDsFilter constant is the maximum number of IDs which can be passed in the ids
+// query string parameter of listMoviesHandler.
+const maxIDsFilter = 100
+
 func (app *application) listMoviesHandler(response http.ResponseWriter, request *http.Request) {
 	// To keep things consistent with our other handlers, we'll define an input struct
 	// to hold the expected values from the request query string.
 	// Embed the new Filters struct.
 	var input struct {
-		Title		string
-		Genres		[]string
+		movieSearch
+		ModifiedSince	time.Time
+		IDs				[]int64
+		IncludeDeleted	bool
 		data.Filters
 	}
 
@@ -228,40 +650,309 @@ func (app *application) listMoviesHandler(response http.ResponseWriter, request
 	// Call r.URL.Query() to get the url.Values map containing the query string data.
 	qs := request.URL.Query()
 
-	// Use our helpers to extract the title and genres query string values, falling back
-	// to defaults of an empty string and an empty slice respectively if they are not
-	// provided by the client.
-	input.Title = app.readString(qs, "title", "")
-	input.Genres = app.readCSV(qs, "genres", []string{})
+	// Work out which format the client wants the results in. An explicit format query
+	// string parameter takes precedence, otherwise we send CSV if the Accept header
+	// asks for it, and JSON by default.
+	defaultFormat := "json"
+	if strings.Contains(request.Header.Get("Accept"), "text/csv") {
+		defaultFormat = "csv"
+	}
+	format := app.readString(qs, "format", defaultFormat)
+	v.Check(validator.In(format, "json", "csv"), "format", `must be either "json" or "csv"`)
+
+	// Read the optional fields query string parameter, which limits the movie fields
+	// included in a JSON response.
+	fields := app.readMovieFields(qs, v)
+
+	// Read the title, genres and year filters, which are shared with the count endpoint.
+	input.movieSearch = app.readMovieSearch(qs, v)
+
+	// Read the modified_since value, which lets clients fetch only the movies which have
+	// changed since their last sync. The zero time means no filter.
+	input.ModifiedSince = app.readTime(qs, "modified_since", time.Time{}, v)
+	v.Check(!input.ModifiedSince.After(time.Now()), "modified_since", "must not be in the future")
+
+	// Read the ids value, which restricts the results to the given movies (returned in
+	// the same order). IDs which don't exist are simply left out of the results.
+	input.IDs = app.readIntCSV(qs, "ids", nil, v)
+	v.Check(validator.Max(len(input.IDs), maxIDsFilter), "ids", fmt.Sprintf("must not contain more than %d values", maxIDsFilter))
+	for _, id := range input.IDs {
+		if id < 1 {
+			v.AddError("ids", "must only contain positive integers")
+			break
+		}
+	}
+
+	// Read the include_deleted value, which adds soft-deleted movies (with their
+	// deleted_at time) to the results so that they can be found and restored. There are
+	// no user accounts or permissions yet, so this isn't restricted to admins.
+	input.IncludeDeleted = app.readBool(qs, "include_deleted", false, v)
 
 	// Get the page and page_size query string values as integers. Notice that we set
-	// the default page value to 1 and default page_size to 20, and that we pass the
-	// validator instance as the final argument here.
+	// the default page value to 1 and default page_size to 20 (or -max-page-size if
+	// that's lower), and that we pass the validator instance as the final argument here.
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
-	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", app.defaultPageSize(), v)
+	input.Filters.MaxPageSize = app.config.maxPageSize
+
+	// If a cursor query string parameter is present, switch to cursor-based pagination.
+	// The cursor is the ID of the last movie the client has seen (or 0 to start from
+	// the beginning).
+	if qs.Has("cursor") {
+		input.Filters.UseCursor = true
+		input.Filters.Cursor = int64(app.readInt(qs, "cursor", 0, v))
+
+		// Cursor pagination relies on the results being in ID order, which doesn't hold
+		// when they're returned in the order of the ids parameter.
+		v.Check(len(input.IDs) == 0, "ids", "cannot be used with cursor pagination")
+	}
 
 	// Extract the sort query string value, falling back to "id" if it is not provided // by the client (which will imply a ascending sort on movie ID).
 	input.Filters.Sort = app.readString(qs, "sort", "id")
-	// Add the supported sort values for this endpoint to the sort safelist.
+	// Add the supported sort values for this endpoint to the sort safelist. Clients can
+	// sort on several of these at once by separating them with commas, for example
+	// sort=-year,title.
 	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
 
 	// Execute the validation checks on the Filters struct and send a response
 	// containing the errors if necessary.
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
-		app.failedValidationResponse(response, request, v.Errors)
+		app.failedValidationResponse(response, request, v)
 		return
 	}
 
 	// Call the GetAll() method to retrieve the movies, passing in the various filter parameters.
-	movies, metadata ,err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata ,err := app.models.Movies.GetAll(request.Context(), input.Title, input.Genres, input.GenresMatch, input.YearFrom, input.YearTo, input.ModifiedSince, input.IDs, input.IncludeDeleted, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(response, request, err)
 		return
 	}
 
-	// Send a JSON response containing the movie data.
-	err = app.writeJSON(response, http.StatusOK, envelope{"movies": movies, "metadata" : metadata}, nil)
+	// If the client asked for CSV, stream the movies as CSV rows instead of building
+	// the JSON envelope.
+	if format == "csv" {
+		app.writeMoviesCSV(response, request, movies, metadata)
+		return
+	}
+
+	// If the client asked for a subset of the fields, strip the others from each movie.
+	// The metadata is always sent in full.
+	selected := make([]any, len(movies))
+	for i, movie := range movies {
+		selected[i], err = selectMovieFields(movie, fields)
+		if err != nil {
+			app.serverErrorResponse(response, request, err)
+			return
+		}
+	}
+
+	// Send a JSON response containing the movie data, streaming it to the client so
+	// that large pages aren't held in memory twice.
+	app.writeJSONStream(response, request, http.StatusOK, envelope{"movies": selected, "metadata" : metadata}, nil)
+}
+
+// The movieSearch type holds the title, genres and year filters which are accepted by
+// both listMoviesHandler and countMoviesHandler.
+type movieSearch struct {
+	Title		string
+	Genres		[]string
+	GenresMatch	string
+	YearFrom	int
+	YearTo		int
+}
+
+// The readMovieSearch() helper reads the title, genres, genres_match, year_from and
+// year_to query string values, recording any problems with them in the validator.
+func (app *application) readMovieSearch(qs url.Values, v *validator.Validator) movieSearch {
+	var search movieSearch
+
+	// Use our helpers to extract the title and genres query string values, falling back
+	// to defaults of an empty string and an empty slice respectively if they are not
+	// provided by the client.
+	search.Title = app.readString(qs, "title", "")
+	search.Genres = app.readCSV(qs, "genres", []string{})
+
+	// Read the genres_match value, which controls whether movies must contain all of
+	// the genres or just any of them, and check that it's one of the supported values.
+	search.GenresMatch = app.readString(qs, "genres_match", "all")
+	v.Check(validator.In(search.GenresMatch, "all", "any"), "genres_match", `must be either "all" or "any"`)
+
+	// Read the year_from and year_to values, which default to zero (meaning the range is
+	// unbounded on that side), and check that any bounds provided are sensible.
+	search.YearFrom = app.readInt(qs, "year_from", 0, v)
+	search.YearTo = app.readInt(qs, "year_to", 0, v)
+
+	currentYear := time.Now().Year()
+
+	if search.YearFrom != 0 {
+		v.Check(validator.Min(search.YearFrom, 1888), "year_from", "must be greater than 1888")
+		v.Check(validator.Max(search.YearFrom, currentYear), "year_from", "must not be in the future")
+	}
+	if search.YearTo != 0 {
+		v.Check(validator.Min(search.YearTo, 1888), "year_to", "must be greater than 1888")
+		v.Check(validator.Max(search.YearTo, currentYear), "year_to", "must not be in the future")
+	}
+	if search.YearFrom != 0 && search.YearTo != 0 {
+		v.Check(validator.Max(search.YearFrom, search.YearTo), "year_from", "must not be greater than year_to")
+	}
+
+	return search
+}
+
+// The countMoviesHandler() handler returns the number of movies matching the same title,
+// genres and year filters as listMoviesHandler, without fetching the movies themselves.
+func (app *application) countMoviesHandler(response http.ResponseWriter, request *http.Request) {
+	v := validator.New()
+
+	search := app.readMovieSearch(request.URL.Query(), v)
+
+	if !v.Valid() {
+		app.failedValidationResponse(response, request, v)
+		return
+	}
+
+	count, err := app.models.Movies.Count(request.Context(), search.Title, search.Genres, search.GenresMatch, search.YearFrom, search.YearTo)
 	if err != nil {
 		app.serverErrorResponse(response, request, err)
+		return
+	}
+
+	err = app.writeJSON(response, http.StatusOK, envelope{"count": count}, nil)
+	if err != nil {
+		app.serverErrorResponse(response, request, err)
+	}
+}
+
+// The movieFieldSafelist holds the names of the movie fields which clients can ask for
+// with the fields query string parameter.
+var movieFieldSafelist = []string{"id", "created_at", "updated_at", "deleted_at", "title", "year", "runtime", "genres", "version"}
+
+// The readMovieFields() helper reads the comma-separated fields query string parameter
+// and checks each field against movieFieldSafelist, recording an error naming the first
+// unknown field. A missing or empty value means all fields, and returns nil.
+func (app *application) readMovieFields(qs url.Values, v *validator.Validator) []string {
+	fields := app.readCSV(qs, "fields", nil)
+
+	for _, field := range fields {
+		if !validator.In(field, movieFieldSafelist...) {
+			v.AddError("fields", fmt.Sprintf("unknown field %q", field))
+			break
+		}
+	}
+
+	return fields
+}
+
+// The selectMovieFields() function returns the movie with only the given fields. If no
+// fields are given the movie is returned unchanged. Otherwise the movie is encoded to
+// JSON (so that the usual field names and formatting apply) and only the requested keys
+// are kept.
+func selectMovieFields(movie *data.Movie, fields []string) (any, error) {
+	if len(fields) == 0 {
+		return movie, nil
+	}
+
+	js, err := json.Marshal(movie)
+	if err != nil {
+		return nil, err
+	}
+
+	var all map[string]json.RawMessage
+	err = json.Unmarshal(js, &all)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			selected[field] = value
+		}
+	}
+
+	return selected, nil
+}
+
+// The writeMoviesCSV() method streams a slice of movies to the client as CSV, with a
+// header row followed by one row per movie. The genres for each movie are joined with
+// a semicolon so that they fit in a single field. The pagination metadata is sent in
+// the X-Total-Records, X-Next-Cursor and Link headers, as there's nowhere to put it in
+// the CSV itself.
+func (app *application) writeMoviesCSV(response http.ResponseWriter, request *http.Request, movies []*data.Movie, metadata data.Metadata) {
+	response.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	response.Header().Set("Content-Disposition", `attachment; filename="movies.csv"`)
+	setPaginationHeaders(response.Header(), request, metadata)
+	response.WriteHeader(http.StatusOK)
+
+	// Write directly to the http.ResponseWriter. Once the header has been sent we can no
+	// longer change the status code, so any error from here on is just logged.
+	w := csv.NewWriter(response)
+
+	err := w.Write([]string{"id", "title", "year", "runtime", "genres", "version"})
+	if err != nil {
+		app.logError(request, err)
+		return
+	}
+
+	for _, movie := range movies {
+		err = w.Write([]string{
+			strconv.FormatInt(movie.ID, 10),
+			movie.Title,
+			strconv.Itoa(int(movie.Year)),
+			strconv.Itoa(int(movie.Runtime)),
+			strings.Join(movie.Genres, ";"),
+			strconv.Itoa(int(movie.Version)),
+		})
+		if err != nil {
+			app.logError(request, err)
+			return
+		}
+	}
+
+	// Flush any buffered data to the underlying writer and check for errors.
+	w.Flush()
+	if err := w.Error(); err != nil {
+		app.logError(request, err)
+	}
+}
+
+// The setPaginationHeaders() function copies the pagination metadata for a list into
+// response headers. X-Total-Records is set in page mode, X-Next-Cursor is set in cursor
+// mode when there are more results, and the Link header holds the URLs of the
+// neighbouring pages (with every other query string parameter left as it was).
+func setPaginationHeaders(header http.Header, request *http.Request, metadata data.Metadata) {
+	if metadata.TotalRecords != nil {
+		header.Set("X-Total-Records", strconv.Itoa(*metadata.TotalRecords))
 	}
+
+	var links []string
+
+	if metadata.NextCursor != 0 {
+		header.Set("X-Next-Cursor", strconv.FormatInt(metadata.NextCursor, 10))
+		links = append(links, pageLink(request, "cursor", metadata.NextCursor, "next"))
+	}
+
+	if metadata.CurrentPage > 1 && metadata.LastPage > 0 {
+		links = append(links, pageLink(request, "page", int64(min(metadata.CurrentPage-1, metadata.LastPage)), "prev"))
+	}
+
+	if metadata.CurrentPage > 0 && metadata.CurrentPage < metadata.LastPage {
+		links = append(links, pageLink(request, "page", int64(metadata.CurrentPage+1), "next"))
+	}
+
+	if len(links) > 0 {
+		header.Set("Link", strings.Join(links, ", "))
+	}
+}
+
+// The pageLink() function returns a Link header value pointing at the request URL with
+// one query string parameter replaced.
+func pageLink(request *http.Request, key string, value int64, rel string) string {
+	u := *request.URL
+
+	qs := u.Query()
+	qs.Set(key, strconv.FormatInt(value, 10))
+	u.RawQuery = qs.Encode()
+
+	return fmt.Sprintf("<%s>; rel=%q", u.RequestURI(), rel)
 }
\ No newline at end of file
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"greenlight.nursultandias.net/internal/data"
+)
+
+func TestWriteMoviesCSV(t *testing.T) {
+	app := newTestApplication(t)
+
+	movies := []*data.Movie{
+		{ID: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}, Version: 1},
+		{ID: 2, Title: `Say "Cheese", Please`, Year: 2001, Runtime: 90, Genres: []string{"comedy"}, Version: 3},
+		{ID: 3, Title: "Untitled", Year: 2020, Runtime: 0, Genres: nil, Version: 1},
+		{ID: 4, Title: "Line one\nLine two, \"quoted\"", Year: 1999, Runtime: 120, Genres: []string{"drama"}, Version: 2},
+	}
+	total := 7
+
+	request := httptest.NewRequest(http.MethodGet, "/v1/movies?format=csv&page=2&page_size=3&title=a", nil)
+	rr := httptest.NewRecorder()
+
+	app.writeMoviesCSV(rr, request, movies, data.Metadata{CurrentPage: 2, PageSize: 3, FirstPage: 1, LastPage: 3, TotalRecords: &total})
+
+	// Every field (including titles with commas, quotes and newlines) must round-trip
+	// through a standard CSV reader.
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{
+		{"id", "title", "year", "runtime", "genres", "version"},
+		{"1", "Moana", "2016", "107", "animation;adventure", "1"},
+		{"2", `Say "Cheese", Please`, "2001", "90", "comedy", "3"},
+		{"3", "Untitled", "2020", "0", "", "1"},
+		{"4", "Line one\nLine two, \"quoted\"", "1999", "120", "drama", "2"},
+	}
+	if fmt.Sprintf("%q", records) != fmt.Sprintf("%q", want) {
+		t.Errorf("got records:\n%q\nwant:\n%q", records, want)
+	}
+
+	headers := map[string]string{
+		"Content-Type":			"text/csv; charset=utf-8",
+		"X-Total-Records":		"7",
+		"X-Next-Cursor":		"",
+		"Link":					`</v1/movies?format=csv&page=1&page_size=3&title=a>; rel="prev", </v1/movies?format=csv&page=3&page_size=3&title=a>; rel="next"`,
+	}
+	for name, want := range headers {
+		if got := rr.Header().Get(name); got != want {
+			t.Errorf("got %s header %q; want %q", name, got, want)
+		}
+	}
+}
+
+func TestSetPaginationHeaders(t *testing.T) {
+	zero := 0
+	total := 45
+
+	tests := []struct {
+		name		string
+		url			string
+		metadata	data.Metadata
+		wantTotal	string
+		wantCursor	string
+		wantLink	string
+	}{
+		{
+			name:		"empty result",
+			url:		"/v1/movies?format=csv",
+			metadata:	data.Metadata{CurrentPage: 1, PageSize: 20, TotalRecords: &zero},
+			wantTotal:	"0",
+		},
+		{
+			name:		"first page",
+			url:		"/v1/movies?format=csv",
+			metadata:	data.Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 3, TotalRecords: &total},
+			wantTotal:	"45",
+			wantLink:	`</v1/movies?format=csv&page=2>; rel="next"`,
+		},
+		{
+			name:		"last page",
+			url:		"/v1/movies?format=csv&page=3",
+			metadata:	data.Metadata{CurrentPage: 3, PageSize: 20, FirstPage: 1, LastPage: 3, TotalRecords: &total},
+			wantTotal:	"45",
+			wantLink:	`</v1/movies?format=csv&page=2>; rel="prev"`,
+		},
+		{
+			name:		"past the last page",
+			url:		"/v1/movies?format=csv&page=9",
+			metadata:	data.Metadata{CurrentPage: 9, PageSize: 20, FirstPage: 1, LastPage: 3, TotalRecords: &total},
+			wantTotal:	"45",
+			wantLink:	`</v1/movies?format=csv&page=3>; rel="prev"`,
+		},
+		{
+			name:		"cursor with more results",
+			url:		"/v1/movies?format=csv&cursor=10",
+			metadata:	data.Metadata{PageSize: 20, NextCursor: 30},
+			wantCursor:	"30",
+			wantLink:	`</v1/movies?cursor=30&format=csv>; rel="next"`,
+		},
+		{
+			name:		"cursor at the end",
+			url:		"/v1/movies?format=csv&cursor=30",
+			metadata:	data.Metadata{PageSize: 20},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			setPaginationHeaders(header, httptest.NewRequest(http.MethodGet, tt.url, nil), tt.metadata)
+
+			if got := header.Get("X-Total-Records"); got != tt.wantTotal {
+				t.Errorf("got X-Total-Records %q; want %q", got, tt.wantTotal)
+			}
+			if got := header.Get("X-Next-Cursor"); got != tt.wantCursor {
+				t.Errorf("got X-Next-Cursor %q; want %q", got, tt.wantCursor)
+			}
+			if got := header.Get("Link"); got != tt.wantLink {
+				t.Errorf("got Link %q; want %q", got, tt.wantLink)
+			}
+		})
+	}
+}
+
+func TestRestoreMovieHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ctx := context.Background()
+
+	movie := &data.Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	err := app.models.Movies.Insert(ctx, movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.models.Movies.Delete(ctx, movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, events, unsubscribe := app.events.subscribe(false, 0)
+	defer unsubscribe()
+
+	rr := httptest.NewRecorder()
+	app.restoreMovieHandler(rr, withParams(httptest.NewRequest(http.MethodPut, "/v1/movies/1/restore", nil), "id", "1"))
+	app.wg.Wait()
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d", rr.Code, http.StatusOK)
+	}
+
+	select {
+	case event := <-events:
+		if event.eventType != data.EventMovieRestored {
+			t.Errorf("got event %q; want %q", event.eventType, data.EventMovieRestored)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event was published")
+	}
+
+	// Restoring the movie a second time fails, as it's no longer deleted.
+	rr = httptest.NewRecorder()
+	app.restoreMovieHandler(rr, withParams(httptest.NewRequest(http.MethodPut, "/v1/movies/1/restore", nil), "id", "1"))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("got status %d for a second restore; want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestListMoviesIncludeDeleted(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.maxPageSize = 100
+	ctx := context.Background()
+
+	for _, title := range []string{"Moana", "Deadpool"} {
+		err := app.models.Movies.Insert(ctx, &data.Movie{Title: title, Year: 2016, Runtime: 100, Genres: []string{"action"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := app.models.Movies.Delete(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query		string
+		wantStatus	int
+		wantIDs		[]int64
+	}{
+		{query: "", wantStatus: http.StatusOK, wantIDs: []int64{1}},
+		{query: "?include_deleted=false", wantStatus: http.StatusOK, wantIDs: []int64{1}},
+		{query: "?include_deleted=true", wantStatus: http.StatusOK, wantIDs: []int64{1, 2}},
+		{query: "?include_deleted=1", wantStatus: http.StatusOK, wantIDs: []int64{1, 2}},
+		{query: "?include_deleted=yes", wantStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			app.listMoviesHandler(rr, httptest.NewRequest(http.MethodGet, "/v1/movies"+tt.query, nil))
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d", rr.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Movies	[]struct {
+					ID			int64		`json:"id"`
+					DeletedAt	*time.Time	`json:"deleted_at"`
+				}	`json:"movies"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(body.Movies) != len(tt.wantIDs) {
+				t.Fatalf("got %d movies; want %d", len(body.Movies), len(tt.wantIDs))
+			}
+			for i, movie := range body.Movies {
+				if movie.ID != tt.wantIDs[i] {
+					t.Errorf("got movie %d at position %d; want %d", movie.ID, i, tt.wantIDs[i])
+				}
+				if (movie.DeletedAt != nil) != (movie.ID == 2) {
+					t.Errorf("got deleted_at %v for movie %d", movie.DeletedAt, movie.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestMovieHistoryAfterHardDelete(t *testing.T) {
+	app := newTestApplication(t)
+	ctx := context.Background()
+
+	err := app.models.Movies.Insert(ctx, &data.Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.models.Movies.HardDelete(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id			string
+		wantStatus	int
+		wantEntries	int
+	}{
+		{id: "1", wantStatus: http.StatusOK, wantEntries: 2},
+		{id: "2", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		app.movieHistoryHandler(rr, withParams(httptest.NewRequest(http.MethodGet, "/v1/movies/"+tt.id+"/history", nil), "id", tt.id))
+
+		if rr.Code != tt.wantStatus {
+			t.Fatalf("movie %s: got status %d; want %d", tt.id, rr.Code, tt.wantStatus)
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+
+		var body struct {
+			History	[]data.AuditEntry	`json:"history"`
+		}
+		err := json.Unmarshal(rr.Body.Bytes(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(body.History) != tt.wantEntries {
+			t.Errorf("movie %s: got %d history entries; want %d", tt.id, len(body.History), tt.wantEntries)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// The openAPIDocument is the OpenAPI 3 description of the API, which is embedded in the
+// binary. It's maintained by hand, so remember to update openapi.json whenever an
+// endpoint is added or changed.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// The openAPIHandler() handler sends the embedded OpenAPI document as-is.
+func (app *application) openAPIHandler(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(openAPIDocument)
+}
\ No newline at end of file
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/netip"
+	"strings"
+	"time"
+	"github.com/julienschmidt/httprouter"
+)
+
+// The pprofPathPrefix is the path under which the pprof handlers are registered when
+// the -debug-pprof flag is set.
+const pprofPathPrefix = "/debug/pprof/"
+
+// The pprofHandler() handler serves the net/http/pprof endpoints. They're registered
+// with a single catch-all route, as httprouter won't register the named profiles
+// (/debug/pprof/:name) alongside the static cmdline, profile, symbol and trace paths.
+// pprof.Index() serves both the index page and the named profiles, such as
+// /debug/pprof/heap.
+func (app *application) pprofHandler(response http.ResponseWriter, request *http.Request) {
+	params := httprouter.ParamsFromContext(request.Context())
+
+	switch strings.TrimPrefix(params.ByName("item"), "/") {
+	case "cmdline":
+		pprof.Cmdline(response, request)
+	case "profile":
+		// CPU profiles and traces run for as long as the client asks (30 seconds by
+		// default for a profile), which can be longer than the server's write timeout.
+		http.NewResponseController(response).SetWriteDeadline(time.Time{})
+		pprof.Profile(response, request)
+	case "trace":
+		http.NewResponseController(response).SetWriteDeadline(time.Time{})
+		pprof.Trace(response, request)
+	case "symbol":
+		pprof.Symbol(response, request)
+	default:
+		pprof.Index(response, request)
+	}
+}
+
+// The allowPprofClient() middleware only lets through requests from clients whose IP
+// address is in the -debug-pprof-allow list. Other clients get a 404, so that the
+// endpoints don't appear to exist. If the list is empty, every client is allowed.
+// The address is taken from the connection rather than any forwarding headers, which
+// the client could set to anything.
+func (app *application) allowPprofClient(next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		if len(app.config.pprof.allow) == 0 {
+			next(response, request)
+			return
+		}
+
+		host, _, err := net.SplitHostPort(request.RemoteAddr)
+		if err != nil {
+			app.notFoundResponse(response, request)
+			return
+		}
+
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			app.notFoundResponse(response, request)
+			return
+		}
+
+		for _, prefix := range app.config.pprof.allow {
+			if prefix.Contains(addr.Unmap()) {
+				next(response, request)
+				return
+			}
+		}
+
+		app.notFoundResponse(response, request)
+	}
+}
+
+// The parseIPAllowlist() function parses a space separated list of IP addresses and
+// CIDR ranges, such as "127.0.0.1 10.0.0.0/8", into a slice of prefixes. A single
+// address is treated as a range containing just that address.
+func parseIPAllowlist(val string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for _, field := range strings.Fields(val) {
+		if strings.Contains(field, "/") {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+
+	return prefixes, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The unmatchedRoute is used as the route label for requests which didn't match any
+// route (such as 404 and 405 responses), so that arbitrary paths can't add labels.
+const unmatchedRoute = "unmatched"
+
+// The promMetrics type holds the Prometheus collectors which are exported at /metrics
+// when the -metrics-enabled flag is set.
+type promMetrics struct {
+	registry	*prometheus.Registry
+	requests	*prometheus.CounterVec
+	duration	*prometheus.HistogramVec
+	inFlight	prometheus.Gauge
+}
+
+// The newPromMetrics() function creates and registers the collectors. The requests are
+// labelled by the route pattern rather than the path, so that the number of label values
+// stays bounded. The connection pool statistics are collected for the primary database
+// and, if it's a different pool, the read replica.
+func newPromMetrics(db, readDB *sql.DB) *promMetrics {
+	m := &promMetrics{
+		registry:	prometheus.NewRegistry(),
+		requests:	prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:	"http_requests_total",
+			Help:	"Total number of HTTP requests, by route, method and status code.",
+		}, []string{"route", "method", "status"}),
+		duration:	prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:		"http_request_duration_seconds",
+			Help:		"Time taken to handle HTTP requests, by route and method.",
+			Buckets:	prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		inFlight:	prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:	"http_requests_in_flight",
+			Help:	"Number of HTTP requests currently being handled.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.duration,
+		m.inFlight,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(db, "primary"),
+	)
+
+	if readDB != nil && readDB != db {
+		m.registry.MustRegister(collectors.NewDBStatsCollector(readDB, "replica"))
+	}
+
+	return m
+}
+
+// The recordMetrics() middleware records the Prometheus metrics for each request. It
+// must wrap the router, as it relies on the route handlers (see route()) to fill in
+// the matched route pattern. If metrics aren't enabled, it does nothing.
+func (app *application) recordMetrics(next http.Handler) http.Handler {
+	if app.prometheus == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+
+		app.prometheus.inFlight.Inc()
+		defer app.prometheus.inFlight.Dec()
+
+		request, route := app.contextSetRoute(request)
+
+		mw := newMetricsResponseWriter(response)
+		next.ServeHTTP(mw, request)
+
+		pattern := route.pattern
+		if pattern == "" {
+			pattern = unmatchedRoute
+		}
+
+		app.prometheus.requests.WithLabelValues(pattern, request.Method, strconv.Itoa(mw.statusCode)).Inc()
+		app.prometheus.duration.WithLabelValues(pattern, request.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// The route() method wraps the handler for a route so that it records the route
+// pattern in the request context, for the recordMetrics() middleware.
+func (app *application) route(pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if route := app.contextGetRoute(request); route != nil {
+			route.pattern = pattern
+		}
+
+		next.ServeHTTP(response, request)
+	})
+}
+
+// The metricsHandler() method returns the handler for GET /metrics. If a username is
+// configured, the client must supply it and the password with HTTP basic auth.
+func (app *application) metricsHandler() http.Handler {
+	handler := promhttp.HandlerFor(app.prometheus.registry, promhttp.HandlerOpts{})
+
+	if app.config.metrics.username == "" {
+		return handler
+	}
+
+	return app.requireBasicAuth(app.config.metrics.username, app.config.metrics.password, handler.ServeHTTP)
+}
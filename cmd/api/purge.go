@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Soft-deleted movies are kept for purgeDeletedAfter so that they can be restored, and
+// are then permanently removed by a job which runs every purgeInterval.
+const (
+	purgeDeletedAfter	= 30 * 24 * time.Hour
+	purgeInterval		= time.Hour
+)
+
+// The purgeDeletedMovies() method runs the purge job until the context is cancelled. It
+// should be started with the background() helper, so that the shutdown waits for a
+// purge which is in progress to finish.
+func (app *application) purgeDeletedMovies(ctx context.Context) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := app.models.Movies.PurgeDeleted(ctx, time.Now().Add(-purgeDeletedAfter))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			app.logger.PrintError(err, map[string]any{"job": "purge_deleted_movies"})
+		} else if purged > 0 {
+			app.logger.PrintInfo("purged deleted movies", map[string]any{
+				"job":		"purge_deleted_movies",
+				"purged":	purged,
+			})
+		}
+
+		// Expired idempotency keys are deleted by the same job.
+		purged, err = app.models.IdempotencyKeys.DeleteExpired(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			app.logger.PrintError(err, map[string]any{"job": "purge_deleted_movies"})
+		} else if purged > 0 {
+			app.logger.PrintInfo("deleted expired idempotency keys", map[string]any{
+				"job":		"purge_deleted_movies",
+				"deleted":	purged,
+			})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
\ No newline at end of file
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"expvar"
 	"net/http"
+	"strings"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -12,11 +14,99 @@ func (app *application) routes() http.Handler {
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.listMoviesHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.createMovieHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.showMovieHandler)
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.updateMovieHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.deleteMovieHandler)
-	return app.recoverPanic(router)
+	// Every route is registered through handle(), which records the route pattern for
+	// the Prometheus metrics (see route()).
+	handle := func(method, pattern string, handler http.HandlerFunc) {
+		router.Handler(method, pattern, app.route(pattern, handler))
+	}
+
+	handle(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	handle(http.MethodGet, "/v1/healthcheck/live", app.liveHandler)
+	handle(http.MethodGet, "/v1/openapi.json", app.openAPIHandler)
+
+	// HEAD requests for the movie resources are sent to the same handlers as GET
+	// requests, so they have identical status codes and headers (including the ETag).
+	// The http.Server discards the body of the response to a HEAD request.
+	handle(http.MethodGet, "/v1/movies", app.listMoviesHandler)
+	handle(http.MethodHead, "/v1/movies", app.listMoviesHandler)
+	handle(http.MethodPost, "/v1/movies", app.idempotent(app.createMovieHandler))
+	// POST /v1/movies/batch is registered as /v1/movies/:id, so that it doesn't clash
+	// with POST /v1/movies/:id/genres (see routeByID()). There's no POST handler for a
+	// movie itself, so any other ID gets a 405 Method Not Allowed response.
+	handle(http.MethodPost, "/v1/movies/:id", app.routeByID(app.methodNotAllowedResponse, map[string]http.HandlerFunc{
+		"batch":	app.createMoviesBatchHandler,
+	}))
+	movieStatics := map[string]http.HandlerFunc{
+		"events":	app.movieEventsHandler,
+		"count":	app.countMoviesHandler,
+	}
+	handle(http.MethodGet, "/v1/movies/:id", app.routeByID(app.showMovieHandler, movieStatics))
+	handle(http.MethodHead, "/v1/movies/:id", app.routeByID(app.showMovieHandler, movieStatics))
+	handle(http.MethodPut, "/v1/movies/:id", app.replaceMovieHandler)
+	handle(http.MethodPatch, "/v1/movies/:id", app.updateMovieHandler)
+	handle(http.MethodDelete, "/v1/movies/:id", app.deleteMovieHandler)
+	handle(http.MethodPut, "/v1/movies/:id/restore", app.restoreMovieHandler)
+	handle(http.MethodGet, "/v1/movies/:id/history", app.movieHistoryHandler)
+	handle(http.MethodPost, "/v1/movies/:id/genres", app.addMovieGenreHandler)
+	handle(http.MethodDelete, "/v1/movies/:id/genres/:genre", app.removeMovieGenreHandler)
+
+	handle(http.MethodGet, "/v1/genres", app.listGenresHandler)
+
+	// The webhooks make the server send signed requests to any URL, so they're only
+	// available to an administrator. There are no user accounts yet, so the routes are
+	// only registered when the -admin-username and -admin-password flags are set.
+	if app.config.admin.username != "" {
+		admin := func(next http.HandlerFunc) http.HandlerFunc {
+			return app.requireBasicAuth(app.config.admin.username, app.config.admin.password, next)
+		}
+
+		handle(http.MethodGet, "/v1/webhooks", admin(app.listWebhooksHandler))
+		handle(http.MethodPost, "/v1/webhooks", admin(app.createWebhookHandler))
+		handle(http.MethodDelete, "/v1/webhooks/:id", admin(app.deleteWebhookHandler))
+	}
+
+	// Register a new GET /debug/vars endpoint pointing to the expvar handler.
+	handle(http.MethodGet, "/debug/vars", expvar.Handler().ServeHTTP)
+
+	// Register the pprof endpoints if the -debug-pprof flag is set. The symbol endpoint
+	// also accepts POST requests.
+	if app.config.pprof.enabled {
+		handle(http.MethodGet, pprofPathPrefix+"*item", app.allowPprofClient(app.pprofHandler))
+		handle(http.MethodPost, pprofPathPrefix+"*item", app.allowPprofClient(app.pprofHandler))
+	}
+
+	// Register the GET /metrics endpoint for Prometheus, if it's enabled.
+	if app.prometheus != nil {
+		handle(http.MethodGet, "/metrics", app.metricsHandler().ServeHTTP)
+	}
+
+	// Wrap the router with the metrics() and recordMetrics() middleware, so that every
+	// request (including those to /debug/vars) is counted. The requestID() middleware is outermost so that
+	// every log entry written while handling the request includes its ID, followed by
+	// logRequest() which writes the access log entry. The prettyJSON() middleware is
+	// innermost, so that writeJSON() receives its wrapped http.ResponseWriter directly.
+	return app.requestID(app.logRequest(app.metrics(app.recordMetrics(app.trackInFlight(app.gzipResponse(app.recoverPanic(app.enableCORS(app.prettyJSON(router)))))))))
+}
+
+// httprouter doesn't allow a static path segment in the same position as a named
+// parameter, so GET /v1/movies/events can't be registered alongside GET
+// /v1/movies/:id. Instead, the routeByID() helper returns a handler for the :id route
+// which sends requests for any of the static names to their own handler, and all
+// other requests to the idHandler. For the metrics, the :id in the route pattern is
+// replaced with the static name.
+func (app *application) routeByID(idHandler http.HandlerFunc, static map[string]http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		params := httprouter.ParamsFromContext(request.Context())
+
+		if handler, ok := static[params.ByName("id")]; ok {
+			if route := app.contextGetRoute(request); route != nil {
+				route.pattern = strings.Replace(route.pattern, ":id", params.ByName("id"), 1)
+			}
+
+			handler(response, request)
+			return
+		}
+
+		idHandler(response, request)
+	}
 }
\ No newline at end of file
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"greenlight.nursultandias.net/internal/data"
+)
+
+func TestHeadMovieRoutes(t *testing.T) {
+	app := newTestApplication(t)
+
+	movie := &data.Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	err := app.models.Movies.Insert(context.Background(), movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := app.routes()
+
+	tests := []struct {
+		path		string
+		wantStatus	int
+	}{
+		{"/v1/movies/1", http.StatusOK},
+		{"/v1/movies/2", http.StatusNotFound},
+		{"/v1/movies/count", http.StatusOK},
+		{"/v1/movies/events", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			head := httptest.NewRecorder()
+			routes.ServeHTTP(head, httptest.NewRequest(http.MethodHead, tt.path, nil))
+
+			if head.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d", head.Code, tt.wantStatus)
+			}
+
+			// The events stream never ends, so it isn't compared with a GET request.
+			if tt.path == "/v1/movies/events" {
+				if got := head.Header().Get("Content-Type"); got != "text/event-stream" {
+					t.Errorf("got Content-Type %q; want text/event-stream", got)
+				}
+				return
+			}
+
+			get := httptest.NewRecorder()
+			routes.ServeHTTP(get, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if head.Code != get.Code {
+				t.Errorf("got status %d; GET returned %d", head.Code, get.Code)
+			}
+			for _, name := range []string{"Content-Type", "ETag"} {
+				if head.Header().Get(name) != get.Header().Get(name) {
+					t.Errorf("got %s %q; GET returned %q", name, head.Header().Get(name), get.Header().Get(name))
+				}
+			}
+		})
+	}
+}
+
+func TestPprofRoutes(t *testing.T) {
+	tests := []struct {
+		name		string
+		enabled		bool
+		allow		string
+		remoteAddr	string
+		wantStatus	int
+	}{
+		{name: "disabled", enabled: false, remoteAddr: "127.0.0.1:1234", wantStatus: http.StatusNotFound},
+		{name: "enabled", enabled: true, remoteAddr: "127.0.0.1:1234", wantStatus: http.StatusOK},
+		{name: "allowed client", enabled: true, allow: "127.0.0.1 10.0.0.0/8", remoteAddr: "10.1.2.3:1234", wantStatus: http.StatusOK},
+		{name: "other client", enabled: true, allow: "127.0.0.1 10.0.0.0/8", remoteAddr: "192.0.2.1:1234", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.pprof.enabled = tt.enabled
+			if tt.allow != "" {
+				allow, err := parseIPAllowlist(tt.allow)
+				if err != nil {
+					t.Fatal(err)
+				}
+				app.config.pprof.allow = allow
+			}
+
+			request := httptest.NewRequest(http.MethodGet, pprofPathPrefix+"cmdline", nil)
+			request.RemoteAddr = tt.remoteAddr
+
+			rr := httptest.NewRecorder()
+			app.routes().ServeHTTP(rr, request)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("got status %d; want %d", rr.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestMovieGenreRoutes(t *testing.T) {
+	app := newTestApplication(t)
+
+	movie := &data.Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	err := app.models.Movies.Insert(context.Background(), movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := app.routes()
+
+	tests := []struct {
+		name		string
+		method		string
+		path		string
+		body		string
+		wantStatus	int
+		wantGenres	[]string
+	}{
+		{name: "add genre", method: http.MethodPost, path: "/v1/movies/1/genres", body: `{"genre": "musical"}`, wantStatus: http.StatusOK, wantGenres: []string{"animation", "musical"}},
+		{name: "add existing genre", method: http.MethodPost, path: "/v1/movies/1/genres", body: `{"genre": "musical"}`, wantStatus: http.StatusOK, wantGenres: []string{"animation", "musical"}},
+		{name: "remove genre", method: http.MethodDelete, path: "/v1/movies/1/genres/animation", wantStatus: http.StatusOK, wantGenres: []string{"musical"}},
+		{name: "remove missing genre", method: http.MethodDelete, path: "/v1/movies/1/genres/animation", wantStatus: http.StatusNotFound},
+		{name: "remove only genre", method: http.MethodDelete, path: "/v1/movies/1/genres/musical", wantStatus: http.StatusUnprocessableEntity, wantGenres: []string{"musical"}},
+		{name: "missing movie", method: http.MethodPost, path: "/v1/movies/2/genres", body: `{"genre": "musical"}`, wantStatus: http.StatusNotFound},
+		{name: "batch", method: http.MethodPost, path: "/v1/movies/batch", body: `[{"title": "Up", "year": 2009, "runtime": "96 mins", "genres": ["animation"]}]`, wantStatus: http.StatusCreated},
+		{name: "post to a movie", method: http.MethodPost, path: "/v1/movies/1", wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+
+		if rr.Code != tt.wantStatus {
+			t.Fatalf("%s: got status %d; want %d: %s", tt.name, rr.Code, tt.wantStatus, rr.Body)
+		}
+
+		if tt.wantGenres != nil {
+			stored, err := app.models.Movies.Get(context.Background(), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(stored.Genres, tt.wantGenres) {
+				t.Errorf("%s: got genres %q; want %q", tt.name, stored.Genres, tt.wantGenres)
+			}
+		}
+	}
+}
+
+func TestWebhookRoutesRequireAdmin(t *testing.T) {
+	body := `{"url": "https://example.com/hook", "events": ["movie.created"]}`
+
+	tests := []struct {
+		name		string
+		admin		bool
+		username	string
+		password	string
+		wantStatus	int
+	}{
+		{name: "no admin credentials configured", admin: false, wantStatus: http.StatusNotFound},
+		{name: "no credentials", admin: true, wantStatus: http.StatusUnauthorized},
+		{name: "wrong password", admin: true, username: "admin", password: "wrong", wantStatus: http.StatusUnauthorized},
+		{name: "admin", admin: true, username: "admin", password: "secret", wantStatus: http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			if tt.admin {
+				app.config.admin.username = "admin"
+				app.config.admin.password = "secret"
+			}
+
+			request := httptest.NewRequest(http.MethodPost, "/v1/webhooks", strings.NewReader(body))
+			if tt.username != "" {
+				request.SetBasicAuth(tt.username, tt.password)
+			}
+
+			rr := httptest.NewRecorder()
+			app.routes().ServeHTTP(rr, request)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("got status %d; want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Define the exit codes that the application can terminate with, so that process
+// supervisors can tell the different kinds of shutdown apart.
+const (
+	exitOK					= 0	// Clean shutdown.
+	exitServerError			= 1	// The server failed unexpectedly (e.g. the port is in use).
+	exitConfigInvalid		= 2	// The configuration failed validation.
+	exitDatabaseUnavailable	= 3	// The database couldn't be reached at startup.
+	exitDrainTimeout		= 4	// The drain timeout expired with requests still in-flight.
+	exitBackgroundAbandoned	= 5	// Background tasks were still running when we gave up waiting.
+	exitMigrationFailed		= 6	// The database migrations couldn't be applied (e.g. the schema is dirty).
+)
+
+// The shutdownTimeout is the maximum amount of time that we give in-flight requests
+// and background tasks to complete once a shutdown signal has been received.
+const shutdownTimeout = 30 * time.Second
+
+// The shutdownReport type records what happened during each phase of a graceful
+// shutdown. It's returned by serve() and translated into an exit code by run().
+type shutdownReport struct {
+	signal					string
+	drainDuration			time.Duration
+	drainTimedOut			bool
+	abandonedRequests		int64
+	backgroundWaitDuration	time.Duration
+	abandonedTasks			int64
+	componentStopDuration	time.Duration
+}
+
+// The exitCode() method returns the process exit code matching the report. A drain
+// timeout takes precedence over abandoned background tasks.
+func (report shutdownReport) exitCode() int {
+	switch {
+	case report.drainTimedOut:
+		return exitDrainTimeout
+	case report.abandonedTasks > 0:
+		return exitBackgroundAbandoned
+	default:
+		return exitOK
+	}
+}
+
+// The properties() method returns the report in a form suitable for including in a
+// log entry.
+func (report shutdownReport) properties() map[string]any {
+	return map[string]any{
+		"signal":					report.signal,
+		"drain_duration":			report.drainDuration.String(),
+		"abandoned_requests":		report.abandonedRequests,
+		"background_wait_duration":	report.backgroundWaitDuration.String(),
+		"abandoned_tasks":			report.abandonedTasks,
+		"component_stop_duration":	report.componentStopDuration.String(),
+		"exit_code":				report.exitCode(),
+	}
+}
+
+// The serve() method starts the HTTP server and blocks until either the server fails
+// or a SIGINT/SIGTERM signal is received. In the latter case it drains in-flight
+// requests, waits for background tasks, and returns a report of what happened.
+func (app *application) serve() (shutdownReport, error) {
+	// Declare a HTTP server with the timeout settings from the config struct, which
+	// listens on the port provided in the config struct and uses the servemux we created
+	// above as the handler
+	srv := &http.Server{
+		Addr:			fmt.Sprintf(":%d", app.config.port),
+		Handler:		app.routes(),
+		IdleTimeout:	app.config.server.idleTimeout,
+		ReadTimeout:	app.config.server.readTimeout,
+		WriteTimeout:	app.config.server.writeTimeout,
+	}
+
+	// If a certificate and key were given we serve HTTPS, accepting only TLS 1.2 and
+	// later and preferring the curves which have assembly implementations.
+	tlsEnabled := app.config.tls.certFile != ""
+	if tlsEnabled {
+		srv.TLSConfig = &tls.Config{
+			MinVersion:			tls.VersionTLS12,
+			CurvePreferences:	[]tls.CurveID{tls.X25519, tls.CurveP256},
+		}
+	}
+
+	// Close the movie event streams when the shutdown starts, as they would otherwise
+	// stay open until the drain timeout expires.
+	srv.RegisterOnShutdown(app.events.close)
+
+	// Use signal.Notify() to listen for incoming SIGINT and SIGTERM signals and relay
+	// them to the quit channel. Note that the channel is buffered, so that a signal
+	// isn't missed if we aren't ready to receive it at the exact moment it arrives.
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(quit)
+
+	// Start the server in a background goroutine. ListenAndServe() and
+	// ListenAndServeTLS() always return a non-nil error, which we relay on the
+	// serverError channel. The shutdown below works the same way in both cases.
+	serverError := make(chan error, 1)
+	go func() {
+		if tlsEnabled {
+			serverError <- srv.ListenAndServeTLS(app.config.tls.certFile, app.config.tls.keyFile)
+		} else {
+			serverError <- srv.ListenAndServe()
+		}
+	}()
+
+	// Start the job which purges old soft-deleted movies. It's stopped during the
+	// shutdown, before we wait for the background tasks to complete.
+	purgeCtx, stopPurge := context.WithCancel(context.Background())
+	defer stopPurge()
+	app.background(func() {
+		app.purgeDeletedMovies(purgeCtx)
+	})
+
+	// Again, we use the PrintInfo() method to write a "starting server" message at the
+	// INFO level. But this time we pass a map containing additional properties (the
+	// operating environment, server address and whether TLS is enabled) as the final
+	// parameter.
+	app.logger.PrintInfo("starting server", map[string]any{
+		"addr":	srv.Addr,
+		"env":	app.config.env,
+		"tls":	tlsEnabled,
+	})
+
+	// Block until either the server fails or a shutdown signal is received.
+	var sig os.Signal
+	select {
+	case err := <-serverError:
+		return shutdownReport{}, err
+	case sig = <-quit:
+	}
+
+	app.logger.PrintInfo("shutting down server", map[string]any{
+		"signal": sig.String(),
+	})
+
+	report := shutdownReport{signal: sig.String()}
+
+	// Create a context with a timeout which bounds both the drain and the background
+	// wait phases.
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Call Shutdown() on the server, which stops accepting new connections and waits
+	// for in-flight requests to complete. If the context deadline is exceeded first we
+	// record how many requests were abandoned.
+	start := time.Now()
+	err := srv.Shutdown(ctx)
+	report.drainDuration = time.Since(start)
+	if err != nil {
+		if !errors.Is(err, context.DeadlineExceeded) {
+			return report, err
+		}
+		report.drainTimedOut = true
+		report.abandonedRequests = app.inFlight.Load()
+	}
+
+	stopPurge()
+
+	// Log a message to say that we're waiting for any background goroutines to
+	// complete their tasks.
+	app.logger.PrintInfo("completing background tasks", map[string]any{
+		"addr": srv.Addr,
+	})
+
+	// Wait for any background tasks to complete, giving up when the context deadline
+	// is exceeded. The WaitGroup can't be waited on with a timeout directly, so we
+	// close a channel from a separate goroutine once Wait() returns.
+	start = time.Now()
+	done := make(chan struct{})
+	go func() {
+		app.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		report.abandonedTasks = app.backgroundTasks.Load()
+	}
+	report.backgroundWaitDuration = time.Since(start)
+
+	return report, nil
+}
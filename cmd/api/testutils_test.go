@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"github.com/julienschmidt/httprouter"
+	"greenlight.nursultandias.net/internal/data"
+	"greenlight.nursultandias.net/internal/jsonlog"
+)
+
+// The newTestApplication() helper returns an application which uses the in-memory mock
+// models and discards its log output.
+func newTestApplication(t testing.TB) *application {
+	t.Helper()
+
+	return &application{
+		config: testConfig(),
+		logger: jsonlog.New(io.Discard, jsonlog.LevelOff),
+		models: data.NewMockModels(),
+	}
+}
+
+// The withParams() helper returns a copy of the request carrying the given httprouter
+// parameters (as name, value pairs), so that handlers can be called directly.
+func withParams(request *http.Request, pairs ...string) *http.Request {
+	var params httprouter.Params
+	for i := 0; i+1 < len(pairs); i += 2 {
+		params = append(params, httprouter.Param{Key: pairs[i], Value: pairs[i+1]})
+	}
+
+	ctx := context.WithValue(request.Context(), httprouter.ParamsKey, params)
+	return request.WithContext(ctx)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+	"greenlight.nursultandias.net/internal/data"
+	"greenlight.nursultandias.net/internal/validator"
+)
+
+// The webhook deliveries are retried up to webhookMaxRetries times after the first
+// attempt, waiting webhookRetryBackoff before the first retry and doubling the wait
+// before each one after that. Each attempt is given webhookDeliveryTimeout to
+// complete.
+const (
+	webhookMaxRetries		= 3
+	webhookRetryBackoff		= time.Second
+	webhookDeliveryTimeout	= 5 * time.Second
+)
+
+// The webhookSignatureHeader holds the HMAC-SHA256 signature of the request body, made
+// with the webhook's secret, so that receivers can check that the event came from us.
+const webhookSignatureHeader = "X-Greenlight-Signature"
+
+// The errWebhookPrivateAddr error is returned when a webhook's host name resolves to a
+// loopback or private address at delivery time.
+var errWebhookPrivateAddr = errors.New("webhook target resolves to a loopback or private address")
+
+// The webhookClient is the HTTP client used for deliveries. ValidateWebhook() only
+// catches IP literals, so its dialer checks the resolved address of every connection
+// as well, which stops host names that point at internal services.
+var webhookClient = &http.Client{
+	Timeout:	webhookDeliveryTimeout,
+	Transport:	&http.Transport{
+		DialContext:	(&net.Dialer{Control: webhookDialControl}).DialContext,
+	},
+}
+
+// The webhookDialControl() function refuses connections to non-public addresses.
+func webhookDialControl(network, address string, conn syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+
+	if !data.PublicAddr(addrPort.Addr()) {
+		return errWebhookPrivateAddr
+	}
+
+	return nil
+}
+
+func (app *application) createWebhookHandler(response http.ResponseWriter, request *http.Request) {
+	var input struct {
+		URL		string		`json:"url"`
+		Events	[]string	`json:"events"`
+	}
+
+	if !app.readJSONValidated(response, request, &input) {
+		return
+	}
+
+	webhook := &data.Webhook{
+		URL:	input.URL,
+		Events:	input.Events,
+	}
+
+	v := validator.New()
+
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(response, request, v)
+		return
+	}
+
+	// Generate a random secret for signing the deliveries. It's only sent to the client
+	// in this response.
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		app.serverErrorResponse(response, request, err)
+		return
+	}
+	webhook.Secret = hex.EncodeToString(secret)
+
+	err = app.models.Webhooks.Insert(request.Context(), webhook)
+	if err != nil {
+		app.serverErrorResponse(response, request, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/webhooks/%d", webhook.ID))
+
+	err = app.writeJSON(response, http.StatusCreated, envelope{"webhook": webhook}, headers)
+	if err != nil {
+		app.serverErrorResponse(response, request, err)
+	}
+}
+
+func (app *application) listWebhooksHandler(response http.ResponseWriter, request *http.Request) {
+	webhooks, err := app.models.Webhooks.GetAll(request.Context())
+	if err != nil {
+		app.serverErrorResponse(response, request, err)
+		return
+	}
+
+	err = app.writeJSON(response, http.StatusOK, envelope{"webhooks": webhooks}, nil)
+	if err != nil {
+		app.serverErrorResponse(response, request, err)
+	}
+}
+
+func (app *application) deleteWebhookHandler(response http.ResponseWriter, request *http.Request) {
+	id, err := app.readIDParam(request)
+	if err != nil {
+		app.notFoundResponse(response, request)
+		return
+	}
+
+	err = app.models.Webhooks.Delete(request.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(response, request)
+		default:
+			app.serverErrorResponse(response, request, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(response, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(response, request, err)
+	}
+}
+
+// The notifyWebhooks() method sends an event about a movie to every webhook which is
+// subscribed to it. The movie parameter is the movie data to include in the event (just
+// the ID for a deleted movie). The deliveries are made by background goroutines, so
+// they don't delay the response to the client, and any failures are only logged.
+func (app *application) notifyWebhooks(event string, movie any) {
+	payload, err := json.Marshal(envelope{
+		"event":		event,
+		"occurred_at":	time.Now().UTC().Format(time.RFC3339),
+		"movie":		movie,
+	})
+	if err != nil {
+		app.logger.PrintError(err, map[string]any{"event": event})
+		return
+	}
+
+	app.background(func() {
+		webhooks, err := app.models.Webhooks.GetForEvent(context.Background(), event)
+		if err != nil {
+			app.logger.PrintError(err, map[string]any{"event": event})
+			return
+		}
+
+		for _, webhook := range webhooks {
+			app.background(func() {
+				app.deliverWebhook(webhook, event, payload)
+			})
+		}
+	})
+}
+
+// The deliverWebhook() method POSTs an event to a webhook, retrying with exponential
+// backoff if the delivery fails, and records the outcome of the last attempt.
+func (app *application) deliverWebhook(webhook *data.Webhook, event string, payload []byte) {
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write(payload)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	var status int
+	var err error
+
+	backoff := webhookRetryBackoff
+	for attempt := 0; attempt <= webhookMaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		status, err = postWebhook(webhook.URL, event, signature, payload)
+		if err == nil {
+			break
+		}
+	}
+
+	deliveryErr := ""
+	if err != nil {
+		deliveryErr = err.Error()
+		app.logger.PrintError(err, map[string]any{
+			"webhook_id":	webhook.ID,
+			"event":		event,
+		})
+	}
+
+	err = app.models.Webhooks.RecordDelivery(context.Background(), webhook.ID, status, deliveryErr)
+	if err != nil {
+		app.logger.PrintError(err, map[string]any{"webhook_id": webhook.ID})
+	}
+}
+
+// The postWebhook() function makes a single delivery attempt. It returns the status
+// code of the response (or zero if there wasn't one), and an error unless the status
+// code was 2xx.
+func postWebhook(url, event, signature string, payload []byte) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Greenlight-Event", event)
+	request.Header.Set(webhookSignatureHeader, signature)
+
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+
+	return response.StatusCode, nil
+}
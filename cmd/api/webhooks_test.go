@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWebhookDialControl(t *testing.T) {
+	tests := []struct {
+		address	string
+		wantErr	error
+	}{
+		{"93.184.216.34:443", nil},
+		{"127.0.0.1:80", errWebhookPrivateAddr},
+		{"[::1]:80", errWebhookPrivateAddr},
+		{"10.0.0.5:8080", errWebhookPrivateAddr},
+		{"169.254.169.254:80", errWebhookPrivateAddr},
+	}
+
+	for _, tt := range tests {
+		if err := webhookDialControl("tcp", tt.address, nil); !errors.Is(err, tt.wantErr) {
+			t.Errorf("webhookDialControl(%q) = %v; want %v", tt.address, err, tt.wantErr)
+		}
+	}
+}
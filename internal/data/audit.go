@@ -0,0 +1,168 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"slices"
+	"time"
+)
+
+// The actions recorded in the movies_audit table. A soft delete is recorded as
+// "delete", a permanent delete through the API as "hard_delete", and the removal of an
+// old soft-deleted movie by PurgeDeleted() as "purge". The audit rows aren't linked to
+// the movies table by a foreign key, so they outlive the movie.
+const (
+	AuditActionInsert		= "insert"
+	AuditActionUpdate		= "update"
+	AuditActionDelete		= "delete"
+	AuditActionRestore		= "restore"
+	AuditActionHardDelete	= "hard_delete"
+	AuditActionPurge		= "purge"
+)
+
+// The actorContextKey is the key for the ID of the user making a change, which is
+// stored in the request context and recorded in the audit trail.
+type actorContextKey struct{}
+
+// ContextWithActor returns a copy of the context holding the ID of the user who is
+// making changes, so that the MovieModel can record it in the audit trail.
+func ContextWithActor(ctx context.Context, userID int64) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, userID)
+}
+
+// The actorFromContext() helper returns the ID of the user stored in the context, or nil
+// if there isn't one (in which case the audit entry has no actor).
+func actorFromContext(ctx context.Context) *int64 {
+	userID, ok := ctx.Value(actorContextKey{}).(int64)
+	if !ok {
+		return nil
+	}
+	return &userID
+}
+
+// A FieldChange holds the old and new values of a movie field. From is nil for the
+// fields of a newly inserted movie.
+type FieldChange struct {
+	From	any	`json:"from"`
+	To		any	`json:"to"`
+}
+
+// An AuditEntry records a single change to a movie: who made it, when, the version of
+// the movie after the change, and the fields which were changed. ActorID is nil when
+// the change wasn't made by a known user.
+type AuditEntry struct {
+	ID			int64					`json:"id"`
+	MovieID		int64					`json:"movie_id"`
+	Version		int32					`json:"version"`
+	ActorID		*int64					`json:"actor_id"`
+	Action		string					`json:"action"`
+	Changes		map[string]FieldChange	`json:"changes"`
+	CreatedAt	time.Time				`json:"created_at"`
+}
+
+// The diffMovies() function returns the fields which differ between the old and new
+// versions of a movie, keyed by their JSON names. If old is nil (for a new movie) every
+// field is included, with a nil From value. A no-op update returns an empty map.
+func diffMovies(old, new *Movie) map[string]FieldChange {
+	changes := make(map[string]FieldChange)
+
+	if old == nil {
+		changes["title"] = FieldChange{To: new.Title}
+		changes["year"] = FieldChange{To: new.Year}
+		changes["runtime"] = FieldChange{To: new.Runtime}
+		changes["genres"] = FieldChange{To: new.Genres}
+		return changes
+	}
+
+	if old.Title != new.Title {
+		changes["title"] = FieldChange{From: old.Title, To: new.Title}
+	}
+	if old.Year != new.Year {
+		changes["year"] = FieldChange{From: old.Year, To: new.Year}
+	}
+	if old.Runtime != new.Runtime {
+		changes["runtime"] = FieldChange{From: old.Runtime, To: new.Runtime}
+	}
+	if !slices.Equal(old.Genres, new.Genres) {
+		changes["genres"] = FieldChange{From: old.Genres, To: new.Genres}
+	}
+
+	return changes
+}
+
+// The insertAudit() helper writes an entry to the movies_audit table within the
+// transaction that made the change, so that the entry is only recorded if the change
+// is committed. The actor is taken from the context.
+func insertAudit(ctx context.Context, tx *sql.Tx, movieID int64, version int32, action string, changes map[string]FieldChange) error {
+	if changes == nil {
+		changes = map[string]FieldChange{}
+	}
+
+	js, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO movies_audit (movie_id, version, actor_id, action, changes)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	_, err = tx.ExecContext(ctx, query, movieID, version, actorFromContext(ctx), action, js)
+	return err
+}
+
+// The History() method returns the audit entries for a movie, newest first, paginated
+// according to the page and page size in the filters.
+func (m MovieModel) History(ctx context.Context, movieID int64, filters Filters) ([]*AuditEntry, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), id, movie_id, version, actor_id, action, changes, created_at
+		FROM movies_audit
+		WHERE movie_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	rows, err := m.reader().QueryContext(ctx, query, movieID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := []*AuditEntry{}
+
+	for rows.Next() {
+		var entry AuditEntry
+		var changes []byte
+
+		err := rows.Scan(
+			&totalRecords,
+			&entry.ID,
+			&entry.MovieID,
+			&entry.Version,
+			&entry.ActorID,
+			&entry.Action,
+			&changes,
+			&entry.CreatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		err = json.Unmarshal(changes, &entry.Changes)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return entries, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
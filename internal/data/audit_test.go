@@ -0,0 +1,152 @@
+package data
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffMovies(t *testing.T) {
+	base := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}}
+
+	tests := []struct {
+		name	string
+		old		*Movie
+		new		*Movie
+		want	map[string]FieldChange
+	}{
+		{
+			name:	"new movie",
+			old:	nil,
+			new:	base,
+			want: map[string]FieldChange{
+				"title":	{To: "Moana"},
+				"year":		{To: int32(2016)},
+				"runtime":	{To: Runtime(107)},
+				"genres":	{To: []string{"animation", "adventure"}},
+			},
+		},
+		{
+			name:	"no changes",
+			old:	base,
+			new:	&Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}},
+			want:	map[string]FieldChange{},
+		},
+		{
+			name:	"title",
+			old:	base,
+			new:	&Movie{Title: "Moana 2", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}},
+			want:	map[string]FieldChange{"title": {From: "Moana", To: "Moana 2"}},
+		},
+		{
+			name:	"year and runtime",
+			old:	base,
+			new:	&Movie{Title: "Moana", Year: 2024, Runtime: 100, Genres: []string{"animation", "adventure"}},
+			want: map[string]FieldChange{
+				"year":		{From: int32(2016), To: int32(2024)},
+				"runtime":	{From: Runtime(107), To: Runtime(100)},
+			},
+		},
+		{
+			name:	"genre added",
+			old:	base,
+			new:	&Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure", "musical"}},
+			want: map[string]FieldChange{
+				"genres": {From: []string{"animation", "adventure"}, To: []string{"animation", "adventure", "musical"}},
+			},
+		},
+		{
+			name:	"genres reordered",
+			old:	base,
+			new:	&Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"adventure", "animation"}},
+			want: map[string]FieldChange{
+				"genres": {From: []string{"animation", "adventure"}, To: []string{"adventure", "animation"}},
+			},
+		},
+		{
+			name:	"every field",
+			old:	base,
+			new:	&Movie{Title: "Frozen", Year: 2013, Runtime: 102, Genres: []string{"musical"}},
+			want: map[string]FieldChange{
+				"title":	{From: "Moana", To: "Frozen"},
+				"year":		{From: int32(2016), To: int32(2013)},
+				"runtime":	{From: Runtime(107), To: Runtime(102)},
+				"genres":	{From: []string{"animation", "adventure"}, To: []string{"musical"}},
+			},
+		},
+		{
+			name:	"fields which aren't audited",
+			old:	base,
+			new:	&Movie{ID: 9, Version: 4, UpdatedAt: time.Now(), Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}},
+			want:	map[string]FieldChange{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffMovies(tt.old, tt.new)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v; want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The auditActions() helper returns the actions in a movie's history, oldest first.
+func auditActions(t *testing.T, models Models, movieID int64) []string {
+	t.Helper()
+
+	entries, _, err := models.Movies.History(context.Background(), movieID, Filters{Page: 1, PageSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := make([]string, len(entries))
+	for i, entry := range entries {
+		actions[len(entries)-1-i] = entry.Action
+	}
+	return actions
+}
+
+func TestAuditTrailOutlivesMovie(t *testing.T) {
+	models := NewMockModels()
+	ctx := context.Background()
+
+	for _, title := range []string{"Moana", "Frozen"} {
+		err := models.Movies.Insert(ctx, &Movie{Title: title, Year: 2016, Runtime: 100, Genres: []string{"animation"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Movie 1 is hard-deleted straight away, while movie 2 is soft-deleted and then
+	// purged.
+	err := models.Movies.HardDelete(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = models.Movies.Delete(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := models.Movies.PurgeDeleted(ctx, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Fatalf("got %d movies purged; want 1", purged)
+	}
+
+	want := map[int64][]string{
+		1:	{AuditActionInsert, AuditActionHardDelete},
+		2:	{AuditActionInsert, AuditActionDelete, AuditActionPurge},
+	}
+	for id, actions := range want {
+		if got := auditActions(t, models, id); !reflect.DeepEqual(got, actions) {
+			t.Errorf("got actions %q for movie %d; want %q", got, id, actions)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+)
+
+// The errors which a ConstraintError can wrap, one for each class of constraint
+// violation reported by PostgreSQL.
+var (
+	ErrDuplicateRecord		= errors.New("duplicate record")
+	ErrInvalidReference		= errors.New("invalid reference")
+	ErrConstraintViolation	= errors.New("constraint violation")
+	ErrValueTooLong			= errors.New("value too long")
+)
+
+// A ConstraintError is returned when a write is rejected by a database constraint. Err
+// is one of the errors above (so callers can check the class with errors.Is()),
+// Constraint is the name of the constraint, and Field is the name of the JSON field
+// which the constraint applies to, or the empty string if it isn't known.
+type ConstraintError struct {
+	Err			error
+	Constraint	string
+	Field		string
+}
+
+func (e *ConstraintError) Error() string {
+	if e.Constraint == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s (%s)", e.Err, e.Constraint)
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return e.Err
+}
+
+// The constraintFields map holds the JSON field name for each of the constraints in
+// our migrations which a client's input can violate. Remember to add any new
+// constraints here.
+var constraintFields = map[string]string{
+	"movies_runtime_check":			"runtime",
+	"movies_year_check":			"year",
+	"movies_title_year_idx":		"title",
+	"genres_name_key":				"genres",
+	"movies_genres_pkey":			"genres",
+	"movies_genres_movie_id_fkey":	"id",
+	"movies_genres_count_check":	"genres",
+}
+
+// The minGenres and maxGenres constants are the limits on the number of genres which a
+// movie can have. Besides ValidateMovie(), they're enforced by the deferred
+// movies_genres_count_check constraint trigger from migration 000007.
+const (
+	minGenres	= 1
+	maxGenres	= 5
+)
+
+// The errGenreCount error is returned by AddGenre() and RemoveGenre() when the change
+// would take a movie outside the genre limits. It's the same error that the constraint
+// trigger would cause when the transaction commits.
+var errGenreCount = &ConstraintError{
+	Err:		ErrConstraintViolation,
+	Constraint:	"movies_genres_count_check",
+	Field:		"genres",
+}
+
+// The pqErrorClasses map holds the error for each of the PostgreSQL error codes which we
+// convert into a ConstraintError.
+var pqErrorClasses = map[pq.ErrorCode]error{
+	"23505":	ErrDuplicateRecord,		// unique_violation
+	"23503":	ErrInvalidReference,	// foreign_key_violation
+	"23514":	ErrConstraintViolation,	// check_violation
+	"22001":	ErrValueTooLong,		// string_data_right_truncation
+}
+
+// The constraintError() helper converts an error returned by PostgreSQL for a
+// constraint violation into a ConstraintError. Any other error is returned unchanged.
+func constraintError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+
+	class, ok := pqErrorClasses[pqErr.Code]
+	if !ok {
+		return err
+	}
+
+	field := constraintFields[pqErr.Constraint]
+	if field == "" {
+		field = pqErr.Column
+	}
+
+	return &ConstraintError{
+		Err:		class,
+		Constraint:	pqErr.Constraint,
+		Field:		field,
+	}
+}
@@ -0,0 +1,107 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"github.com/lib/pq"
+)
+
+func TestConstraintError(t *testing.T) {
+	tests := []struct {
+		name			string
+		err				*pq.Error
+		wantClass		error
+		wantConstraint	string
+		wantField		string
+	}{
+		{
+			name:			"unique violation",
+			err:			&pq.Error{Code: "23505", Constraint: "movies_title_year_idx"},
+			wantClass:		ErrDuplicateRecord,
+			wantConstraint:	"movies_title_year_idx",
+			wantField:		"title",
+		},
+		{
+			name:			"foreign key violation",
+			err:			&pq.Error{Code: "23503", Constraint: "movies_genres_movie_id_fkey"},
+			wantClass:		ErrInvalidReference,
+			wantConstraint:	"movies_genres_movie_id_fkey",
+			wantField:		"id",
+		},
+		{
+			name:			"check violation",
+			err:			&pq.Error{Code: "23514", Constraint: "movies_runtime_check"},
+			wantClass:		ErrConstraintViolation,
+			wantConstraint:	"movies_runtime_check",
+			wantField:		"runtime",
+		},
+		{
+			name:			"genre count trigger",
+			err:			&pq.Error{Code: "23514", Constraint: "movies_genres_count_check"},
+			wantClass:		ErrConstraintViolation,
+			wantConstraint:	"movies_genres_count_check",
+			wantField:		"genres",
+		},
+		{
+			name:		"value too long",
+			err:		&pq.Error{Code: "22001", Column: "title"},
+			wantClass:	ErrValueTooLong,
+			wantField:	"title",
+		},
+		{
+			name:			"unknown constraint",
+			err:			&pq.Error{Code: "23514", Constraint: "movies_other_check"},
+			wantClass:		ErrConstraintViolation,
+			wantConstraint:	"movies_other_check",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The pq errors are usually wrapped by the time they reach us.
+			err := constraintError(fmt.Errorf("insert movie: %w", tt.err))
+
+			var constraintErr *ConstraintError
+			if !errors.As(err, &constraintErr) {
+				t.Fatalf("got %T; want *ConstraintError", err)
+			}
+			if !errors.Is(err, tt.wantClass) {
+				t.Errorf("got class %v; want %v", constraintErr.Err, tt.wantClass)
+			}
+			if constraintErr.Constraint != tt.wantConstraint {
+				t.Errorf("got constraint %q; want %q", constraintErr.Constraint, tt.wantConstraint)
+			}
+			if constraintErr.Field != tt.wantField {
+				t.Errorf("got field %q; want %q", constraintErr.Field, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestConstraintErrorUnchanged(t *testing.T) {
+	tests := []error{
+		sql.ErrNoRows,
+		&pq.Error{Code: "42P01"},
+		nil,
+	}
+
+	for _, err := range tests {
+		if got := constraintError(err); got != err {
+			t.Errorf("constraintError(%v) = %v; want it unchanged", err, got)
+		}
+	}
+}
+
+func TestConstraintErrorMessage(t *testing.T) {
+	err := &ConstraintError{Err: ErrDuplicateRecord, Constraint: "movies_title_year_idx"}
+	if got, want := err.Error(), "duplicate record (movies_title_year_idx)"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	err = &ConstraintError{Err: ErrValueTooLong}
+	if got, want := err.Error(), "value too long"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
@@ -1,56 +1,177 @@
 package data
 
 import (
+	"fmt"
 	"greenlight.nursultandias.net/internal/validator"
+	"slices"
 	"strings"
 	"math"
 )
 
 // Add a SortSafelist field to hold the supported sort values.
+// When UseCursor is true, cursor-based pagination is used instead of page numbers:
+// only records with an ID greater than Cursor (the last ID the client has seen) are
+// returned, which stays fast on large tables and doesn't skip or duplicate rows when
+// the data changes between requests.
+// MaxPageSize is the largest PageSize which is accepted. If it's zero, the
+// DefaultMaxPageSize is used.
 type Filters struct {
 	Page			int
 	PageSize		int
 	Sort			string
 	SortSafelist	[]string
+	Cursor			int64
+	UseCursor		bool
+	MaxPageSize		int
 }
 
+// The DefaultMaxPageSize is the largest page size which is accepted when a Filters
+// struct doesn't set its own MaxPageSize. The MaxPage is the largest page number which
+// is accepted.
+const (
+	DefaultMaxPageSize	= 100
+	MaxPage				= 10_000_000
+)
+
+// The Metadata struct holds the pagination metadata. TotalRecords is a pointer so that
+// a total of zero is still included in the response, while it's left out altogether in
+// cursor mode (where the total isn't known). Sort holds the sort order which was
+// applied, in its normalized form (see appliedSort()).
 type Metadata struct {
-	CurrentPage		int	`json:"current_page,omitempty"`
-	PageSize		int	`json:"page_size,omitempty"`
-	FirstPage		int	`json:"first_page,omitempty"`
-	LastPage		int	`json:"last_page,omitempty"`
-	TotalRecords	int	`json:"total_records,omitempty"`
+	CurrentPage		int		`json:"current_page,omitempty"`
+	PageSize		int		`json:"page_size,omitempty"`
+	FirstPage		int		`json:"first_page,omitempty"`
+	LastPage		int		`json:"last_page,omitempty"`
+	TotalRecords	*int	`json:"total_records,omitempty"`
+	NextCursor		int64	`json:"next_cursor,omitempty"`
+	Sort			string	`json:"sort,omitempty"`
 }
 
 func ValidateFilters(v *validator.Validator, f Filters) {
 	// Check that the page and page_size parameters contain sensible values.
-	v.Check(f.Page > 0, "page", "must be greater than zero")
-	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
-	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
-	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
+	v.Check(validator.Min(f.Page, 1), "page", "must be greater than zero")
+	v.Check(validator.Max(f.Page, MaxPage), "page", "must be a maximum of 10 million")
+	v.Check(validator.Min(f.PageSize, 1), "page_size", "must be greater than zero")
+	v.Check(validator.Max(f.PageSize, f.maxPageSize()), "page_size", fmt.Sprintf("must be a maximum of %d", f.maxPageSize()))
 
-	// Check that the sort parameter matches a value in the safelist.
-	v.Check(validator.In(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+	// Check that each of the comma-separated sort fields matches a value in the
+	// safelist, naming the first one which doesn't. Each column can only be sorted on
+	// once, so "year,year" and contradictory fields such as "year,-year" are rejected.
+	seen := make(map[string]bool)
+
+	for _, field := range f.sortFields() {
+		if !validator.In(field, f.SortSafelist...) {
+			v.AddError("sort", fmt.Sprintf("invalid sort value %q", field))
+			break
+		}
+
+		column := strings.TrimPrefix(field, "-")
+		if seen[column] {
+			v.AddError("sort", fmt.Sprintf("must not sort on %q more than once", column))
+			break
+		}
+		seen[column] = true
+	}
+
+	// Cursor pagination relies on the results being ordered by ascending ID.
+	if f.UseCursor {
+		v.Check(validator.Min(f.Cursor, 0), "cursor", "must not be negative")
+		v.Check(slices.Equal(f.sortFields(), []string{"id"}), "sort", "must be id when using cursor pagination")
+	}
+}
+
+// The maxPageSize() method returns the largest page size which is accepted.
+func (f Filters) maxPageSize() int {
+	if f.MaxPageSize <= 0 {
+		return DefaultMaxPageSize
+	}
+	return f.MaxPageSize
 }
 
-// Check that the client-provided Sort field matches one of the entries in our safelist
-// and if it does, extract the column name from the Sort field by stripping the leading
-// hyphen character (if one exists).
-func (f Filters) sortColumn() string {
-	for _, safeValue := range f.SortSafelist {
-		if f.Sort == safeValue {
-			return strings.TrimPrefix(f.Sort, "-")
+// The sortFields() method splits the client-provided Sort value into its
+// comma-separated fields, such as "-year" and "title" for "-year, title". Whitespace
+// around each field is ignored.
+func (f Filters) sortFields() []string {
+	fields := strings.Split(f.Sort, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return fields
+}
+
+// The sortKey type holds a column to sort on and the direction of the sort.
+type sortKey struct {
+	column		string
+	descending	bool
+}
+
+// Check that each of the client-provided sort fields matches one of the entries in our
+// safelist and if it does, extract the column name by stripping the leading hyphen
+// character (if one exists), which indicates a descending sort.
+func (f Filters) sortKeys() []sortKey {
+	keys := []sortKey{}
+
+	for _, field := range f.sortFields() {
+		if !validator.In(field, f.SortSafelist...) {
+			panic("unsafe sort parameter: " + field)
 		}
+
+		keys = append(keys, sortKey{
+			column:		strings.TrimPrefix(field, "-"),
+			descending:	strings.HasPrefix(field, "-"),
+		})
 	}
-	panic("unsafe sort parameter: " + f.Sort)
+
+	return keys
 }
 
-// Return the sort direction ("ASC" or "DESC") depending on the prefix character of the sort field.
-func (f Filters) sortDirection() string {
-	if strings.HasPrefix(f.Sort, "-") {
-		return "DESC"
+// The appliedSortKeys() method returns the sort keys followed, unless the client is
+// already sorting on the ID, by a final ascending sort on the ID. The ID is unique, so
+// this tiebreaker makes the ordering stable, which keeps pagination deterministic.
+func (f Filters) appliedSortKeys() []sortKey {
+	keys := f.sortKeys()
+
+	hasID := slices.ContainsFunc(keys, func(key sortKey) bool { return key.column == "id" })
+	if !hasID {
+		keys = append(keys, sortKey{column: "id"})
 	}
-	return "ASC"
+
+	return keys
+}
+
+// The orderBy() method returns the contents of the ORDER BY clause for the sort fields,
+// such as "year DESC, title ASC, id ASC".
+func (f Filters) orderBy() string {
+	clauses := []string{}
+
+	for _, key := range f.appliedSortKeys() {
+		direction := "ASC"
+		if key.descending {
+			direction = "DESC"
+		}
+
+		clauses = append(clauses, key.column+" "+direction)
+	}
+
+	return strings.Join(clauses, ", ")
+}
+
+// The appliedSort() method returns the sort order used by orderBy() in the same format
+// as the sort query string parameter, such as "-year,title,id" for a sort value of
+// "-year, title". It's sent back to the client in the metadata.
+func (f Filters) appliedSort() string {
+	fields := []string{}
+
+	for _, key := range f.appliedSortKeys() {
+		field := key.column
+		if key.descending {
+			field = "-" + field
+		}
+
+		fields = append(fields, field)
+	}
+
+	return strings.Join(fields, ",")
 }
 
 func (f Filters) limit() int {
@@ -58,9 +179,22 @@ func (f Filters) limit() int {
 }
 
 func (f Filters) offset() int {
+	// In cursor mode the cursor takes the place of the offset.
+	if f.UseCursor {
+		return 0
+	}
 	return (f.Page - 1) * f.PageSize
 }
 
+// Return the ID that records must be greater than. Outside of cursor mode this is zero,
+// which matches every record because IDs start at 1.
+func (f Filters) cursor() int64 {
+	if f.UseCursor {
+		return f.Cursor
+	}
+	return 0
+}
+
 // The calculateMetadata() function calculates the appropriate pagination metadata
 // values given the total number of records, current page, and page size values. Note
 // that the last page value is calculated using the math.Ceil() function, which rounds
@@ -68,8 +202,13 @@ func (f Filters) offset() int {
 // and a page size of 5, the last page value would be math.Ceil(12/5) = 3.
 func calculateMetadata(totalRecords, page, pageSize int) Metadata {
 	if totalRecords == 0 {
-		// return empty Metadata struct if there are no records
-		return Metadata{}
+		// If there are no records, still return the requested page and page size along
+		// with a total of zero, so that clients can render their pagination controls.
+		return Metadata{
+			CurrentPage: page,
+			PageSize: pageSize,
+			TotalRecords: &totalRecords,
+		}
 	}
 
 	return Metadata {
@@ -77,6 +216,22 @@ func calculateMetadata(totalRecords, page, pageSize int) Metadata {
 		PageSize: pageSize,
 		FirstPage: 1,
 		LastPage: int(math.Ceil(float64(totalRecords)/float64(pageSize))),
-		TotalRecords: totalRecords,
+		TotalRecords: &totalRecords,
+	}
+}
+
+// The calculateCursorMetadata() function calculates the pagination metadata for cursor
+// mode. The remainingRecords value is the number of records after the cursor, so if it
+// is larger than the page size there is at least one more page and we return the ID of
+// the last record as the next cursor.
+func calculateCursorMetadata(remainingRecords, pageSize int, lastID int64) Metadata {
+	metadata := Metadata{
+		PageSize: pageSize,
+	}
+
+	if remainingRecords > pageSize {
+		metadata.NextCursor = lastID
 	}
-}
\ No newline at end of file
+
+	return metadata
+}
@@ -0,0 +1,116 @@
+package data
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCalculateMetadata(t *testing.T) {
+	tests := []struct {
+		name			string
+		totalRecords	int
+		page			int
+		pageSize		int
+		want			Metadata
+	}{
+		{
+			name:			"no records",
+			totalRecords:	0,
+			page:			1,
+			pageSize:		20,
+			want:			Metadata{CurrentPage: 1, PageSize: 20},
+		},
+		{
+			name:			"no records past the first page",
+			totalRecords:	0,
+			page:			99,
+			pageSize:		20,
+			want:			Metadata{CurrentPage: 99, PageSize: 20},
+		},
+		{
+			name:			"exact pages",
+			totalRecords:	40,
+			page:			2,
+			pageSize:		20,
+			want:			Metadata{CurrentPage: 2, PageSize: 20, FirstPage: 1, LastPage: 2},
+		},
+		{
+			name:			"partial last page",
+			totalRecords:	41,
+			page:			1,
+			pageSize:		20,
+			want:			Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 3},
+		},
+		{
+			name:			"past the last page",
+			totalRecords:	5,
+			page:			99,
+			pageSize:		20,
+			want:			Metadata{CurrentPage: 99, PageSize: 20, FirstPage: 1, LastPage: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := calculateMetadata(tt.totalRecords, tt.page, tt.pageSize)
+
+			if got.TotalRecords == nil || *got.TotalRecords != tt.totalRecords {
+				t.Fatalf("got total_records %v; want %d", got.TotalRecords, tt.totalRecords)
+			}
+
+			got.TotalRecords = nil
+			if got != tt.want {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetAllEmptyPageMetadata(t *testing.T) {
+	models := NewMockModels()
+	ctx := context.Background()
+
+	for _, title := range []string{"Moana", "Black Panther", "Deadpool"} {
+		err := models.Movies.Insert(ctx, &Movie{Title: title, Year: 2016, Runtime: 100, Genres: []string{"action"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name		string
+		title		string
+		page		int
+		wantTotal	int
+		wantLast	int
+	}{
+		{name: "no matches", title: "Frozen", page: 1, wantTotal: 0, wantLast: 0},
+		{name: "page past the end", page: 99, wantTotal: 3, wantLast: 2},
+		{name: "filtered page past the end", title: "Moana", page: 2, wantTotal: 1, wantLast: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filters := Filters{Page: tt.page, PageSize: 2, Sort: "id", SortSafelist: []string{"id"}}
+
+			movies, metadata, err := models.Movies.GetAll(ctx, tt.title, []string{}, "all", 0, 0, time.Time{}, nil, false, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(movies) != 0 {
+				t.Errorf("got %d movies; want none", len(movies))
+			}
+			if metadata.TotalRecords == nil || *metadata.TotalRecords != tt.wantTotal {
+				t.Errorf("got total_records %v; want %d", metadata.TotalRecords, tt.wantTotal)
+			}
+			if metadata.LastPage != tt.wantLast {
+				t.Errorf("got last_page %d; want %d", metadata.LastPage, tt.wantLast)
+			}
+			if metadata.CurrentPage != tt.page {
+				t.Errorf("got current_page %d; want %d", metadata.CurrentPage, tt.page)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// The IdempotencyKeyTTL is how long a stored response is kept for. After it expires
+// the key can be used again for a new request.
+const IdempotencyKeyTTL = 24 * time.Hour
+
+var (
+	// ErrIdempotencyKeyMismatch is returned when an idempotency key is reused with a
+	// different request body.
+	ErrIdempotencyKeyMismatch = errors.New("idempotency key reused with a different request")
+
+	// ErrIdempotencyKeyInProgress is returned when the first request with an
+	// idempotency key is still being processed.
+	ErrIdempotencyKeyInProgress = errors.New("idempotency key in progress")
+)
+
+// An IdempotencyRecord holds the response which was sent for a request with a given
+// idempotency key, along with a hash of the request body.
+type IdempotencyRecord struct {
+	Key			string
+	RequestHash	string
+	Status		int
+	Headers		map[string][]string
+	Body		[]byte
+}
+
+// The IdempotencyKeyModelInterface describes the methods for storing and replaying the
+// responses to requests with an idempotency key.
+type IdempotencyKeyModelInterface interface {
+	Reserve(ctx context.Context, key, requestHash string) (*IdempotencyRecord, error)
+	Complete(ctx context.Context, record *IdempotencyRecord) error
+	Release(ctx context.Context, key string) error
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+// Define an IdempotencyKeyModel struct type which wraps a sql.DB connection pool.
+type IdempotencyKeyModel struct {
+	DB		*sql.DB
+	Timeout	time.Duration
+}
+
+// The timeout() method returns the timeout to use for database operations.
+func (m IdempotencyKeyModel) timeout() time.Duration {
+	if m.Timeout <= 0 {
+		return DefaultQueryTimeout
+	}
+	return m.Timeout
+}
+
+// The Reserve() method claims an idempotency key for a new request. It returns a nil
+// record if the key was claimed (because it's new, or the previous use has expired), in
+// which case the caller should process the request and then call Complete() or
+// Release(). If the key has already been used for the same request body, the stored
+// record is returned so that its response can be replayed. Otherwise an
+// ErrIdempotencyKeyMismatch or ErrIdempotencyKeyInProgress error is returned.
+//
+// The key is the table's primary key, so if two requests with the same key arrive at
+// once, only one of the inserts can succeed and the other sees the in-progress record.
+func (m IdempotencyKeyModel) Reserve(ctx context.Context, key, requestHash string) (*IdempotencyRecord, error) {
+	query := `
+		INSERT INTO idempotency_keys (key, request_hash, expires_at)
+		VALUES ($1, $2, NOW() + make_interval(secs => $3))
+		ON CONFLICT (key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, status = NULL, headers = NULL, body = NULL,
+			expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at < NOW()
+		RETURNING key`
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, key, requestHash, IdempotencyKeyTTL.Seconds()).Scan(&key)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	// The key is already in use, so fetch the existing record.
+	query = `
+		SELECT request_hash, status, headers, body
+		FROM idempotency_keys
+		WHERE key = $1`
+
+	record := IdempotencyRecord{Key: key}
+	var status sql.NullInt64
+	var headers []byte
+
+	err = m.DB.QueryRowContext(ctx, query, key).Scan(&record.RequestHash, &status, &headers, &record.Body)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// The first request failed and released the key in the meantime.
+			return nil, ErrIdempotencyKeyInProgress
+		default:
+			return nil, err
+		}
+	}
+
+	switch {
+	case record.RequestHash != requestHash:
+		return nil, ErrIdempotencyKeyMismatch
+	case !status.Valid:
+		return nil, ErrIdempotencyKeyInProgress
+	}
+
+	record.Status = int(status.Int64)
+
+	err = json.Unmarshal(headers, &record.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// The Complete() method stores the response for a reserved idempotency key.
+func (m IdempotencyKeyModel) Complete(ctx context.Context, record *IdempotencyRecord) error {
+	headers, err := json.Marshal(record.Headers)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE idempotency_keys
+		SET status = $2, headers = $3, body = $4
+		WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, record.Key, record.Status, headers, record.Body)
+	return err
+}
+
+// The Release() method deletes a reserved idempotency key without storing a response,
+// so that the request can be retried with the same key.
+func (m IdempotencyKeyModel) Release(ctx context.Context, key string) error {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key)
+	return err
+}
+
+// The DeleteExpired() method deletes the idempotency keys which have expired, and
+// returns the number of keys deleted.
+func (m IdempotencyKeyModel) DeleteExpired(ctx context.Context) (int64, error) {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE expires_at < NOW()`
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,678 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewMockModels returns a Models struct backed by in-memory implementations instead of
+// PostgreSQL. It's intended for testing handlers without a database.
+func NewMockModels() Models {
+	return Models{
+		Movies: &MockMovieModel{
+			movies:	make(map[int64]*Movie),
+			deleted:	make(map[int64]bool),
+			deletedAt:	make(map[int64]time.Time),
+		},
+		IdempotencyKeys: &MockIdempotencyKeyModel{
+			records:	make(map[string]*IdempotencyRecord),
+			expires:	make(map[string]time.Time),
+		},
+		Webhooks: &MockWebhookModel{
+			webhooks:	make(map[int64]*Webhook),
+		},
+	}
+}
+
+// MockMovieModel is an in-memory implementation of MovieModelInterface. It follows the
+// same rules as MovieModel: IDs start at 1, versions are incremented on every update,
+// ErrEditConflict is returned for stale versions, and ErrRecordNotFound is returned for
+// missing (or soft-deleted) movies. The mutex makes it safe for concurrent use.
+type MockMovieModel struct {
+	mu		sync.Mutex
+	nextID	int64
+	movies	map[int64]*Movie
+	deleted	map[int64]bool
+	deletedAt	map[int64]time.Time
+	audit		[]*AuditEntry
+}
+
+// The duplicateOf() helper returns the ID of a non-deleted movie (other than the one
+// with excludeID) with the same title (ignoring case) and year, or zero if there isn't
+// one. This mirrors the movies_title_year_idx unique index.
+func (m *MockMovieModel) duplicateOf(title string, year int32, excludeID int64) int64 {
+	for id, movie := range m.movies {
+		if id != excludeID && !m.deleted[id] && movie.Year == year && strings.EqualFold(movie.Title, title) {
+			return id
+		}
+	}
+	return 0
+}
+
+// The copyMovie() helper returns a deep copy of a movie, so that callers can't modify
+// the stored data through the pointers we return (and vice versa).
+func copyMovie(movie *Movie) *Movie {
+	c := *movie
+	if movie.Genres != nil {
+		c.Genres = append([]string(nil), movie.Genres...)
+	}
+	return &c
+}
+
+// The recordAudit() helper appends an entry to the audit trail, like insertAudit() does
+// for the movies_audit table.
+func (m *MockMovieModel) recordAudit(ctx context.Context, movieID int64, version int32, action string, changes map[string]FieldChange) {
+	if changes == nil {
+		changes = map[string]FieldChange{}
+	}
+
+	m.audit = append(m.audit, &AuditEntry{
+		ID:			int64(len(m.audit) + 1),
+		MovieID:	movieID,
+		Version:	version,
+		ActorID:	actorFromContext(ctx),
+		Action:		action,
+		Changes:	changes,
+		CreatedAt:	time.Now().UTC().Truncate(time.Second),
+	})
+}
+
+func (m *MockMovieModel) insert(ctx context.Context, movie *Movie) {
+	m.nextID++
+
+	now := time.Now().UTC().Truncate(time.Second)
+	movie.ID = m.nextID
+	movie.CreatedAt = now
+	movie.UpdatedAt = now
+	movie.Version = 1
+
+	m.movies[movie.ID] = copyMovie(movie)
+	m.recordAudit(ctx, movie.ID, movie.Version, AuditActionInsert, diffMovies(nil, movie))
+}
+
+func (m *MockMovieModel) Insert(ctx context.Context, movie *Movie) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.duplicateOf(movie.Title, movie.Year, 0) != 0 {
+		return ErrDuplicateMovie
+	}
+
+	m.insert(ctx, movie)
+	return nil
+}
+
+func (m *MockMovieModel) InsertBatch(ctx context.Context, movies []*Movie) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Check the whole batch for duplicates (against both the stored movies and the
+	// other movies in the batch) before inserting anything, so the batch is
+	// all-or-nothing like the SQL transaction.
+	seen := make(map[string]bool)
+	for _, movie := range movies {
+		key := fmt.Sprintf("%s|%d", strings.ToLower(movie.Title), movie.Year)
+		if seen[key] || m.duplicateOf(movie.Title, movie.Year, 0) != 0 {
+			return ErrDuplicateMovie
+		}
+		seen[key] = true
+	}
+
+	for _, movie := range movies {
+		m.insert(ctx, movie)
+	}
+	return nil
+}
+
+func (m *MockMovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	movie, ok := m.movies[id]
+	if !ok || m.deleted[id] {
+		return nil, ErrRecordNotFound
+	}
+
+	return copyMovie(movie), nil
+}
+
+func (m *MockMovieModel) Update(ctx context.Context, movie *Movie) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Like the SQL query, only update the movie if it exists, hasn't been deleted and
+	// still has the version that the caller read.
+	stored, ok := m.movies[movie.ID]
+	if !ok || m.deleted[movie.ID] || stored.Version != movie.Version {
+		return ErrEditConflict
+	}
+
+	if m.duplicateOf(movie.Title, movie.Year, movie.ID) != 0 {
+		return ErrDuplicateMovie
+	}
+
+	movie.Version++
+	movie.UpdatedAt = time.Now().UTC().Truncate(time.Second)
+	movie.CreatedAt = stored.CreatedAt
+
+	m.movies[movie.ID] = copyMovie(movie)
+	m.recordAudit(ctx, movie.ID, movie.Version, AuditActionUpdate, diffMovies(stored, movie))
+	return nil
+}
+
+func (m *MockMovieModel) AddGenre(ctx context.Context, movie *Movie, genre string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.movies[movie.ID]
+	if !ok || m.deleted[movie.ID] || stored.Version != movie.Version {
+		return ErrEditConflict
+	}
+
+	if slices.Contains(stored.Genres, genre) {
+		movie.Genres = append([]string(nil), stored.Genres...)
+		return nil
+	}
+
+	if len(stored.Genres) >= maxGenres {
+		return errGenreCount
+	}
+
+	m.updateGenres(ctx, stored, movie, append(append([]string(nil), stored.Genres...), genre))
+	return nil
+}
+
+func (m *MockMovieModel) RemoveGenre(ctx context.Context, movie *Movie, genre string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.movies[movie.ID]
+	if !ok || m.deleted[movie.ID] || stored.Version != movie.Version {
+		return ErrEditConflict
+	}
+
+	if !slices.Contains(stored.Genres, genre) {
+		return ErrRecordNotFound
+	}
+
+	if len(stored.Genres) <= minGenres {
+		return errGenreCount
+	}
+
+	genres := slices.DeleteFunc(append([]string(nil), stored.Genres...), func(g string) bool { return g == genre })
+	m.updateGenres(ctx, stored, movie, genres)
+	return nil
+}
+
+// The updateGenres() helper stores a new list of genres for AddGenre() and
+// RemoveGenre(), incrementing the version like the SQL implementation does.
+func (m *MockMovieModel) updateGenres(ctx context.Context, stored, movie *Movie, genres []string) {
+	updated := copyMovie(stored)
+	updated.Genres = genres
+	updated.Version++
+	updated.UpdatedAt = time.Now().UTC().Truncate(time.Second)
+
+	m.movies[movie.ID] = updated
+	m.recordAudit(ctx, movie.ID, updated.Version, AuditActionUpdate, diffMovies(stored, updated))
+
+	movie.Genres = append([]string(nil), genres...)
+	movie.Version = updated.Version
+	movie.UpdatedAt = updated.UpdatedAt
+}
+
+func (m *MockMovieModel) Delete(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.movies[id]; !ok || m.deleted[id] {
+		return ErrRecordNotFound
+	}
+
+	m.deleted[id] = true
+	m.deletedAt[id] = time.Now()
+	m.recordAudit(ctx, id, m.movies[id].Version, AuditActionDelete, nil)
+	return nil
+}
+
+func (m *MockMovieModel) HardDelete(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.movies[id]; !ok {
+		return ErrRecordNotFound
+	}
+
+	m.recordAudit(ctx, id, m.movies[id].Version, AuditActionHardDelete, nil)
+	delete(m.movies, id)
+	delete(m.deleted, id)
+	delete(m.deletedAt, id)
+	return nil
+}
+
+func (m *MockMovieModel) Restore(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.deleted[id] {
+		return ErrRecordNotFound
+	}
+
+	if m.duplicateOf(m.movies[id].Title, m.movies[id].Year, id) != 0 {
+		return ErrDuplicateMovie
+	}
+
+	delete(m.deleted, id)
+	delete(m.deletedAt, id)
+	m.recordAudit(ctx, id, m.movies[id].Version, AuditActionRestore, nil)
+	return nil
+}
+
+func (m *MockMovieModel) History(ctx context.Context, movieID int64, filters Filters) ([]*AuditEntry, Metadata, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	matched := []*AuditEntry{}
+	for i := len(m.audit) - 1; i >= 0; i-- {
+		if m.audit[i].MovieID == movieID {
+			entry := *m.audit[i]
+			matched = append(matched, &entry)
+		}
+	}
+
+	totalRecords := len(matched)
+	start := min(filters.offset(), totalRecords)
+	end := min(start+filters.limit(), totalRecords)
+
+	return matched[start:end], calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+func (m *MockMovieModel) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var purged int64
+	for id, deletedAt := range m.deletedAt {
+		if deletedAt.Before(before) {
+			// The purge is run by a background job, so there's never an actor.
+			m.recordAudit(context.Background(), id, m.movies[id].Version, AuditActionPurge, nil)
+			delete(m.movies, id)
+			delete(m.deleted, id)
+			delete(m.deletedAt, id)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// The GetAll() method applies the same filters, sorting and pagination as the SQL query
+// in MovieModel.GetAll(). The title filter is approximated by requiring every word in
+// the search to appear as a word in the title (ignoring case).
+func (m *MockMovieModel) GetAll(ctx context.Context, title string, genres []string, genresMatch string, yearFrom, yearTo int, modifiedSince time.Time, ids []int64, includeDeleted bool, filters Filters) ([]*Movie, Metadata, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Call sortKeys() first, so that an unsafe sort value panics just like it would
+	// for the SQL implementation.
+	keys := filters.sortKeys()
+
+	matched := []*Movie{}
+
+	for id, movie := range m.movies {
+		if !m.listMatches(movie, title, genres, genresMatch, yearFrom, yearTo, filters.cursor(), modifiedSince, ids, includeDeleted) {
+			continue
+		}
+
+		matched = append(matched, copyMovie(movie))
+		if m.deleted[id] {
+			deletedAt := m.deletedAt[id]
+			matched[len(matched)-1].DeletedAt = &deletedAt
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+
+		// If a list of IDs was given, keep the movies in the same order as the IDs.
+		if len(ids) > 0 {
+			posA, posB := slices.Index(ids, a.ID), slices.Index(ids, b.ID)
+			if posA != posB {
+				return posA < posB
+			}
+		}
+
+		// Compare on each sort key in turn, moving on to the next key when the values
+		// are equal.
+		for _, key := range keys {
+			var cmp int
+			switch key.column {
+			case "id":
+				cmp = int(a.ID - b.ID)
+			case "title":
+				cmp = strings.Compare(a.Title, b.Title)
+			case "year":
+				cmp = int(a.Year) - int(b.Year)
+			case "runtime":
+				cmp = int(a.Runtime) - int(b.Runtime)
+			}
+
+			if cmp != 0 {
+				if key.descending {
+					return cmp > 0
+				}
+				return cmp < 0
+			}
+		}
+
+		// Fall back to an ascending sort on the ID, like orderBy() does.
+		return a.ID < b.ID
+	})
+
+	totalRecords := len(matched)
+
+	start := filters.offset()
+	if start > len(matched) {
+		start = len(matched)
+	}
+	end := start + filters.limit()
+	if end > len(matched) {
+		end = len(matched)
+	}
+	movies := matched[start:end]
+
+	if filters.UseCursor {
+		var lastID int64
+		if len(movies) > 0 {
+			lastID = movies[len(movies)-1].ID
+		}
+		metadata := calculateCursorMetadata(totalRecords, filters.PageSize, lastID)
+		metadata.Sort = filters.appliedSort()
+		return movies, metadata, nil
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	metadata.Sort = filters.appliedSort()
+	return movies, metadata, nil
+}
+
+// The listMatches() helper reports whether a movie passes the list filters, like
+// movieListConditions() does for the SQL implementation.
+func (m *MockMovieModel) listMatches(movie *Movie, title string, genres []string, genresMatch string, yearFrom, yearTo int, cursor int64, modifiedSince time.Time, ids []int64, includeDeleted bool) bool {
+	switch {
+	case m.deleted[movie.ID] && !includeDeleted:
+		return false
+	case !titleMatches(movie.Title, title):
+		return false
+	case !genresMatchFilter(movie.Genres, genres, genresMatch):
+		return false
+	case yearFrom != 0 && int(movie.Year) < yearFrom:
+		return false
+	case yearTo != 0 && int(movie.Year) > yearTo:
+		return false
+	case movie.ID <= cursor:
+		return false
+	case !modifiedSince.IsZero() && movie.UpdatedAt.Before(modifiedSince):
+		return false
+	case len(ids) > 0 && !slices.Contains(ids, movie.ID):
+		return false
+	}
+
+	return true
+}
+
+// The Count() method applies the same filters as GetAll().
+func (m *MockMovieModel) Count(ctx context.Context, title string, genres []string, genresMatch string, yearFrom, yearTo int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := 0
+
+	for _, movie := range m.movies {
+		if m.listMatches(movie, title, genres, genresMatch, yearFrom, yearTo, 0, time.Time{}, nil, false) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (m *MockMovieModel) AllGenres(ctx context.Context) ([]*Genre, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := make(map[string]int)
+
+	for id, movie := range m.movies {
+		if m.deleted[id] {
+			continue
+		}
+		for _, genre := range movie.Genres {
+			counts[genre]++
+		}
+	}
+
+	genres := make([]*Genre, 0, len(counts))
+	for name, count := range counts {
+		genres = append(genres, &Genre{Name: name, MovieCount: count})
+	}
+
+	sort.Slice(genres, func(i, j int) bool {
+		if genres[i].MovieCount != genres[j].MovieCount {
+			return genres[i].MovieCount > genres[j].MovieCount
+		}
+		return genres[i].Name < genres[j].Name
+	})
+
+	return genres, nil
+}
+
+func (m *MockMovieModel) GetDuplicate(ctx context.Context, title string, year int32) (*Movie, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := m.duplicateOf(title, year, 0)
+	if id == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	return copyMovie(m.movies[id]), nil
+}
+
+// The titleMatches() helper reports whether every word in the search string appears as
+// a word in the title, ignoring case. An empty search matches every title.
+func titleMatches(title, search string) bool {
+	words := make(map[string]bool)
+	for _, word := range strings.Fields(strings.ToLower(title)) {
+		words[word] = true
+	}
+
+	for _, word := range strings.Fields(strings.ToLower(search)) {
+		if !words[word] {
+			return false
+		}
+	}
+	return true
+}
+
+// The genresMatchFilter() helper reports whether a movie's genres match the filter, using
+// the same "all" (contains) or "any" (overlaps) semantics as the SQL query.
+func genresMatchFilter(movieGenres, filter []string, mode string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+
+	has := make(map[string]bool)
+	for _, genre := range movieGenres {
+		has[genre] = true
+	}
+
+	for _, genre := range filter {
+		if has[genre] && mode == "any" {
+			return true
+		}
+		if !has[genre] && mode != "any" {
+			return false
+		}
+	}
+	return mode != "any"
+}
+
+// MockIdempotencyKeyModel is an in-memory implementation of
+// IdempotencyKeyModelInterface. A reserved key which hasn't been completed yet has a
+// record with a zero status.
+type MockIdempotencyKeyModel struct {
+	mu		sync.Mutex
+	records	map[string]*IdempotencyRecord
+	expires	map[string]time.Time
+}
+
+func (m *MockIdempotencyKeyModel) Reserve(ctx context.Context, key, requestHash string) (*IdempotencyRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record, ok := m.records[key]
+	if !ok || time.Now().After(m.expires[key]) {
+		m.records[key] = &IdempotencyRecord{Key: key, RequestHash: requestHash}
+		m.expires[key] = time.Now().Add(IdempotencyKeyTTL)
+		return nil, nil
+	}
+
+	switch {
+	case record.RequestHash != requestHash:
+		return nil, ErrIdempotencyKeyMismatch
+	case record.Status == 0:
+		return nil, ErrIdempotencyKeyInProgress
+	}
+
+	c := *record
+	return &c, nil
+}
+
+func (m *MockIdempotencyKeyModel) Complete(ctx context.Context, record *IdempotencyRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.records[record.Key]
+	if !ok {
+		return nil
+	}
+
+	stored.Status = record.Status
+	stored.Headers = record.Headers
+	stored.Body = record.Body
+	return nil
+}
+
+func (m *MockIdempotencyKeyModel) Release(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.records, key)
+	delete(m.expires, key)
+	return nil
+}
+
+func (m *MockIdempotencyKeyModel) DeleteExpired(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deleted int64
+	for key, expires := range m.expires {
+		if time.Now().After(expires) {
+			delete(m.records, key)
+			delete(m.expires, key)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// MockWebhookModel is an in-memory implementation of WebhookModelInterface.
+type MockWebhookModel struct {
+	mu			sync.Mutex
+	nextID		int64
+	webhooks	map[int64]*Webhook
+}
+
+// The copyWebhook() helper returns a deep copy of a webhook.
+func copyWebhook(webhook *Webhook) *Webhook {
+	c := *webhook
+	c.Events = append([]string(nil), webhook.Events...)
+	return &c
+}
+
+func (m *MockWebhookModel) Insert(ctx context.Context, webhook *Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	webhook.ID = m.nextID
+	webhook.CreatedAt = time.Now().UTC().Truncate(time.Second)
+
+	m.webhooks[webhook.ID] = copyWebhook(webhook)
+	return nil
+}
+
+func (m *MockWebhookModel) GetAll(ctx context.Context) ([]*Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	webhooks := []*Webhook{}
+	for _, webhook := range m.webhooks {
+		c := copyWebhook(webhook)
+		c.Secret = ""
+		webhooks = append(webhooks, c)
+	}
+
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].ID < webhooks[j].ID })
+	return webhooks, nil
+}
+
+func (m *MockWebhookModel) GetForEvent(ctx context.Context, event string) ([]*Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	webhooks := []*Webhook{}
+	for _, webhook := range m.webhooks {
+		if slices.Contains(webhook.Events, event) {
+			webhooks = append(webhooks, copyWebhook(webhook))
+		}
+	}
+
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].ID < webhooks[j].ID })
+	return webhooks, nil
+}
+
+func (m *MockWebhookModel) Delete(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.webhooks[id]; !ok {
+		return ErrRecordNotFound
+	}
+
+	delete(m.webhooks, id)
+	return nil
+}
+
+func (m *MockWebhookModel) RecordDelivery(ctx context.Context, id int64, status int, deliveryErr string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	webhook, ok := m.webhooks[id]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	webhook.LastDeliveryAt = &now
+	webhook.LastDeliveryStatus = &status
+	webhook.LastDeliveryError = deliveryErr
+	return nil
+}
@@ -1,8 +1,11 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
+	"github.com/lib/pq"
 )
 
 // Define a custom ErrRecordNotFound error. We'll return this from our Get() method when
@@ -10,18 +13,60 @@ import (
 var (
 	ErrRecordNotFound = errors.New("record not found")
 	ErrEditConflict = errors.New("edit conflict")
+	ErrDuplicateMovie = errors.New("duplicate movie")
 )
 
+// The IsQueryTimeout() function reports whether an error was caused by a database
+// query taking too long. That's either the context deadline set by a model expiring, or
+// PostgreSQL cancelling the statement (error code 57014) when the statement_timeout
+// setting is exceeded.
+func IsQueryTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "57014"
+}
+
+// The MovieModelInterface describes the methods that the handlers use to work with
+// movies. The Models struct holds this interface rather than the concrete MovieModel,
+// so that it can be swapped for an alternative implementation (such as the in-memory
+// one returned by NewMockModels) in tests.
+type MovieModelInterface interface {
+	Insert(ctx context.Context, movie *Movie) error
+	InsertBatch(ctx context.Context, movies []*Movie) error
+	Get(ctx context.Context, id int64) (*Movie, error)
+	GetAll(ctx context.Context, title string, genres []string, genresMatch string, yearFrom, yearTo int, modifiedSince time.Time, ids []int64, includeDeleted bool, filters Filters) ([]*Movie, Metadata, error)
+	Count(ctx context.Context, title string, genres []string, genresMatch string, yearFrom, yearTo int) (int, error)
+	Update(ctx context.Context, movie *Movie) error
+	AddGenre(ctx context.Context, movie *Movie, genre string) error
+	RemoveGenre(ctx context.Context, movie *Movie, genre string) error
+	Delete(ctx context.Context, id int64) error
+	HardDelete(ctx context.Context, id int64) error
+	Restore(ctx context.Context, id int64) error
+	PurgeDeleted(ctx context.Context, before time.Time) (int64, error)
+	History(ctx context.Context, movieID int64, filters Filters) ([]*AuditEntry, Metadata, error)
+	AllGenres(ctx context.Context) ([]*Genre, error)
+	GetDuplicate(ctx context.Context, title string, year int32) (*Movie, error)
+}
+
 // Create a Models struct which wraps the MovieModel. We'll add other models to this,
 // like a UserModel and PermissionModel, as our build progresses.
 type Models struct {
-	Movies MovieModel
+	Movies			MovieModelInterface
+	IdempotencyKeys	IdempotencyKeyModelInterface
+	Webhooks		WebhookModelInterface
 }
 
 // For ease of use, we also add a New() method which returns a Models struct containing
-// the initialized MovieModel.
-func NewModels(db *sql.DB) Models {
+// the initialized MovieModel. The timeout is applied to every database operation. The
+// readDB pool is used for read-only movie queries; pass the same pool as db (or nil) if
+// there's no read replica.
+func NewModels(db, readDB *sql.DB, timeout time.Duration) Models {
 	return Models{
-		Movies: MovieModel{DB: db},
+		Movies:				MovieModel{DB: db, ReadDB: readDB, Timeout: timeout},
+		IdempotencyKeys:	IdempotencyKeyModel{DB: db, Timeout: timeout},
+		Webhooks:			WebhookModel{DB: db, Timeout: timeout},
 	}
 }
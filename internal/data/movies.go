@@ -7,6 +7,7 @@ import (
 	"errors"
 	"context"
 	"fmt"
+	"slices"
 	"greenlight.nursultandias.net/internal/validator"
 )
 
@@ -17,7 +18,9 @@ import (
 // we use three directives: - ,omitempty , string
 type Movie struct {
 	ID			int64		`json:"id"`			// Unique integer ID for the movie
-	CreatedAt	time.Time	`json:"-"`	// Timestamp for when the movie is added to our database
+	CreatedAt	time.Time	`json:"created_at"`	// Timestamp for when the movie is added to our database
+	UpdatedAt	time.Time	`json:"updated_at"`	// Timestamp for when the movie was last updated
+	DeletedAt	*time.Time	`json:"deleted_at,omitempty"`	// Timestamp for when the movie was soft-deleted (only set in lists which include deleted movies)
 	Title		string		`json:"title"`		// Movie title
 	Year		int32		`json:"year,omitempty"`		// Movie release year
 	Runtime		Runtime		`json:"runtime,omitempty"`	// Movie runtime (in minutes) // CUSTOMIZED so it’s encoded as a string with the format "<runtime> mins" instead of int32.
@@ -30,59 +33,301 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	// provided key and error message to the errors map if the check does not evaluate
 	// to true. For example, in the first line here we "check that the title is not
 	// equal to the empty string". In the second, we "check that the length of the title
-	// is less than or equal to 500 bytes" and so on.
-	v.Check(movie.Title != "", "title", "must be provided")
-	v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
+	// is less than or equal to 500 characters" and so on. The length is counted in
+	// runes, so titles in non-Latin scripts get the same allowance.
+	v.Check(validator.NotBlank(movie.Title), "title", "must be provided")
+	v.Check(validator.MaxLength(movie.Title, 500), "title", "must not be more than 500 characters long")
 
 	v.Check(movie.Year != 0, "year", "must be provided")
-	v.Check(movie.Year >= 1888, "year", "must be greater than 1888")
-	v.Check(movie.Year <= int32(time.Now().Year()), "year", "must not be in the future")
+	v.Check(validator.Min(movie.Year, 1888), "year", "must be greater than 1888")
+	v.Check(validator.Max(movie.Year, int32(time.Now().Year())), "year", "must not be in the future")
 
 	v.Check(movie.Runtime != 0, "runtime", "must be provided")
-	v.Check(movie.Runtime > 0, "runtime", "must be a positive integer")
+	v.Check(validator.Min(movie.Runtime, 1), "runtime", "must be a positive integer")
 
 	v.Check(movie.Genres != nil, "genres", "must be provided")
-	v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
-	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
+	v.Check(validator.Min(len(movie.Genres), minGenres), "genres", fmt.Sprintf("must contain at least %d genre", minGenres))
+	v.Check(validator.Max(len(movie.Genres), maxGenres), "genres", fmt.Sprintf("must not contain more than %d genres", maxGenres))
 
 	// Note that we're using the Unique helper in the line below to check that all
 	// values in the movie.Genres slice are unique.
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
 }
 
-// Define a MovieModel struct type which wraps a sql.DB connection pool.
+// The DefaultQueryTimeout is used for database queries when a MovieModel's Timeout
+// field isn't set.
+const DefaultQueryTimeout = 3 * time.Second
+
+// Define a MovieModel struct type which wraps a sql.DB connection pool. The Timeout
+// field is the maximum time allowed for each database operation. If ReadDB is set, the
+// read-only queries (Get(), GetAll(), Count(), History() and AllGenres()) use it
+// instead of DB, so that they can be served by a read replica.
 type MovieModel struct {
-	DB *sql.DB
+	DB		*sql.DB
+	ReadDB	*sql.DB
+	Timeout	time.Duration
+}
+
+// The reader() method returns the connection pool to use for read-only queries.
+func (m MovieModel) reader() *sql.DB {
+	if m.ReadDB == nil {
+		return m.DB
+	}
+	return m.ReadDB
+}
+
+// The timeout() method returns the timeout to use for database operations.
+func (m MovieModel) timeout() time.Duration {
+	if m.Timeout <= 0 {
+		return DefaultQueryTimeout
+	}
+	return m.Timeout
+}
+
+// The genres for each movie are stored in the genres and movies_genres tables, rather
+// than in the movies table itself. The movieGenres expression aggregates them back into
+// an array (in their original order) so that queries on the movies table can select
+// the genres as if they were a column.
+const movieGenres = `COALESCE((SELECT array_agg(g.name ORDER BY mg.position)
+		FROM movies_genres mg JOIN genres g ON g.id = mg.genre_id
+		WHERE mg.movie_id = movies.id), '{}')`
+
+// The setGenres() helper replaces the genres for a movie within a transaction. Any
+// genres which don't exist yet are created, and the position of each genre is stored so
+// that they're returned in the same order.
+func setGenres(ctx context.Context, tx *sql.Tx, movieID int64, genres []string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO genres (name)
+		SELECT unnest($1::text[])
+		ON CONFLICT (name) DO NOTHING`, pq.Array(genres))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM movies_genres WHERE movie_id = $1`, movieID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO movies_genres (movie_id, genre_id, position)
+		SELECT $1, g.id, t.position
+		FROM unnest($2::text[]) WITH ORDINALITY AS t(name, position)
+		JOIN genres g ON g.name = t.name`, movieID, pq.Array(genres))
+
+	return err
 }
 
 // The Insert() method accepts a pointer to a movie struct,
 // which should contain the data for the new record.
-func (m MovieModel) Insert(movie *Movie) error {
+func (m MovieModel) Insert(ctx context.Context, movie *Movie) error {
 	// Define the SQL query for inserting a new record in
 	// the system-generated data.
 	query := `
-		INSERT INTO movies (title, year, runtime, genres)
-		VALUES ($1, $2, $3, $4)
-		RETURNING id, created_at, version`
+		INSERT INTO movies (title, year, runtime)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, updated_at, version`
 
 	// Create an args slice containing the values for the placeholder parameters from
 	// the movie struct. Declaring this slice immediately next to our SQL query helps to
 	// make it nice and clear *what values are being used where* in the query.
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	args := []interface{}{movie.Title, movie.Year, movie.Runtime}
 
-	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// Derive a context with the query timeout from the caller's context, so that the
+	// query is also cancelled if the caller's context is (e.g. the client disconnects).
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
+	// The movie and its genres are written in a transaction, so that we never end up
+	// with a movie that has no genres.
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	// Use the QueryRow() method to execute the SQL query on our connection pool,
 	// passing in the args slice as a variadic parameter and scanning the system-
 	// generated id, created_at and version values into the movie struct.
 	// Use QueryRowContext() and pass the context as the first argument.
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	// If the insert violates the unique index on the title and year, we return our
+	// custom ErrDuplicateMovie error instead of the raw database error. Any other
+	// constraint violation is returned as a ConstraintError (see constraints.go).
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.UpdatedAt, &movie.Version)
+	if err != nil {
+		switch {
+		case isDuplicateMovieError(err):
+			return ErrDuplicateMovie
+		default:
+			return constraintError(err)
+		}
+	}
+
+	err = setGenres(ctx, tx, movie.ID, movie.Genres)
+	if err != nil {
+		return constraintError(err)
+	}
+
+	err = insertAudit(ctx, tx, movie.ID, movie.Version, AuditActionInsert, diffMovies(nil, movie))
+	if err != nil {
+		return err
+	}
+
+	// The genre count is checked by a deferred constraint trigger when the transaction
+	// commits.
+	return constraintError(tx.Commit())
+}
+
+// The isDuplicateMovieError() helper reports whether an error returned by PostgreSQL is
+// a unique violation (error code 23505) on the movies_title_year_idx index, which
+// means that a movie with the same title (ignoring case) and year already exists.
+func isDuplicateMovieError(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "movies_title_year_idx"
+}
+
+// The GetDuplicate() method returns the existing (non-deleted) movie with the given
+// title (ignoring case) and year, which is the movie that an insert or update resulting
+// in an ErrDuplicateMovie error clashed with.
+func (m MovieModel) GetDuplicate(ctx context.Context, title string, year int32) (*Movie, error) {
+	query := `
+		SELECT id, created_at, updated_at, title, year, runtime, ` + movieGenres + `, version
+		FROM movies
+		WHERE lower(title) = lower($1) AND year = $2 AND deleted_at IS NULL`
+
+	var movie Movie
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, title, year).Scan(
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.UpdatedAt,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		&movie.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &movie, nil
+}
+
+// The InsertBatch() method inserts a slice of movies using a single multi-row INSERT
+// statement inside a transaction, so either all of the movies are created or none of
+// them are. The system-generated fields are set on each movie struct, in the same order
+// as the slice.
+func (m MovieModel) InsertBatch(ctx context.Context, movies []*Movie) error {
+	if len(movies) == 0 {
+		return nil
+	}
+
+	// Pass the fields as arrays, which are unnested into rows along with their position
+	// in the slice.
+	titles := make([]string, len(movies))
+	years := make([]int32, len(movies))
+	runtimes := make([]int32, len(movies))
+
+	for i, movie := range movies {
+		titles[i] = movie.Title
+		years[i] = movie.Year
+		runtimes[i] = int32(movie.Runtime)
+	}
+
+	// PostgreSQL doesn't guarantee that the IDs are assigned in the order of the input
+	// rows, and RETURNING can only return the columns of the movies table. So each
+	// inserted row is matched back to its input row (and so its position) on the title
+	// and year, which the movies_title_year_idx unique index guarantees are distinct.
+	query := `
+		WITH input AS (
+			SELECT * FROM unnest($1::text[], $2::integer[], $3::integer[])
+			WITH ORDINALITY AS t(title, year, runtime, position)
+		), inserted AS (
+			INSERT INTO movies (title, year, runtime)
+			SELECT title, year, runtime FROM input ORDER BY position
+			RETURNING id, title, year, created_at, updated_at, version
+		)
+		SELECT input.position, inserted.id, inserted.created_at, inserted.updated_at, inserted.version
+		FROM inserted
+		JOIN input ON lower(input.title) = lower(inserted.title) AND input.year = inserted.year
+		ORDER BY input.position`
+
+	args := []interface{}{pq.Array(titles), pq.Array(years), pq.Array(runtimes)}
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	// Begin a transaction. If anything goes wrong, the deferred Rollback() call undoes
+	// the insert; after a successful Commit() it is a no-op.
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		if isDuplicateMovieError(err) {
+			return ErrDuplicateMovie
+		}
+		return constraintError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var position int
+		var inserted Movie
+
+		err := rows.Scan(&position, &inserted.ID, &inserted.CreatedAt, &inserted.UpdatedAt, &inserted.Version)
+		if err != nil {
+			return err
+		}
+
+		if position < 1 || position > len(movies) {
+			return fmt.Errorf("insert batch: unexpected position %d", position)
+		}
+
+		movie := movies[position-1]
+		movie.ID, movie.CreatedAt, movie.UpdatedAt, movie.Version = inserted.ID, inserted.CreatedAt, inserted.UpdatedAt, inserted.Version
+	}
+
+	if err = rows.Err(); err != nil {
+		if isDuplicateMovieError(err) {
+			return ErrDuplicateMovie
+		}
+		return constraintError(err)
+	}
+
+	// The result set must be closed before we can run the queries for the genres on
+	// the same transaction.
+	rows.Close()
+
+	for _, movie := range movies {
+		err = setGenres(ctx, tx, movie.ID, movie.Genres)
+		if err != nil {
+			return constraintError(err)
+		}
+
+		err = insertAudit(ctx, tx, movie.ID, movie.Version, AuditActionInsert, diffMovies(nil, movie))
+		if err != nil {
+			return err
+		}
+	}
+
+	return constraintError(tx.Commit())
 }
 
 // Add a placeholder method for fetching a specific record from the movies table.
-func (m MovieModel) Get(id int64) (*Movie, error) {
+func (m MovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
 	// The PostgreSQL bigserial type that we're using for the movie ID starts
 	// auto-incrementing at 1 by default, so we know that no movies will have ID values
 	// less than that. To avoid making an unnecessary database call, we take a shortcut
@@ -93,23 +338,24 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 
 	// Define the SQL query for retrieving the movie data.
 	query := `
-		SELECT id, created_at, title, year, runtime, genres, version 
+		SELECT id, created_at, updated_at, title, year, runtime, ` + movieGenres + `, version
 		FROM movies
-		WHERE id = $1`
+		WHERE id = $1 AND deleted_at IS NULL`
 
 	// Declare a Movie struct to hold the data returned by the query.
 	var movie Movie
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
 	// Execute the query using the QueryRow() method, passing in the provided id value
 	// as a placeholder parameter, and scan the response data into the fields of the
 	// Movie struct. Importantly, notice that we need to convert the scan target for the
 	// genres column using the pq.Array() adapter function again.
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.reader().QueryRowContext(ctx, query, id).Scan(
 		&movie.ID,
 		&movie.CreatedAt,
+		&movie.UpdatedAt,
 		&movie.Title, &movie.Year,
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
@@ -133,121 +379,404 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 }
 
 // Add a placeholder method for updating a specific record in the movies table.
-func (m MovieModel) Update(movie *Movie) error {
+func (m MovieModel) Update(ctx context.Context, movie *Movie) error {
 	// Declare the SQL query for updating the record and returning the new version // number.
-	// Add the 'AND version = $6' clause to the SQL query to prevent race conditions.
+	// Add the 'AND version = $5' clause to the SQL query to prevent race conditions.
+	// Soft-deleted movies can't be updated until they have been restored.
 	query := `
 		UPDATE movies
-		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-		WHERE id = $5 AND version = $6
-		RETURNING version`
+		SET title = $1, year = $2, runtime = $3, version = version + 1, updated_at = NOW()
+		WHERE id = $4 AND version = $5 AND deleted_at IS NULL
+		RETURNING version, updated_at`
 
 	// Create an args slice containing the values for the placeholder parameters.
 	args := []interface{}{
 		movie.Title,
 		movie.Year,
 		movie.Runtime,
-		pq.Array(movie.Genres),
 		movie.ID,
 		movie.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
+	// As with Insert(), the movie and its genres are updated in a transaction.
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Read (and lock) the current values of the movie, so that we can record which
+	// fields were changed in the audit trail.
+	old, err := m.getForUpdate(ctx, tx, movie.ID, movie.Version)
+	if err != nil {
+		return err
+	}
+
 	// Use the QueryRow() method to execute the query, passing in the args slice as a
 	// variadic parameter and scanning the new version value into the movie struct.
 	// Execute the SQL query. If no matching row could be found, we know the movie
 	// version has changed (or the record has been deleted) and we return our custom
 	// ErrEditConflict error.
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.Version, &movie.UpdatedAt)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
+		case isDuplicateMovieError(err):
+			return ErrDuplicateMovie
 		default:
-			return err
+			return constraintError(err)
+		}
+	}
+
+	err = setGenres(ctx, tx, movie.ID, movie.Genres)
+	if err != nil {
+		return constraintError(err)
+	}
+
+	err = insertAudit(ctx, tx, movie.ID, movie.Version, AuditActionUpdate, diffMovies(old, movie))
+	if err != nil {
+		return err
+	}
+
+	return constraintError(tx.Commit())
+}
+
+// The getForUpdate() helper reads a movie within a transaction and locks its row until
+// the transaction ends. Like Update(), it returns an ErrEditConflict error if the movie
+// doesn't have the given version, or has been deleted.
+func (m MovieModel) getForUpdate(ctx context.Context, tx *sql.Tx, id int64, version int32) (*Movie, error) {
+	query := `
+		SELECT title, year, runtime, ` + movieGenres + `
+		FROM movies
+		WHERE id = $1 AND version = $2 AND deleted_at IS NULL
+		FOR UPDATE`
+
+	var movie Movie
+
+	err := tx.QueryRowContext(ctx, query, id, version).Scan(
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrEditConflict
+		default:
+			return nil, err
 		}
 	}
 
-	return nil
+	return &movie, nil
+}
+
+// The AddGenre() method adds a genre to the end of a movie's genres. The movie must be
+// the current version, as read by the caller: like Update(), an ErrEditConflict error
+// is returned if its version has changed or it has been deleted. Adding a genre which
+// the movie already has does nothing, and leaves the version unchanged. If the movie
+// already has the maximum number of genres, errGenreCount is returned. On success the
+// movie's Genres, Version and UpdatedAt fields are updated.
+func (m MovieModel) AddGenre(ctx context.Context, movie *Movie, genre string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	old, err := m.getForUpdate(ctx, tx, movie.ID, movie.Version)
+	if err != nil {
+		return err
+	}
+
+	if slices.Contains(old.Genres, genre) {
+		movie.Genres = old.Genres
+		return nil
+	}
+
+	if len(old.Genres) >= maxGenres {
+		return errGenreCount
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO genres (name) VALUES ($1) ON CONFLICT (name) DO NOTHING`, genre)
+	if err != nil {
+		return constraintError(err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO movies_genres (movie_id, genre_id, position)
+		SELECT $1, g.id, COALESCE((SELECT max(position) FROM movies_genres WHERE movie_id = $1), 0) + 1
+		FROM genres g
+		WHERE g.name = $2`, movie.ID, genre)
+	if err != nil {
+		return constraintError(err)
+	}
+
+	movie.Genres = append(old.Genres, genre)
+
+	return m.commitGenres(ctx, tx, old, movie)
 }
 
-// Add a placeholder method for deleting a specific record from the movies table.
-func (m MovieModel) Delete(id int64) error {
+// The RemoveGenre() method removes a genre from a movie's genres, checking the version
+// in the same way as AddGenre(). If the movie doesn't have the genre, an
+// ErrRecordNotFound error is returned, and if it's the movie's only genre,
+// errGenreCount is returned.
+func (m MovieModel) RemoveGenre(ctx context.Context, movie *Movie, genre string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	old, err := m.getForUpdate(ctx, tx, movie.ID, movie.Version)
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(old.Genres, genre) {
+		return ErrRecordNotFound
+	}
+
+	if len(old.Genres) <= minGenres {
+		return errGenreCount
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM movies_genres
+		WHERE movie_id = $1 AND genre_id = (SELECT id FROM genres WHERE name = $2)`, movie.ID, genre)
+	if err != nil {
+		return err
+	}
+
+	movie.Genres = slices.DeleteFunc(slices.Clone(old.Genres), func(g string) bool { return g == genre })
+
+	return m.commitGenres(ctx, tx, old, movie)
+}
+
+// The commitGenres() helper finishes AddGenre() and RemoveGenre(): it increments the
+// movie's version, records the change in the audit trail and commits the transaction.
+func (m MovieModel) commitGenres(ctx context.Context, tx *sql.Tx, old, movie *Movie) error {
+	query := `
+		UPDATE movies
+		SET version = version + 1, updated_at = NOW()
+		WHERE id = $1
+		RETURNING version, updated_at`
+
+	err := tx.QueryRowContext(ctx, query, movie.ID).Scan(&movie.Version, &movie.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = insertAudit(ctx, tx, movie.ID, movie.Version, AuditActionUpdate, diffMovies(old, movie))
+	if err != nil {
+		return err
+	}
+
+	return constraintError(tx.Commit())
+}
+
+// The Delete() method soft-deletes a specific record in the movies table by setting
+// its deleted_at timestamp. The row is kept so that it can be restored later.
+func (m MovieModel) Delete(ctx context.Context, id int64) error {
 	// Return an ErrRecordNotFound error if the movie ID is less than 1.
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	// Construct the SQL query to delete the record.
+	// Construct the SQL query to mark the record as deleted. Movies which have already
+	// been deleted are excluded, so deleting the same movie twice returns an
+	// ErrRecordNotFound error.
+	query := `
+		UPDATE movies
+		SET deleted_at = NOW()
+		WHERE id = $1 AND deleted_at IS NULL
+		RETURNING version`
+
+	return m.setDeleted(ctx, query, id, AuditActionDelete)
+}
+
+// The HardDelete() method permanently removes a specific record from the movies table,
+// regardless of whether it has been soft-deleted or not. The movie's audit trail is
+// kept, and a hard_delete entry is added to it.
+func (m MovieModel) HardDelete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	// Construct the SQL query to delete the record, returning its version for the
+	// audit trail.
 	query := `
 		DELETE FROM movies
-		WHERE id = $1`
+		WHERE id = $1
+		RETURNING version`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
-	// Execute the SQL query using the Exec() method, passing in the id variable as
-	// the value for the placeholder parameter. The Exec() method returns a sql.Result object.
-	result, err := m.DB.ExecContext(ctx, query, id)
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	// Call the RowsAffected() method on the sql.Result object to get the number of rows
-	// affected by the query.
-	rowsAffected, err := result.RowsAffected()
+	var version int32
+	err = tx.QueryRowContext(ctx, query, id).Scan(&version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	err = insertAudit(ctx, tx, id, version, AuditActionHardDelete, nil)
 	if err != nil {
 		return err
 	}
 
-	// If no rows were affected, we know that the movies table didn't contain a record
-	// with the provided ID at the moment we tried to delete it. In that case we
-	// return an ErrRecordNotFound error.
-	if rowsAffected == 0 {
+	return tx.Commit()
+}
+
+// The Restore() method clears the deleted_at timestamp on a soft-deleted movie. If the
+// movie doesn't exist or hasn't been deleted, an ErrRecordNotFound error is returned.
+func (m MovieModel) Restore(ctx context.Context, id int64) error {
+	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	return nil
+	query := `
+		UPDATE movies
+		SET deleted_at = NULL
+		WHERE id = $1 AND deleted_at IS NOT NULL
+		RETURNING version`
+
+	return m.setDeleted(ctx, query, id, AuditActionRestore)
+}
+
+// The setDeleted() helper executes a query which soft-deletes or restores a movie and
+// returns its version, and records the action in the audit trail in the same
+// transaction. If no movie was affected, an ErrRecordNotFound error is returned.
+func (m MovieModel) setDeleted(ctx context.Context, query string, id int64, action string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Restoring a movie can clash with another movie which was created with the same
+	// title and year while it was deleted, so check for a duplicate error here too.
+	var version int32
+	err = tx.QueryRowContext(ctx, query, id).Scan(&version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		case isDuplicateMovieError(err):
+			return ErrDuplicateMovie
+		default:
+			return constraintError(err)
+		}
+	}
+
+	err = insertAudit(ctx, tx, id, version, action, nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// The PurgeDeleted() method permanently removes the movies which were soft-deleted
+// before the given time, and returns the number of movies removed.
+func (m MovieModel) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	// Delete the movies and record a "purge" audit entry for each of them in a single
+	// statement, so that the two can't get out of step. The number of rows affected is
+	// the number of audit entries, which is the same as the number of movies purged.
+	query := `
+		WITH purged AS (
+			DELETE FROM movies
+			WHERE deleted_at < $1
+			RETURNING id, version
+		)
+		INSERT INTO movies_audit (movie_id, version, action)
+		SELECT id, version, $2 FROM purged`
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, before, AuditActionPurge)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
 }
 
 // Create a new GetAll() method which returns a slice of movies. Although we're not
 // using them right now, we've set this up to accept the various filter parameters as
 // arguments.
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+// The genresMatch parameter controls how the genres filter is applied: "all" returns
+// movies which contain every one of the genres, and "any" returns movies which contain
+// at least one of them.
+// The yearFrom and yearTo parameters restrict the results to an inclusive range of
+// release years. A value of zero means the range is unbounded on that side.
+// If modifiedSince isn't the zero time, only movies updated at or after that time are
+// returned.
+// If ids isn't empty, only the movies with those IDs are returned, in the same order
+// as the IDs (with the sort fields only used as a tiebreaker).
+// Soft-deleted movies are left out unless includeDeleted is true, in which case their
+// DeletedAt field is set.
+func (m MovieModel) GetAll(ctx context.Context, title string, genres []string, genresMatch string, yearFrom, yearTo int, modifiedSince time.Time, ids []int64, includeDeleted bool, filters Filters) ([]*Movie, Metadata, error) {
 	// Construct the SQL query to retrieve all movie records.
 	// SQL query with filter conditions.
 	// Use full-text search for the title filter.
-	// Add an ORDER BY clause and interpolate the sort column and direction. Importantly
-	// notice that we also include a secondary sort on the movie ID to ensure a
+	// Add an ORDER BY clause and interpolate the sort columns and directions. Importantly
+	// notice that orderBy() also includes a final sort on the movie ID to ensure a
 	// consistent ordering.
 	// Update the SQL query to include the LIMIT and OFFSET clauses with placeholder
 	// parameter values.
 	// Update the SQL query to include the window function which counts the total
 	// (filtered) records.
+	// Interpolate the condition for the genres filter, which checks the movies_genres
+	// join table (see genresCondition()).
+	// The WHERE clause is shared with the count query below (see movieListConditions()).
+	conditions := movieListConditions(genresMatch)
 	query := fmt.Sprintf(`
-	SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+	SELECT count(*) OVER(), id, created_at, updated_at, deleted_at, title, year, runtime, %s, version
 	FROM movies
-	WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-	AND (genres @> $2 OR $2 = '{}')
-	ORDER BY %s %s, id ASC
-	LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+	WHERE %s
+	ORDER BY array_position($7::bigint[], id), %s
+	LIMIT $9 OFFSET $10`, movieGenres, conditions, filters.orderBy())
 
-	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// Derive a context with the query timeout from the caller's context, so that the
+	// query is also cancelled if the caller's context is (e.g. the client disconnects).
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
 	defer cancel()
 
 	// As our SQL query now has quite a few placeholder parameters, let's collect the
 	// values for the placeholders in a slice. Notice here how we call the limit() and
 	// offset() methods on the Filters struct to get the appropriate values for the
 	// LIMIT and OFFSET clauses.
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args := append(movieListArgs(title, genres, yearFrom, yearTo, filters.cursor(), modifiedSince, ids, includeDeleted), filters.limit(), filters.offset())
 
 	// Use QueryContext() to execute the query. This returns a sql.Rows resultset
 	// containing the result.
 	// pass the args slice to QueryContext() as a variadic parameter.
-	rows, err := m.DB.QueryContext(ctx, query, args...)
+	rows, err := m.reader().QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -272,6 +801,8 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&totalRecords,
 			&movie.ID,
 			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.DeletedAt,
 			&movie.Title,
 			&movie.Year,
 			&movie.Runtime,
@@ -293,10 +824,152 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 		return nil, Metadata{} ,err
 	}
 
+	// The count(*) OVER() window only sees the rows on the page, so when a client asks
+	// for a page past the end of the results there's no total. In that case we count
+	// the matching records separately, so that total_records and last_page are still
+	// right. The count query takes the same arguments, minus the LIMIT and OFFSET.
+	if len(movies) == 0 && !filters.UseCursor && filters.offset() > 0 {
+		err = m.reader().QueryRowContext(ctx, "SELECT count(*) FROM movies WHERE "+conditions, args[:8]...).Scan(&totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+
 	// Generate a Metadata struct, passing in the total record count and pagination
-	// parameters from the client.
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	// parameters from the client. In cursor mode the count is the number of records
+	// after the cursor, which tells us whether there is a next page.
+	var metadata Metadata
+	if filters.UseCursor {
+		var lastID int64
+		if len(movies) > 0 {
+			lastID = movies[len(movies)-1].ID
+		}
+		metadata = calculateCursorMetadata(totalRecords, filters.PageSize, lastID)
+	} else {
+		metadata = calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	}
+
+	// Tell the client the sort order which was applied, including the ID tiebreaker.
+	metadata.Sort = filters.appliedSort()
 
 	// If everything went OK, then return the slice of movies.
 	return movies, metadata ,nil
 }
+
+
+// The Count() method returns the number of (non-deleted) movies matching the title,
+// genres and year filters, which are applied in the same way as in GetAll(). It only
+// runs the count query, so it's much cheaper than paging through the movies.
+func (m MovieModel) Count(ctx context.Context, title string, genres []string, genresMatch string, yearFrom, yearTo int) (int, error) {
+	// Use the same WHERE clause as GetAll(), with the filters which the count doesn't
+	// support (the cursor, modified_since, IDs and include_deleted) switched off.
+	query := `SELECT count(*) FROM movies WHERE ` + movieListConditions(genresMatch)
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	var count int
+
+	args := movieListArgs(title, genres, yearFrom, yearTo, 0, time.Time{}, []int64{}, false)
+
+	err := m.reader().QueryRowContext(ctx, query, args...).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// The genresCondition() function returns the SQL condition for the genres filter in
+// GetAll(). Matching "any" genre requires at least one of the movie's genres to be in
+// the $2 array, while matching "all" requires every genre in the array to be linked to
+// the movie (the array never contains duplicates, so comparing the counts is enough).
+// Because the condition is interpolated into the SQL query, we panic on any unexpected
+// value rather than risk an injection.
+func genresCondition(genresMatch string) string {
+	switch genresMatch {
+	case "all":
+		return `(SELECT count(*) FROM movies_genres mg JOIN genres g ON g.id = mg.genre_id
+		WHERE mg.movie_id = movies.id AND g.name = ANY($2)) = cardinality($2::text[])`
+	case "any":
+		return `EXISTS (SELECT 1 FROM movies_genres mg JOIN genres g ON g.id = mg.genre_id
+		WHERE mg.movie_id = movies.id AND g.name = ANY($2))`
+	default:
+		panic("unsafe genres match parameter: " + genresMatch)
+	}
+}
+
+// The movieListConditions() function returns the WHERE clause used by GetAll() and
+// Count(). The placeholders are $1 for the title, $2 for the genres, $3 and $4 for the
+// years, $5 for the cursor, $6 for modified_since, $7 for the IDs and $8 for
+// include_deleted (see movieListArgs()).
+func movieListConditions(genresMatch string) string {
+	return fmt.Sprintf(`($8 OR deleted_at IS NULL)
+	AND (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+	AND (%s OR $2 = '{}')
+	AND (year >= $3 OR $3 = 0)
+	AND (year <= $4 OR $4 = 0)
+	AND id > $5
+	AND ($6::timestamptz IS NULL OR updated_at >= $6)
+	AND (id = ANY($7) OR cardinality($7::bigint[]) = 0)`, genresCondition(genresMatch))
+}
+
+// The movieListArgs() function returns the values for the $1 to $8 placeholders in
+// movieListConditions(). A zero modifiedSince is passed as NULL, which disables that
+// filter.
+func movieListArgs(title string, genres []string, yearFrom, yearTo int, cursor int64, modifiedSince time.Time, ids []int64, includeDeleted bool) []interface{} {
+	var since interface{}
+	if !modifiedSince.IsZero() {
+		since = modifiedSince
+	}
+
+	return []interface{}{title, pq.Array(genres), yearFrom, yearTo, cursor, since, pq.Array(ids), includeDeleted}
+}
+
+// The Genre type holds a genre along with the number of (non-deleted) movies which
+// have it.
+type Genre struct {
+	Name		string	`json:"name"`
+	MovieCount	int		`json:"movie_count"`
+}
+
+// The AllGenres() method returns every genre along with its movie count, sorted by the
+// count (most popular first) and then by name. Movies which have been deleted aren't
+// counted.
+func (m MovieModel) AllGenres(ctx context.Context) ([]*Genre, error) {
+	query := `
+		SELECT g.name, count(m.id)
+		FROM genres g
+		LEFT JOIN movies_genres mg ON mg.genre_id = g.id
+		LEFT JOIN movies m ON m.id = mg.movie_id AND m.deleted_at IS NULL
+		GROUP BY g.id, g.name
+		ORDER BY 2 DESC, 1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	rows, err := m.reader().QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	genres := []*Genre{}
+
+	for rows.Next() {
+		var genre Genre
+
+		err := rows.Scan(&genre.Name, &genre.MovieCount)
+		if err != nil {
+			return nil, err
+		}
+
+		genres = append(genres, &genre)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return genres, nil
+}
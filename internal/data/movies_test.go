@@ -0,0 +1,114 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMockGenreLimits(t *testing.T) {
+	ctx := context.Background()
+	models := NewMockModels()
+
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+	err := models.Movies.Insert(ctx, movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Removing the only genre would leave the movie with none.
+	err = models.Movies.RemoveGenre(ctx, movie, "animation")
+	if !errors.Is(err, errGenreCount) {
+		t.Fatalf("got %v removing the only genre; want errGenreCount", err)
+	}
+
+	for _, genre := range []string{"adventure", "comedy", "musical", "family"} {
+		err = models.Movies.AddGenre(ctx, movie, genre)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A sixth genre is over the limit, but adding one the movie already has is fine.
+	err = models.Movies.AddGenre(ctx, movie, "fantasy")
+	if !errors.Is(err, errGenreCount) {
+		t.Fatalf("got %v adding a sixth genre; want errGenreCount", err)
+	}
+	err = models.Movies.AddGenre(ctx, movie, "comedy")
+	if err != nil {
+		t.Fatalf("got %v adding an existing genre; want nil", err)
+	}
+
+	var constraintErr *ConstraintError
+	if !errors.As(errGenreCount, &constraintErr) || constraintErr.Field != "genres" || !errors.Is(errGenreCount, ErrConstraintViolation) {
+		t.Errorf("got %#v; want a constraint violation on genres", errGenreCount)
+	}
+
+	stored, err := models.Movies.Get(ctx, movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Genres) != maxGenres {
+		t.Errorf("got %d genres; want %d", len(stored.Genres), maxGenres)
+	}
+}
+
+func TestCountMatchesGetAll(t *testing.T) {
+	ctx := context.Background()
+	models := NewMockModels()
+
+	movies := []*Movie{
+		{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}},
+		{Title: "Black Panther", Year: 2018, Runtime: 134, Genres: []string{"action", "adventure"}},
+		{Title: "Deadpool", Year: 2016, Runtime: 108, Genres: []string{"action", "comedy"}},
+		{Title: "The Breakfast Club", Year: 1985, Runtime: 96, Genres: []string{"drama"}},
+		{Title: "Moana Deleted", Year: 2016, Runtime: 100, Genres: []string{"animation"}},
+	}
+	for _, movie := range movies {
+		err := models.Movies.Insert(ctx, movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Deleted movies are left out of both, as Count() has no include_deleted filter.
+	err := models.Movies.Delete(ctx, movies[4].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name				string
+		title				string
+		genres				[]string
+		genresMatch			string
+		yearFrom, yearTo	int
+	}{
+		{name: "no filters", genres: []string{}, genresMatch: "all"},
+		{name: "title", title: "moana", genres: []string{}, genresMatch: "all"},
+		{name: "all genres", genres: []string{"action", "adventure"}, genresMatch: "all"},
+		{name: "any genre", genres: []string{"comedy", "drama"}, genresMatch: "any"},
+		{name: "year range", genres: []string{}, genresMatch: "all", yearFrom: 2000, yearTo: 2016},
+		{name: "no matches", title: "Frozen", genres: []string{}, genresMatch: "all"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count, err := models.Movies.Count(ctx, tt.title, tt.genres, tt.genresMatch, tt.yearFrom, tt.yearTo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			filters := Filters{Page: 1, PageSize: 1, Sort: "id", SortSafelist: []string{"id"}}
+			_, metadata, err := models.Movies.GetAll(ctx, tt.title, tt.genres, tt.genresMatch, tt.yearFrom, tt.yearTo, time.Time{}, nil, false, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if metadata.TotalRecords == nil || *metadata.TotalRecords != count {
+				t.Errorf("got Count() %d; GetAll() total_records %v", count, metadata.TotalRecords)
+			}
+		})
+	}
+}
@@ -9,11 +9,22 @@ import (
 
 type Runtime int32
 
+// NullZeroRuntime controls how a zero (unknown) runtime is encoded. By default it's
+// encoded as "0 mins", but when this is set to true it will be encoded as JSON null
+// instead.
+var NullZeroRuntime = false
+
 // Implement a MarshalJSON() method on the Runtime type so that it satisfies the
 // json.Marshaler interface. This should return the JSON-encoded value for the movie 
 // runtime (in our case, it will return a string in the format "<runtime> mins").
 func (runtime Runtime) MarshalJSON() ([]byte, error) {
 
+	// If the runtime is unknown and the NullZeroRuntime option is enabled, encode it
+	// as a JSON null rather than "0 mins".
+	if runtime == 0 && NullZeroRuntime {
+		return []byte("null"), nil
+	}
+
 	// Generate a string containing the movie runtime in the required format.
 	jsonValue := fmt.Sprintf("%d mins", runtime)
 
@@ -36,7 +47,26 @@ var ErrInvalidRuntimeFormat = errors.New("invalid runtime format")
 // this method returns).
 func (runtime *Runtime) UnmarshalJSON(jsonValue []byte) error {
 
-	// We expect that the incoming JSON value will be a string in the format
+	// A JSON null leaves the runtime unchanged, in line with how encoding/json treats
+	// null for other types. This means a null produced by MarshalJSON round-trips.
+	if string(jsonValue) == "null" {
+		return nil
+	}
+
+	// Clients may also send the runtime as a plain JSON integer (like 107). If the value
+	// isn't wrapped in double quotes, try to parse it as a whole number of minutes.
+	// Anything else (floats, exponents, etc.) is rejected.
+	if len(jsonValue) > 0 && jsonValue[0] != '"' {
+		i, err := strconv.ParseInt(string(jsonValue), 10, 32)
+		if err != nil {
+			return ErrInvalidRuntimeFormat
+		}
+
+		*runtime = Runtime(i)
+		return nil
+	}
+
+	// Otherwise we expect that the incoming JSON value will be a string in the format
 	// "<runtime> mins", and the first thing we need to do is remove the surrounding 
 	// double-quotes from this string. If we can't unquote it, then we return the
 	// ErrInvalidRuntimeFormat error.
@@ -0,0 +1,146 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestRuntimeUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name	string
+		json	string
+		want	Runtime
+		wantErr	error
+	}{
+		{name: "string", json: `"107 mins"`, want: 107},
+		{name: "integer", json: `107`, want: 107},
+		{name: "zero integer", json: `0`, want: 0},
+		{name: "zero string", json: `"0 mins"`, want: 0},
+		{name: "negative integer", json: `-5`, want: -5},
+		{name: "largest int32", json: `2147483647`, want: 2147483647},
+		{name: "integer overflow", json: `2147483648`, wantErr: ErrInvalidRuntimeFormat},
+		{name: "string overflow", json: `"2147483648 mins"`, wantErr: ErrInvalidRuntimeFormat},
+		{name: "float", json: `107.5`, wantErr: ErrInvalidRuntimeFormat},
+		{name: "exponent", json: `1e2`, wantErr: ErrInvalidRuntimeFormat},
+		{name: "boolean", json: `true`, wantErr: ErrInvalidRuntimeFormat},
+		{name: "missing unit", json: `"107"`, wantErr: ErrInvalidRuntimeFormat},
+		{name: "wrong unit", json: `"107 minutes"`, wantErr: ErrInvalidRuntimeFormat},
+		{name: "extra space", json: `"107  mins"`, wantErr: ErrInvalidRuntimeFormat},
+		{name: "not a number", json: `"abc mins"`, wantErr: ErrInvalidRuntimeFormat},
+		{name: "empty string", json: `""`, wantErr: ErrInvalidRuntimeFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Runtime
+			err := got.UnmarshalJSON([]byte(tt.json))
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuntimeUnmarshalJSONNull(t *testing.T) {
+	// A null leaves the existing value alone, like encoding/json does for other types.
+	got := Runtime(90)
+
+	err := got.UnmarshalJSON([]byte("null"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 90 {
+		t.Errorf("got %d; want 90", got)
+	}
+}
+
+func TestRuntimeMarshalJSON(t *testing.T) {
+	tests := []struct {
+		name	string
+		runtime	Runtime
+		null	bool
+		want	string
+	}{
+		{name: "positive", runtime: 107, want: `"107 mins"`},
+		{name: "zero", runtime: 0, want: `"0 mins"`},
+		{name: "zero as null", runtime: 0, null: true, want: `null`},
+		{name: "positive with null option", runtime: 107, null: true, want: `"107 mins"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setNullZeroRuntime(t, tt.null)
+
+			got, err := json.Marshal(tt.runtime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s; want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuntimeRoundTrip(t *testing.T) {
+	for _, null := range []bool{false, true} {
+		setNullZeroRuntime(t, null)
+
+		for _, runtime := range []Runtime{1, 59, 107, 240, 2147483647} {
+			encoded, err := json.Marshal(runtime)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var decoded Runtime
+			err = json.Unmarshal(encoded, &decoded)
+			if err != nil {
+				t.Fatalf("unmarshal %s: %v", encoded, err)
+			}
+			if decoded != runtime {
+				t.Errorf("round trip of %d (null=%t) gave %d via %s", runtime, null, decoded, encoded)
+			}
+		}
+	}
+}
+
+func TestRuntimeRoundTripZero(t *testing.T) {
+	// In both modes a zero runtime decodes back to zero. With NullZeroRuntime the null
+	// leaves the target's zero value untouched.
+	for _, null := range []bool{false, true} {
+		setNullZeroRuntime(t, null)
+
+		input := struct {
+			Runtime	Runtime	`json:"runtime"`
+		}{}
+
+		encoded, err := json.Marshal(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		output := input
+		err = json.Unmarshal(encoded, &output)
+		if err != nil {
+			t.Fatalf("unmarshal %s: %v", encoded, err)
+		}
+		if output.Runtime != 0 {
+			t.Errorf("round trip of zero (null=%t) gave %d via %s", null, output.Runtime, encoded)
+		}
+	}
+}
+
+// The setNullZeroRuntime() helper sets the NullZeroRuntime option for the rest of the
+// test, restoring the previous value afterwards.
+func setNullZeroRuntime(t *testing.T, null bool) {
+	t.Helper()
+
+	previous := NullZeroRuntime
+	NullZeroRuntime = null
+	t.Cleanup(func() { NullZeroRuntime = previous })
+}
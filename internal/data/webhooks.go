@@ -0,0 +1,234 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+	"github.com/lib/pq"
+	"greenlight.nursultandias.net/internal/validator"
+)
+
+// The events which webhooks can subscribe to.
+const (
+	EventMovieCreated	= "movie.created"
+	EventMovieUpdated	= "movie.updated"
+	EventMovieDeleted	= "movie.deleted"
+	EventMovieRestored	= "movie.restored"
+)
+
+// WebhookEvents holds all of the events which webhooks can subscribe to.
+var WebhookEvents = []string{EventMovieCreated, EventMovieUpdated, EventMovieDeleted, EventMovieRestored}
+
+// A Webhook is a subscription to movie change events. The events are POSTed to the URL,
+// signed with the secret. The secret is only included in the response when the webhook
+// is created, so it's cleared before a webhook is sent anywhere else. The LastDelivery
+// fields record the outcome of the most recent delivery: the HTTP status code (zero if
+// no response was received) and an error message if it failed. Note that the secret is
+// stored unencrypted in the webhooks table, since it's needed to sign each delivery.
+type Webhook struct {
+	ID					int64		`json:"id"`
+	CreatedAt			time.Time	`json:"created_at"`
+	URL					string		`json:"url"`
+	Events				[]string	`json:"events"`
+	Secret				string		`json:"secret,omitempty"`
+	LastDeliveryAt		*time.Time	`json:"last_delivery_at"`
+	LastDeliveryStatus	*int		`json:"last_delivery_status"`
+	LastDeliveryError	string		`json:"last_delivery_error,omitempty"`
+}
+
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	u, err := url.Parse(webhook.URL)
+	v.Check(webhook.URL != "", "url", "must be provided")
+	v.Check(len(webhook.URL) <= 2048, "url", "must not be more than 2048 bytes long")
+	v.Check(err == nil && validator.In(u.Scheme, "http", "https") && u.Host != "", "url", "must be an absolute http or https URL")
+	if err == nil && u.Host != "" {
+		v.Check(PublicHost(u.Hostname()), "url", "must not point to a loopback or private address")
+	}
+
+	v.Check(len(webhook.Events) >= 1, "events", "must contain at least 1 event")
+	v.Check(validator.Unique(webhook.Events), "events", "must not contain duplicate values")
+	for _, event := range webhook.Events {
+		v.Check(validator.In(event, WebhookEvents...), "events", "must only contain movie.created, movie.updated, movie.deleted or movie.restored")
+	}
+}
+
+// The PublicHost() function reports whether the host may be used as a webhook target.
+// It rejects localhost and any IP address which is loopback, private, link-local,
+// unspecified or multicast. Other host names are allowed, since they can only be
+// checked once they're resolved.
+func PublicHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return true
+	}
+
+	return PublicAddr(addr)
+}
+
+// The PublicAddr() function reports whether the IP address is a public unicast address.
+func PublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return !(addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified())
+}
+
+// The WebhookModelInterface describes the methods for working with webhooks.
+type WebhookModelInterface interface {
+	Insert(ctx context.Context, webhook *Webhook) error
+	GetAll(ctx context.Context) ([]*Webhook, error)
+	GetForEvent(ctx context.Context, event string) ([]*Webhook, error)
+	Delete(ctx context.Context, id int64) error
+	RecordDelivery(ctx context.Context, id int64, status int, deliveryErr string) error
+}
+
+// Define a WebhookModel struct type which wraps a sql.DB connection pool.
+type WebhookModel struct {
+	DB		*sql.DB
+	Timeout	time.Duration
+}
+
+// The timeout() method returns the timeout to use for database operations.
+func (m WebhookModel) timeout() time.Duration {
+	if m.Timeout <= 0 {
+		return DefaultQueryTimeout
+	}
+	return m.Timeout
+}
+
+// The Insert() method creates a webhook, setting its ID and creation time.
+func (m WebhookModel) Insert(ctx context.Context, webhook *Webhook) error {
+	query := `
+		INSERT INTO webhooks (url, events, secret)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, webhook.URL, pq.Array(webhook.Events), webhook.Secret).Scan(&webhook.ID, &webhook.CreatedAt)
+}
+
+// The GetAll() method returns every webhook, without their secrets.
+func (m WebhookModel) GetAll(ctx context.Context) ([]*Webhook, error) {
+	query := `
+		SELECT id, created_at, url, events, '', last_delivery_at, last_delivery_status, last_delivery_error
+		FROM webhooks
+		ORDER BY id`
+
+	return m.query(ctx, query)
+}
+
+// The GetForEvent() method returns the webhooks which are subscribed to an event,
+// including their secrets so that the deliveries can be signed.
+func (m WebhookModel) GetForEvent(ctx context.Context, event string) ([]*Webhook, error) {
+	query := `
+		SELECT id, created_at, url, events, secret, last_delivery_at, last_delivery_status, last_delivery_error
+		FROM webhooks
+		WHERE $1 = ANY(events)
+		ORDER BY id`
+
+	return m.query(ctx, query, event)
+}
+
+// The query() helper runs a query which returns webhooks, and scans the results.
+func (m WebhookModel) query(ctx context.Context, query string, args ...interface{}) ([]*Webhook, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+
+	for rows.Next() {
+		var webhook Webhook
+		var status sql.NullInt64
+		var deliveryErr sql.NullString
+
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.CreatedAt,
+			&webhook.URL,
+			pq.Array(&webhook.Events),
+			&webhook.Secret,
+			&webhook.LastDeliveryAt,
+			&status,
+			&deliveryErr,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if status.Valid {
+			s := int(status.Int64)
+			webhook.LastDeliveryStatus = &s
+		}
+		webhook.LastDeliveryError = deliveryErr.String
+
+		webhooks = append(webhooks, &webhook)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+// The Delete() method deletes a webhook, returning an ErrRecordNotFound error if it
+// doesn't exist.
+func (m WebhookModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM webhooks
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// The RecordDelivery() method records the outcome of the latest delivery to a webhook.
+// If the webhook has been deleted in the meantime there's nothing to update, which
+// isn't treated as an error.
+func (m WebhookModel) RecordDelivery(ctx context.Context, id int64, status int, deliveryErr string) error {
+	query := `
+		UPDATE webhooks
+		SET last_delivery_at = NOW(), last_delivery_status = $2, last_delivery_error = NULLIF($3, '')
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, status, deliveryErr)
+	return err
+}
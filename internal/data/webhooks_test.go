@@ -0,0 +1,69 @@
+package data
+
+import (
+	"net/netip"
+	"testing"
+	"greenlight.nursultandias.net/internal/validator"
+)
+
+func TestValidateWebhookURL(t *testing.T) {
+	tests := []struct {
+		url		string
+		valid	bool
+	}{
+		{"https://example.com/hook", true},
+		{"http://example.com:8080/hook", true},
+		{"https://93.184.216.34/hook", true},
+		{"https://[2606:2800:220:1:248:1893:25c8:1946]/hook", true},
+		{"", false},
+		{"ftp://example.com/hook", false},
+		{"/hook", false},
+		{"http://localhost/hook", false},
+		{"http://LOCALHOST./hook", false},
+		{"http://api.localhost/hook", false},
+		{"http://127.0.0.1/hook", false},
+		{"http://127.1.2.3:4000/hook", false},
+		{"http://[::1]/hook", false},
+		{"http://[::ffff:127.0.0.1]/hook", false},
+		{"http://10.0.0.1/hook", false},
+		{"http://172.16.5.4/hook", false},
+		{"http://192.168.1.1/hook", false},
+		{"http://[fd00::1]/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://[fe80::1]/hook", false},
+		{"http://0.0.0.0/hook", false},
+		{"http://[::]/hook", false},
+		{"http://224.0.0.1/hook", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			v := validator.New()
+			ValidateWebhook(v, &Webhook{URL: tt.url, Events: []string{EventMovieCreated}})
+
+			if _, invalid := v.Errors["url"]; invalid == tt.valid {
+				t.Errorf("got url errors %v; want valid %t", v.Errors["url"], tt.valid)
+			}
+		})
+	}
+}
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr	string
+		want	bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"::ffff:192.168.0.1", false},
+		{"ff02::1", false},
+	}
+
+	for _, tt := range tests {
+		if got := PublicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("PublicAddr(%s) = %t; want %t", tt.addr, got, tt.want)
+		}
+	}
+}
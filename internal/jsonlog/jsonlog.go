@@ -2,9 +2,11 @@ package jsonlog
 
 import ( 
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 )
@@ -13,17 +15,23 @@ import (
 type Level int8
 
 const (
-	LevelInfo	Level = iota	// Has the value 0
-	LevelError					// Has the value 1
-	LevelFatal					// Has the value 2
-	LevelOff					// Has the value 3
+	LevelDebug		Level = iota	// Has the value 0
+	LevelInfo						// Has the value 1
+	LevelWarning					// Has the value 2
+	LevelError						// Has the value 3
+	LevelFatal						// Has the value 4
+	LevelOff						// Has the value 5
 )
 
 // Return a human-friendly string the severity level
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
+	case LevelWarning:
+		return "WARNING"
 	case LevelError:
 		return "ERROR"
 	case LevelFatal:
@@ -33,61 +41,226 @@ func (l Level) String() string {
 	}
 }
 
+// ParseLevel returns the Level with the given name. The name is case-insensitive and
+// can be one of "debug", "info", "warning" (or "warn"), "error", "fatal" or "off".
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warning", "warn":
+		return LevelWarning, nil
+	case "error":
+		return LevelError, nil
+	case "fatal":
+		return LevelFatal, nil
+	case "off":
+		return LevelOff, nil
+	default:
+		return LevelInfo, fmt.Errorf("jsonlog: unknown level %q", name)
+	}
+}
+
 // Define a custom Logger type.
 // This holds the output destination that the log entries will be written to,
-// the minimum severity level that log entries will be written for.
-// plus a mutex for coordinating the writes.
+// the minimum severity level that log entries will be written for,
+// and any properties which are included in every entry.
+// The output (and the mutex which coordinates writes to it) is held by pointer so that
+// child loggers created with With() share it with their parent.
 type Logger struct {
-	out			io.Writer
+	output		*output
 	minLevel	Level
-	mu			sync.Mutex
+	properties	map[string]any
+	timeFormat	string
+	clock		func() time.Time
+}
+
+// The output type holds the destination that log entries are written to, plus a mutex
+// for coordinating the writes. If the logger was created with the WithRotatingFile()
+// option, the file field is set and the entries are written to it instead of out.
+// The infoSampleRate and infoCount fields are used to sample INFO entries (see
+// WithInfoSampling()), and are also protected by the mutex.
+type output struct {
+	mu				sync.Mutex
+	out				io.Writer
+	file			*rotatingFile
+	infoSampleRate	int
+	infoCount		int
+}
+
+// An Option configures a Logger when it's created with New().
+type Option func(*Logger) error
+
+// WithInfoSampling returns an Option which makes the logger write only 1 in every n
+// INFO entries, to stop high-volume entries drowning out the rest. Entries at every
+// other level are always written. A value of n less than or equal to 1 disables
+// sampling.
+func WithInfoSampling(n int) Option {
+	return func(l *Logger) error {
+		l.output.infoSampleRate = n
+		return nil
+	}
+}
+
+// WithTimeFormat returns an Option which sets the layout used for the time of each
+// entry. The default is time.RFC3339.
+func WithTimeFormat(layout string) Option {
+	return func(l *Logger) error {
+		l.timeFormat = layout
+		return nil
+	}
+}
+
+// WithClock returns an Option which sets the function used to get the time of each
+// entry. The default is time.Now, but tests can inject a fixed clock so that the
+// output is deterministic. The time is always converted to UTC.
+func WithClock(clock func() time.Time) Option {
+	return func(l *Logger) error {
+		l.clock = clock
+		return nil
+	}
 }
 
 // Return a new Logger instance which writes log entries at or above
 // a minimum severity level to a specific output destination.
-func New(out io.Writer, minLevel Level) *Logger {
-	return &Logger {
-		out:		out,
+// If any of the options fail (for example, if a log file can't be opened) then the
+// logger falls back to writing to out, and logs an error entry saying so.
+func New(out io.Writer, minLevel Level, opts ...Option) *Logger {
+	l := &Logger {
+		output:		&output{out: out},
 		minLevel:	minLevel,
+		timeFormat:	time.RFC3339,
+		clock:		time.Now,
+	}
+
+	for _, opt := range opts {
+		err := opt(l)
+		if err != nil {
+			l.output.file = nil
+			l.PrintError(fmt.Errorf("jsonlog: %w; writing to the default output instead", err), nil)
+		}
+	}
+
+	return l
+}
+
+// With returns a child logger which writes to the same output destination (sharing the
+// same mutex) and includes the given properties in every entry, in addition to any
+// properties of the parent logger. Properties passed when printing an entry win over
+// the logger's properties if the keys clash. The parent logger is not modified, so it's
+// safe to call With() concurrently. Because the properties are encoded as a JSON object
+// with sorted keys, the output for a given set of properties is always the same.
+func (l *Logger) With(properties map[string]any) *Logger {
+	merged := make(map[string]any, len(l.properties)+len(properties))
+	for key, value := range l.properties {
+		merged[key] = value
+	}
+	for key, value := range properties {
+		merged[key] = value
 	}
+
+	return &Logger{
+		output:		l.output,
+		minLevel:	l.minLevel,
+		properties:	merged,
+		timeFormat:	l.timeFormat,
+		clock:		l.clock,
+	}
+}
+
+// Reopen closes and reopens the log file, so that an external tool like logrotate can
+// move the file out of the way and have the logger start writing to a new one. It does
+// nothing if the logger isn't writing to a file.
+func (l *Logger) Reopen() error {
+	l.output.mu.Lock()
+	defer l.output.mu.Unlock()
+
+	if l.output.file == nil {
+		return nil
+	}
+
+	return l.output.file.reopen()
+}
+
+// Close closes the log file, if the logger is writing to one. Entries written after
+// Close() has been called are sent to the default output instead.
+func (l *Logger) Close() error {
+	l.output.mu.Lock()
+	defer l.output.mu.Unlock()
+
+	if l.output.file == nil {
+		return nil
+	}
+
+	err := l.output.file.close()
+	l.output.file = nil
+
+	return err
 }
 
 // Declare some helper methods for writing log entries at the different levels.
 // Notice that these all accept a map as the second parameter which can contain
 // any arbitrary 'properties' that you want to appear in the log entry.
-func (l *Logger) PrintInfo(message string, properties map[string]string) {
+func (l *Logger) PrintDebug(message string, properties map[string]any) {
+	l.print(LevelDebug, message, properties)
+}
+
+func (l *Logger) PrintInfo(message string, properties map[string]any) {
 	l.print(LevelInfo, message, properties)
 }
 
-func (l *Logger) PrintError(err error, properties map[string]string) {
+func (l *Logger) PrintWarning(message string, properties map[string]any) {
+	l.print(LevelWarning, message, properties)
+}
+
+func (l *Logger) PrintError(err error, properties map[string]any) {
 	l.print(LevelError, err.Error(), properties)
 }
 
-func (l *Logger) PrintFatal(err error, properties map[string]string) {
+func (l *Logger) PrintFatal(err error, properties map[string]any) {
 	l.print(LevelFatal, err.Error(), properties)
 	os.Exit(1) // For entries at the FATAL level, we also terminate the application.
 }
 
 // Print is an internal method for writing the log entry.
-func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
+func (l *Logger) print(level Level, message string, properties map[string]any) (int, error) {
 	// If the severity level of the log entry is below the minimum severity for the logger
 	// then return with no further action.
 	if level < l.minLevel {
 		return 0, nil
 	}
 
+	// If INFO sampling is enabled, drop all but 1 in every n INFO entries. The counter
+	// is shared with any child loggers, so it's updated while holding the mutex.
+	if level == LevelInfo && !l.output.sampled() {
+		return 0, nil
+	}
+
+	// Merge the logger's own properties with those for this entry.
+	if len(l.properties) > 0 {
+		merged := make(map[string]any, len(l.properties)+len(properties))
+		for key, value := range l.properties {
+			merged[key] = value
+		}
+		for key, value := range properties {
+			merged[key] = value
+		}
+		properties = merged
+	}
+
 	// Declare an anonymous struct holding the data for the log entry.
 	aux := struct {
 		// struct definition
 		Level		string				`json:"level"`
 		Time		string				`json:"time"`
 		Message		string				`json:"message"`
-		Properties	map[string]string	`json:"properties,omitempty"`
+		Properties	map[string]any		`json:"properties,omitempty"`
 		Trace		string				`json:"trace,omitempty"`
 	}{
 		// struct initialization
 		Level:		level.String(),
-		Time:		time.Now().UTC().Format(time.RFC3339),
+		Time:		l.clock().UTC().Format(l.timeFormat),
 		Message:	message,
 		Properties: properties,
 	}
@@ -104,16 +277,59 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 	// If there was a problem creating the JSON, set the content of the log entry
 	// to be that plain-text error message instead.
 	line, err := json.Marshal(aux)
+
+	// If marshaling failed it's most likely because one of the property values can't be
+	// represented as JSON (like a channel or a func). Replace any such values with their
+	// fmt.Sprintf("%v") representation and try again, so that the rest of the entry is
+	// still logged.
+	if err != nil && len(properties) > 0 {
+		aux.Properties = sanitizeProperties(properties)
+		line, err = json.Marshal(aux)
+	}
+
 	if err != nil {
 		line = []byte(LevelError.String() + ": unable to marshal log message: " + err.Error())
 	}
 
 	// Lock the mutex so that no two writes to the output destination can happen concurrently.
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	l.output.mu.Lock()
+	defer l.output.mu.Unlock()
 
 	// Write the log entry followed by a newline.
-	return l.out.Write(append(line,'\n'))
+	if l.output.file != nil {
+		return l.output.file.write(append(line,'\n'))
+	}
+	return l.output.out.Write(append(line,'\n'))
+}
+
+// The sampled() method reports whether an INFO entry should be written, given the
+// sampling rate. The first entry of every n is written.
+func (o *output) sampled() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.infoSampleRate <= 1 {
+		return true
+	}
+
+	o.infoCount++
+	return (o.infoCount-1)%o.infoSampleRate == 0
+}
+
+// The sanitizeProperties() function returns a copy of the properties map in which any
+// values which can't be marshaled to JSON are replaced by their string representation.
+func sanitizeProperties(properties map[string]any) map[string]any {
+	sanitized := make(map[string]any, len(properties))
+
+	for key, value := range properties {
+		if _, err := json.Marshal(value); err != nil {
+			sanitized[key] = fmt.Sprintf("%v", value)
+			continue
+		}
+		sanitized[key] = value
+	}
+
+	return sanitized
 }
 
 func (l *Logger) Write(message []byte) (n int, err error) {
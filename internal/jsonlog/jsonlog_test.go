@@ -0,0 +1,171 @@
+package jsonlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// The levels() helper decodes the entries written to buf and returns their levels.
+func levels(t *testing.T, buf *bytes.Buffer) []string {
+	t.Helper()
+
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+
+		var entry struct {
+			Level	string	`json:"level"`
+		}
+		err := json.Unmarshal([]byte(line), &entry)
+		if err != nil {
+			t.Fatalf("invalid log entry %q: %v", line, err)
+		}
+		got = append(got, entry.Level)
+	}
+
+	return got
+}
+
+func TestLevelOrdering(t *testing.T) {
+	ordered := []Level{LevelDebug, LevelInfo, LevelWarning, LevelError, LevelFatal, LevelOff}
+
+	for i := 1; i < len(ordered); i++ {
+		if ordered[i-1] >= ordered[i] {
+			t.Errorf("%d (%q) should be lower than %d (%q)", ordered[i-1], ordered[i-1], ordered[i], ordered[i])
+		}
+	}
+}
+
+func TestMinLevel(t *testing.T) {
+	tests := []struct {
+		minLevel	Level
+		want		[]string
+	}{
+		{minLevel: LevelDebug, want: []string{"DEBUG", "INFO", "WARNING", "ERROR"}},
+		{minLevel: LevelInfo, want: []string{"INFO", "WARNING", "ERROR"}},
+		{minLevel: LevelWarning, want: []string{"WARNING", "ERROR"}},
+		{minLevel: LevelError, want: []string{"ERROR"}},
+		{minLevel: LevelFatal, want: nil},
+		{minLevel: LevelOff, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.minLevel.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := New(&buf, tt.minLevel)
+
+			logger.PrintDebug("debug", nil)
+			logger.PrintInfo("info", nil)
+			logger.PrintWarning("warning", nil)
+			logger.PrintError(errors.New("error"), nil)
+
+			got := levels(t, &buf)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got levels %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		name	string
+		want	Level
+		wantErr	bool
+	}{
+		{name: "debug", want: LevelDebug},
+		{name: "info", want: LevelInfo},
+		{name: "warning", want: LevelWarning},
+		{name: "warn", want: LevelWarning},
+		{name: "WARNING", want: LevelWarning},
+		{name: "error", want: LevelError},
+		{name: "Fatal", want: LevelFatal},
+		{name: "off", want: LevelOff},
+		{name: "", want: LevelInfo, wantErr: true},
+		{name: "verbose", want: LevelInfo, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLevel(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %s; want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInfoSampling(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelDebug, WithInfoSampling(10))
+
+	// Interleave the levels, so that every non-INFO entry lands between sampled INFO
+	// entries.
+	for i := 0; i < 100; i++ {
+		logger.PrintInfo("info", nil)
+		logger.PrintDebug("debug", nil)
+		logger.PrintWarning("warning", nil)
+		logger.PrintError(errors.New("error"), nil)
+	}
+
+	counts := make(map[string]int)
+	for _, level := range levels(t, &buf) {
+		counts[level]++
+	}
+
+	want := map[string]int{"INFO": 10, "DEBUG": 100, "WARNING": 100, "ERROR": 100}
+	for level, n := range want {
+		if counts[level] != n {
+			t.Errorf("got %d %s entries; want %d", counts[level], level, n)
+		}
+	}
+}
+
+func TestInfoSamplingSharedWithChildren(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelInfo, WithInfoSampling(3))
+	child := logger.With(map[string]any{"request_id": "abc"})
+
+	// The counter is shared, so six entries split between the parent and the child
+	// give two written entries in total.
+	for i := 0; i < 3; i++ {
+		logger.PrintInfo("parent", nil)
+		child.PrintInfo("child", nil)
+		child.PrintError(errors.New("child error"), nil)
+	}
+
+	counts := make(map[string]int)
+	for _, level := range levels(t, &buf) {
+		counts[level]++
+	}
+
+	if counts["INFO"] != 2 {
+		t.Errorf("got %d INFO entries; want 2", counts["INFO"])
+	}
+	if counts["ERROR"] != 3 {
+		t.Errorf("got %d ERROR entries; want 3", counts["ERROR"])
+	}
+}
+
+func TestInfoSamplingDisabled(t *testing.T) {
+	for _, n := range []int{-1, 0, 1} {
+		var buf bytes.Buffer
+		logger := New(&buf, LevelInfo, WithInfoSampling(n))
+
+		for i := 0; i < 5; i++ {
+			logger.PrintInfo("info", nil)
+		}
+
+		if got := len(levels(t, &buf)); got != 5 {
+			t.Errorf("sampling rate %d: got %d entries; want 5", n, got)
+		}
+	}
+}
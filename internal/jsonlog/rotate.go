@@ -0,0 +1,124 @@
+package jsonlog
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// The rotatingFile type is a log file which is rotated once it grows beyond a maximum
+// size. On rotation the current file is renamed to path.1 (with any existing path.1
+// becoming path.2 and so on, up to maxBackups) and a new, empty file is opened at path.
+// Its methods must only be called while holding the output mutex.
+type rotatingFile struct {
+	path		string
+	maxSize		int64
+	maxBackups	int
+	file		*os.File
+	size		int64
+}
+
+// WithRotatingFile returns an Option which makes the logger write to the file at path
+// instead of its default output. The file is rotated once it reaches maxSizeMB
+// megabytes, and at most maxBackups old files are kept.
+func WithRotatingFile(path string, maxSizeMB int, maxBackups int) Option {
+	return func(l *Logger) error {
+		if maxSizeMB <= 0 {
+			return fmt.Errorf("invalid maximum log file size %dMB", maxSizeMB)
+		}
+
+		rf := &rotatingFile{
+			path:		path,
+			maxSize:	int64(maxSizeMB) * 1024 * 1024,
+			maxBackups:	maxBackups,
+		}
+
+		err := rf.open()
+		if err != nil {
+			return err
+		}
+
+		l.output.file = rf
+		return nil
+	}
+}
+
+// The open() method opens (or creates) the log file for appending, and records its
+// current size.
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+
+	return nil
+}
+
+// The write() method writes p to the log file, rotating the file first if p would take
+// it over the maximum size.
+func (rf *rotatingFile) write(p []byte) (int, error) {
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		err := rf.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+
+	return n, err
+}
+
+// The rotate() method closes the current file, shifts the backups along (dropping the
+// oldest), renames the current file to path.1 and opens a new file at path. Each step
+// uses os.Rename(), which replaces the destination atomically.
+func (rf *rotatingFile) rotate() error {
+	err := rf.file.Close()
+	if err != nil {
+		return err
+	}
+
+	if rf.maxBackups > 0 {
+		for i := rf.maxBackups - 1; i >= 1; i-- {
+			err := os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+
+		err = os.Rename(rf.path, rf.path+".1")
+	} else {
+		err = os.Remove(rf.path)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return rf.open()
+}
+
+// The reopen() method closes the log file and opens the file at path again.
+func (rf *rotatingFile) reopen() error {
+	err := rf.file.Close()
+	if err != nil {
+		return err
+	}
+
+	return rf.open()
+}
+
+// The close() method closes the log file.
+func (rf *rotatingFile) close() error {
+	return rf.file.Close()
+}
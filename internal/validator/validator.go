@@ -1,35 +1,117 @@
 package validator
 
 import (
+	"cmp"
+	"fmt"
 	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
 // Declare a regular expression for sanity checking the format of email addresses (we'll use later)
 // this regular expression pattern is taken from https://html.spec.whatwg.org/#valid-e-mail-address.
 var (
-	EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\. [a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
+	EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 )
 
-// Define a new Validator type which contains a map of validation errors.
+// Define a new Validator type which contains a map of validation errors. Every error
+// message for a key is kept, in the order they were added, so a value with several
+// problems reports all of them.
+// The mutex makes the methods safe to call from multiple goroutines, for example when
+// validating the items of a batch concurrently. Reading the map directly is only safe
+// once all of the checks have finished.
+// A validator returned by Child() shares its parent's errors map, and holds the prefix
+// which is added to its keys. The root field points at the validator created by New(),
+// whose mutex guards the map.
 type Validator struct { 
-	Errors map[string]string
+	mu		sync.RWMutex
+	Errors	map[string][]string
+	root	*Validator
+	prefix	string
 }
 
 // New is a helper which creates a new Validator instance with an empty errors map.
 func New() *Validator {
-	return &Validator{Errors: make(map[string]string)}
+	return &Validator{Errors: make(map[string][]string)}
+}
+
+// Child returns a validator which adds the given prefix to the keys of its errors, and
+// records them in the same map as this validator. A prefix starting with "[" is
+// appended directly, and any other prefix is joined with a ".", so for example
+// v.Child("movies").Child("[2]") records an error for "title" under "movies[2].title".
+// Because the errors are shared, Valid() on any of the validators reports on all of
+// them, and functions such as data.ValidateMovie() can be passed a child unchanged.
+func (validator *Validator) Child(prefix string) *Validator {
+	return &Validator{
+		Errors:	validator.Errors,
+		root:	validator.lockRoot(),
+		prefix:	joinKey(validator.prefix, prefix),
+	}
+}
+
+// The lockRoot() method returns the validator whose mutex guards the errors map.
+func (validator *Validator) lockRoot() *Validator {
+	if validator.root == nil {
+		return validator
+	}
+	return validator.root
+}
+
+// The joinKey() function adds a prefix to a key, following the rules in Child().
+func joinKey(prefix, key string) string {
+	switch {
+	case prefix == "":
+		return key
+	case key == "":
+		return prefix
+	case strings.HasPrefix(key, "["):
+		return prefix + key
+	default:
+		return prefix + "." + key
+	}
 }
 
 // Valid returns true if the errors map doesn't contain any entries.
 func (validator *Validator) Valid() bool { 
+	root := validator.lockRoot()
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+
 	return len(validator.Errors) == 0
 }
 
-// AddError adds an error message to the map (as long as no entry already exists for the given key).
+// AddError appends an error message to the list for the given key (with the validator's
+// prefix added). A message which is already in the list isn't added a second time.
 func (validator *Validator) AddError(key, message string) {
-	if _, exists := validator.Errors[key]; !exists { 
-		validator.Errors[key] = message
+	root := validator.lockRoot()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	key = joinKey(validator.prefix, key)
+
+	for _, existing := range validator.Errors[key] {
+		if existing == message {
+			return
+		}
+	}
+
+	validator.Errors[key] = append(validator.Errors[key], message)
+}
+
+// FirstErrors returns a map holding just the first error message for each key, which
+// is what the Errors map used to contain.
+func (validator *Validator) FirstErrors() map[string]string {
+	root := validator.lockRoot()
+	root.mu.RLock()
+	defer root.mu.RUnlock()
+
+	first := make(map[string]string, len(validator.Errors))
+	for key, messages := range validator.Errors {
+		first[key] = messages[0]
 	}
+
+	return first
 }
 
 // Check adds an error message to the map only if a validation check is not 'ok'.
@@ -62,6 +144,64 @@ func Unique(values []string) bool { uniqueValues := make(map[string]bool)
 	return len(values) == len(uniqueValues)
 }
 
+// NotBlank returns true if a string value contains at least one non-whitespace character.
+func NotBlank(value string) bool {
+	return strings.TrimSpace(value) != ""
+}
+
+// MinLength returns true if a string value contains at least n characters. Characters
+// are counted as runes rather than bytes, so multi-byte characters count as one.
+func MinLength(value string, n int) bool {
+	return utf8.RuneCountInString(value) >= n
+}
+
+// MaxLength returns true if a string value contains no more than n characters (runes).
+func MaxLength(value string, n int) bool {
+	return utf8.RuneCountInString(value) <= n
+}
+
+// Min returns true if a value is greater than or equal to min. It works with any
+// ordered type, including named types such as data.Runtime.
+func Min[T cmp.Ordered](value, min T) bool {
+	return value >= min
+}
+
+// Max returns true if a value is less than or equal to max.
+func Max[T cmp.Ordered](value, max T) bool {
+	return value <= max
+}
+
+// Between returns true if a value is within the inclusive range min to max.
+func Between[T cmp.Ordered](value, min, max T) bool {
+	return value >= min && value <= max
+}
+
+// The maxEmailLength is the longest email address which can be used in the SMTP
+// protocol (RFC 5321), in bytes.
+const maxEmailLength = 254
+
+// ValidateEmail checks an email address, recording any problems under the "email" key,
+// and returns the address in its normalized form: with surrounding whitespace removed
+// and the domain lowercased (the local part is case sensitive, so it's left as is).
+// Callers should store the returned value rather than the original.
+func ValidateEmail(v *Validator, email string) string {
+	email = strings.TrimSpace(email)
+
+	if at := strings.LastIndexByte(email, '@'); at >= 0 {
+		email = email[:at+1] + strings.ToLower(email[at+1:])
+	}
+
+	if email == "" {
+		v.AddError("email", "must be provided")
+		return email
+	}
+
+	v.Check(len(email) <= maxEmailLength, "email", fmt.Sprintf("must not be more than %d bytes long", maxEmailLength))
+	v.Check(Matches(email, EmailRX), "email", "must be a valid email address")
+
+	return email
+}
+
 // In the code above we’ve defined a custom Validator type which contains a map of errors.
 // The Validator type provides a Check() method for conditionally adding errors to the map,
 // and a Valid() method which returns whether the errors map is empty or not.
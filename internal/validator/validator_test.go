@@ -0,0 +1,327 @@
+package validator
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotBlank(t *testing.T) {
+	tests := []struct {
+		value	string
+		want	bool
+	}{
+		{value: "", want: false},
+		{value: " ", want: false},
+		{value: "\t\n\r ", want: false},
+		{value: "  ", want: false},
+		{value: "a", want: true},
+		{value: "  Moana  ", want: true},
+		{value: "日本", want: true},
+	}
+
+	for _, tt := range tests {
+		if got := NotBlank(tt.value); got != tt.want {
+			t.Errorf("NotBlank(%q) = %t; want %t", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestLength(t *testing.T) {
+	tests := []struct {
+		name	string
+		value	string
+		runes	int
+	}{
+		{name: "empty", value: "", runes: 0},
+		{name: "ascii", value: "Moana", runes: 5},
+		{name: "accented", value: "Amélie", runes: 6},
+		{name: "japanese", value: "千と千尋の神隠し", runes: 8},
+		{name: "emoji", value: "🎬🍿", runes: 2},
+		{name: "combining mark", value: "é", runes: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The limits are counted in runes, so a value is exactly at both limits when
+			// n is its rune count, even if it's longer than that in bytes.
+			if !MinLength(tt.value, tt.runes) {
+				t.Errorf("MinLength(%q, %d) = false; want true", tt.value, tt.runes)
+			}
+			if MinLength(tt.value, tt.runes+1) {
+				t.Errorf("MinLength(%q, %d) = true; want false", tt.value, tt.runes+1)
+			}
+			if !MaxLength(tt.value, tt.runes) {
+				t.Errorf("MaxLength(%q, %d) = false; want true", tt.value, tt.runes)
+			}
+			if tt.runes > 0 && MaxLength(tt.value, tt.runes-1) {
+				t.Errorf("MaxLength(%q, %d) = true; want false", tt.value, tt.runes-1)
+			}
+		})
+	}
+}
+
+func TestMaxLengthCountsRunesNotBytes(t *testing.T) {
+	// 500 three-byte runes are 1500 bytes long, but still within a 500 character limit.
+	title := strings.Repeat("映", 500)
+
+	if !MaxLength(title, 500) {
+		t.Error("MaxLength rejected 500 multi-byte characters with a limit of 500")
+	}
+	if MaxLength(title+"映", 500) {
+		t.Error("MaxLength accepted 501 multi-byte characters with a limit of 500")
+	}
+}
+
+// Run this test with the race detector (go test -race) to check that the mutex guards
+// every access to the errors map.
+func TestValidatorConcurrentUse(t *testing.T) {
+	v := New()
+
+	const goroutines = 50
+	var wg sync.WaitGroup
+
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			child := v.Child(fmt.Sprintf("movies[%d]", i))
+			for j := 0; j < 10; j++ {
+				child.Check(false, "title", "must be provided")
+				v.Check(false, "shared", fmt.Sprintf("error %d", j))
+				_ = child.Valid()
+				_ = v.FirstErrors()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if got := len(v.Errors); got != goroutines+1 {
+		t.Errorf("got %d keys; want %d", got, goroutines+1)
+	}
+	if got := len(v.Errors["shared"]); got != 10 {
+		t.Errorf("got %d messages for the shared key; want 10 (duplicates dropped)", got)
+	}
+	for i := 0; i < goroutines; i++ {
+		key := fmt.Sprintf("movies[%d].title", i)
+		if got := v.Errors[key]; len(got) != 1 {
+			t.Errorf("got %q for %s; want a single message", got, key)
+		}
+	}
+}
+
+func TestEmailRX(t *testing.T) {
+	tests := []struct {
+		email	string
+		want	bool
+	}{
+		{email: "alice@example.com", want: true},
+		{email: "alice.smith@example.co.uk", want: true},
+		{email: "alice+movies@example.com", want: true},
+		{email: "a@b", want: true},
+		{email: "o'brien@example.com", want: true},
+		{email: "x@sub-domain.example.com", want: true},
+		{email: "", want: false},
+		{email: "alice", want: false},
+		{email: "alice@", want: false},
+		{email: "@example.com", want: false},
+		{email: " alice@example.com", want: false},
+		{email: "alice@example.com ", want: false},
+		{email: "alice @example.com", want: false},
+		{email: "alice@exa mple.com", want: false},
+		{email: "alice@@example.com", want: false},
+		{email: "alice@-example.com", want: false},
+		{email: "alice@example-.com", want: false},
+		{email: "alice@example..com", want: false},
+		{email: "alice@.example.com", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := Matches(tt.email, EmailRX); got != tt.want {
+			t.Errorf("Matches(%q, EmailRX) = %t; want %t", tt.email, got, tt.want)
+		}
+	}
+}
+
+func TestMinMaxBetween(t *testing.T) {
+	ints := []struct {
+		value, min, max			int
+		wantMin, wantMax, want	bool
+	}{
+		{value: 5, min: 1, max: 10, wantMin: true, wantMax: true, want: true},
+		{value: 1, min: 1, max: 10, wantMin: true, wantMax: true, want: true},
+		{value: 10, min: 1, max: 10, wantMin: true, wantMax: true, want: true},
+		{value: 0, min: 1, max: 10, wantMin: false, wantMax: true, want: false},
+		{value: 11, min: 1, max: 10, wantMin: true, wantMax: false, want: false},
+		{value: -5, min: -10, max: -1, wantMin: true, wantMax: true, want: true},
+		{value: 3, min: 3, max: 3, wantMin: true, wantMax: true, want: true},
+		{value: 5, min: 10, max: 1, wantMin: false, wantMax: false, want: false},
+	}
+
+	for _, tt := range ints {
+		if got := Min(tt.value, tt.min); got != tt.wantMin {
+			t.Errorf("Min(%d, %d) = %t; want %t", tt.value, tt.min, got, tt.wantMin)
+		}
+		if got := Max(tt.value, tt.max); got != tt.wantMax {
+			t.Errorf("Max(%d, %d) = %t; want %t", tt.value, tt.max, got, tt.wantMax)
+		}
+		if got := Between(tt.value, tt.min, tt.max); got != tt.want {
+			t.Errorf("Between(%d, %d, %d) = %t; want %t", tt.value, tt.min, tt.max, got, tt.want)
+		}
+	}
+
+	// The functions work with any ordered type, including named types.
+	if !Between(int32(1888), 1888, 2026) {
+		t.Error("Between(int32(1888), 1888, 2026) = false; want true")
+	}
+	if Min(0.99, 1.0) {
+		t.Error("Min(0.99, 1.0) = true; want false")
+	}
+	if !Max(2.5, 2.5) {
+		t.Error("Max(2.5, 2.5) = false; want true")
+	}
+	if !Between("m", "a", "z") || Between("Z", "a", "z") {
+		t.Error("Between() compared strings incorrectly")
+	}
+	if !Between(90*time.Second, time.Second, time.Hour) || Max(2*time.Hour, time.Hour) {
+		t.Error("Between() or Max() compared durations incorrectly")
+	}
+}
+
+func TestValidateEmail(t *testing.T) {
+	// The longest valid address is 254 bytes: a 64 byte local part, the @, and a 189
+	// byte domain made of 63 byte labels.
+	label := strings.Repeat("a", 63)
+	longDomain := label + "." + label + "." + strings.Repeat("b", 59) + ".c"
+	longest := strings.Repeat("x", 64) + "@" + longDomain
+
+	tests := []struct {
+		name		string
+		email		string
+		want		string
+		wantErrors	[]string
+	}{
+		{name: "simple", email: "alice@example.com", want: "alice@example.com"},
+		{name: "subdomain", email: "alice@mail.example.co.uk", want: "alice@mail.example.co.uk"},
+		{name: "plus tag", email: "alice+movies@example.com", want: "alice+movies@example.com"},
+		{name: "dotted local part", email: "alice.smith@example.com", want: "alice.smith@example.com"},
+		{name: "single label domain", email: "alice@localhost", want: "alice@localhost"},
+		{name: "surrounding spaces", email: "  alice@example.com  ", want: "alice@example.com"},
+		{name: "surrounding tabs and newlines", email: "\talice@example.com\n", want: "alice@example.com"},
+		{name: "uppercase domain", email: "alice@EXAMPLE.COM", want: "alice@example.com"},
+		{name: "mixed case domain", email: "alice@Example.Com", want: "alice@example.com"},
+		{name: "local part case kept", email: "Alice.Smith@Example.com", want: "Alice.Smith@example.com"},
+		{name: "trimmed and lowercased", email: " Bob@MAIL.Example.ORG ", want: "Bob@mail.example.org"},
+		{name: "254 bytes", email: longest, want: longest},
+		{name: "empty", email: "", want: "", wantErrors: []string{"must be provided"}},
+		{name: "only whitespace", email: "   ", want: "", wantErrors: []string{"must be provided"}},
+		{name: "255 bytes", email: "x" + longest, want: "x" + longest, wantErrors: []string{"must not be more than 254 bytes long"}},
+		{name: "too long and invalid", email: strings.Repeat("x", 250) + " @example.com", want: strings.Repeat("x", 250) + " @example.com", wantErrors: []string{"must not be more than 254 bytes long", "must be a valid email address"}},
+		{name: "no at sign", email: "alice.example.com", want: "alice.example.com", wantErrors: []string{"must be a valid email address"}},
+		{name: "no local part", email: "@example.com", want: "@example.com", wantErrors: []string{"must be a valid email address"}},
+		{name: "no domain", email: "alice@", want: "alice@", wantErrors: []string{"must be a valid email address"}},
+		{name: "two at signs", email: "alice@bob@example.com", want: "alice@bob@example.com", wantErrors: []string{"must be a valid email address"}},
+		{name: "inner space", email: "alice smith@example.com", want: "alice smith@example.com", wantErrors: []string{"must be a valid email address"}},
+		{name: "double dot in domain", email: "alice@example..com", want: "alice@example..com", wantErrors: []string{"must be a valid email address"}},
+		{name: "domain starts with hyphen", email: "alice@-example.com", want: "alice@-example.com", wantErrors: []string{"must be a valid email address"}},
+		{name: "invalid with uppercase domain", email: "alice@EXAMPLE..COM", want: "alice@example..com", wantErrors: []string{"must be a valid email address"}},
+	}
+
+	if len(longest) != 254 {
+		t.Fatalf("test address is %d bytes; want 254", len(longest))
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := New()
+			got := ValidateEmail(v, tt.email)
+
+			if got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+			if fmt.Sprint(v.Errors["email"]) != fmt.Sprint(tt.wantErrors) {
+				t.Errorf("got errors %q; want %q", v.Errors["email"], tt.wantErrors)
+			}
+			if v.Valid() != (len(tt.wantErrors) == 0) {
+				t.Errorf("got Valid() %t with errors %q", v.Valid(), v.Errors)
+			}
+		})
+	}
+}
+
+func TestChildKeys(t *testing.T) {
+	v := New()
+
+	v.Child("movie").AddError("title", "must be provided")
+	v.Child("movies").Child("[2]").AddError("year", "must be provided")
+	v.Child("movies").Child("[2]").Child("genres").Child("[0]").AddError("", "must not be blank")
+	v.Child("movies[3]").Check(false, "runtime", "must be positive")
+	v.Child("").AddError("id", "must be positive")
+	v.Child("filters").AddError("[0]", "must be valid")
+
+	want := map[string][]string{
+		"movie.title":			{"must be provided"},
+		"movies[2].year":		{"must be provided"},
+		"movies[2].genres[0]":	{"must not be blank"},
+		"movies[3].runtime":	{"must be positive"},
+		"id":					{"must be positive"},
+		"filters[0]":			{"must be valid"},
+	}
+
+	if fmt.Sprint(v.Errors) != fmt.Sprint(want) {
+		t.Errorf("got errors %q; want %q", v.Errors, want)
+	}
+}
+
+func TestChildSharesErrors(t *testing.T) {
+	v := New()
+	movies := v.Child("movies")
+	first := movies.Child("[0]")
+	second := movies.Child("[1]")
+
+	if !v.Valid() || !movies.Valid() || !first.Valid() || !second.Valid() {
+		t.Fatal("got an invalid validator before any errors were added")
+	}
+
+	second.AddError("title", "must be provided")
+	second.AddError("title", "must be provided")
+
+	// The error is visible through the parent and through its siblings, as they all
+	// share the same map.
+	for name, validator := range map[string]*Validator{"root": v, "movies": movies, "first": first, "second": second} {
+		if validator.Valid() {
+			t.Errorf("%s.Valid() = true; want false", name)
+		}
+		if got := validator.Errors["movies[1].title"]; len(got) != 1 {
+			t.Errorf("%s got %q for movies[1].title; want a single message", name, got)
+		}
+	}
+
+	if got := v.FirstErrors(); len(got) != 1 || got["movies[1].title"] != "must be provided" {
+		t.Errorf("got first errors %q", got)
+	}
+}
+
+func TestJoinKey(t *testing.T) {
+	tests := []struct {
+		prefix, key, want	string
+	}{
+		{"", "title", "title"},
+		{"movie", "", "movie"},
+		{"", "", ""},
+		{"movie", "title", "movie.title"},
+		{"movies", "[1]", "movies[1]"},
+		{"movies[1]", "genres", "movies[1].genres"},
+		{"movies[1].genres", "[0]", "movies[1].genres[0]"},
+	}
+
+	for _, tt := range tests {
+		if got := joinKey(tt.prefix, tt.key); got != tt.want {
+			t.Errorf("joinKey(%q, %q) = %q; want %q", tt.prefix, tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package vcs
+
+import (
+	"runtime/debug"
+)
+
+// The fallbackVersion is returned by Version() when no version information is
+// available, for example when running the application with `go run`.
+const fallbackVersion = "1.0.0"
+
+// The buildVersion variable can be set at build time using the -ldflags flag, for
+// example:
+//
+//	go build -ldflags="-X greenlight.nursultandias.net/internal/vcs.buildVersion=1.2.0" ./cmd/api
+//
+// When it's set it takes precedence over the VCS information embedded by the Go toolchain.
+var buildVersion string
+
+// Version returns the application version. If it wasn't set at build
+// time, we read the VCS revision from the build information and append "-dirty" if
+// there were uncommitted changes in the working tree when the binary was built.
+func Version() string {
+	if buildVersion != "" {
+		return buildVersion
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return fallbackVersion
+	}
+
+	var revision string
+	var modified bool
+
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+
+	if revision == "" {
+		return fallbackVersion
+	}
+
+	if modified {
+		return revision + "-dirty"
+	}
+
+	return revision
+}
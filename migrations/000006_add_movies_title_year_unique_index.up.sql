@@ -0,0 +1 @@
+CREATE UNIQUE INDEX IF NOT EXISTS movies_title_year_idx ON movies (lower(title), year) WHERE deleted_at IS NULL;
\ No newline at end of file
@@ -0,0 +1,20 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS genres text[] NOT NULL DEFAULT '{}';
+
+UPDATE movies m
+SET genres = t.genres
+FROM (
+	SELECT mg.movie_id, array_agg(g.name ORDER BY mg.position) AS genres
+	FROM movies_genres mg
+	JOIN genres g ON g.id = mg.genre_id
+	GROUP BY mg.movie_id
+) t
+WHERE t.movie_id = m.id;
+
+ALTER TABLE movies ALTER COLUMN genres DROP DEFAULT;
+ALTER TABLE movies ADD CONSTRAINT genres_length_check CHECK (array_length(genres, 1) BETWEEN 1 AND 5) NOT VALID;
+CREATE INDEX IF NOT EXISTS movies_genres_idx ON movies USING GIN (genres);
+
+DROP TRIGGER IF EXISTS movies_genres_count_check ON movies;
+DROP TABLE IF EXISTS movies_genres;
+DROP FUNCTION IF EXISTS movies_genres_count_check();
+DROP TABLE IF EXISTS genres;
\ No newline at end of file
@@ -0,0 +1,65 @@
+CREATE TABLE IF NOT EXISTS genres (
+	id		bigserial	PRIMARY KEY,
+	name	text		NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS movies_genres (
+	movie_id	bigint	NOT NULL REFERENCES movies ON DELETE CASCADE,
+	genre_id	bigint	NOT NULL REFERENCES genres ON DELETE CASCADE,
+	position	integer	NOT NULL,
+	PRIMARY KEY (movie_id, genre_id)
+);
+
+CREATE INDEX IF NOT EXISTS movies_genres_genre_id_idx ON movies_genres (genre_id);
+
+CREATE OR REPLACE FUNCTION movies_genres_count_check() RETURNS trigger AS $$
+DECLARE
+	movie	bigint;
+	total	integer;
+BEGIN
+	IF TG_TABLE_NAME = 'movies' THEN
+		movie := NEW.id;
+	ELSIF TG_OP = 'DELETE' THEN
+		movie := OLD.movie_id;
+	ELSE
+		movie := NEW.movie_id;
+	END IF;
+
+	IF NOT EXISTS (SELECT 1 FROM movies WHERE id = movie) THEN
+		RETURN NULL;
+	END IF;
+
+	SELECT count(*) INTO total FROM movies_genres WHERE movie_id = movie;
+	IF total NOT BETWEEN 1 AND 5 THEN
+		RAISE EXCEPTION 'movie % has % genres, which is not between 1 and 5', movie, total
+			USING ERRCODE = 'check_violation', CONSTRAINT = 'movies_genres_count_check';
+	END IF;
+
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO genres (name)
+SELECT DISTINCT unnest(genres) FROM movies
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO movies_genres (movie_id, genre_id, position)
+SELECT m.id, g.id, t.position
+FROM movies m
+CROSS JOIN LATERAL unnest(m.genres) WITH ORDINALITY AS t(name, position)
+JOIN genres g ON g.name = t.name
+ON CONFLICT DO NOTHING;
+
+DROP INDEX IF EXISTS movies_genres_idx;
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS genres_length_check;
+ALTER TABLE movies DROP COLUMN IF EXISTS genres;
+
+CREATE CONSTRAINT TRIGGER movies_genres_count_check
+AFTER INSERT OR UPDATE OR DELETE ON movies_genres
+DEFERRABLE INITIALLY DEFERRED
+FOR EACH ROW EXECUTE FUNCTION movies_genres_count_check();
+
+CREATE CONSTRAINT TRIGGER movies_genres_count_check
+AFTER INSERT ON movies
+DEFERRABLE INITIALLY DEFERRED
+FOR EACH ROW EXECUTE FUNCTION movies_genres_count_check();
\ No newline at end of file
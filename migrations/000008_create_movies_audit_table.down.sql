@@ -0,0 +1 @@
+DROP TABLE IF EXISTS movies_audit;
\ No newline at end of file
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS movies_audit (
+	id			bigserial					PRIMARY KEY,
+	movie_id	bigint						NOT NULL,
+	version		integer						NOT NULL,
+	actor_id	bigint,
+	action		text						NOT NULL,
+	changes		jsonb						NOT NULL DEFAULT '{}',
+	created_at	timestamp(0) with time zone	NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS movies_audit_movie_id_idx ON movies_audit (movie_id, id);
\ No newline at end of file
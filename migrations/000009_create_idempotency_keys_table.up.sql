@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	key				text						PRIMARY KEY,
+	request_hash	text						NOT NULL,
+	status			integer,
+	headers			jsonb,
+	body			bytea,
+	expires_at		timestamp(0) with time zone	NOT NULL
+);
\ No newline at end of file
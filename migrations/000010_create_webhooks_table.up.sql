@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS webhooks (
+	id						bigserial					PRIMARY KEY,
+	created_at				timestamp(0) with time zone	NOT NULL DEFAULT NOW(),
+	url						text						NOT NULL,
+	events					text[]						NOT NULL,
+	secret					text						NOT NULL,
+	last_delivery_at		timestamp(0) with time zone,
+	last_delivery_status	integer,
+	last_delivery_error		text
+);
\ No newline at end of file
@@ -0,0 +1,185 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strconv"
+	"github.com/lib/pq"
+)
+
+// The files variable holds the SQL migration files, which are embedded in the binary so
+// that the API can apply them itself (see Up()). They can still be applied with the
+// migrate CLI too, as Up() records its progress in the same schema_migrations table.
+//
+//go:embed *.sql
+var files embed.FS
+
+// The lockID is the key of the PostgreSQL advisory lock which is held while migrations
+// are applied, so that several instances starting at once don't apply them twice.
+const lockID = 7314275105602140672
+
+// ErrDirty is returned when a previous migration failed part way through, so the
+// schema needs to be fixed by hand before any more migrations can be applied.
+var ErrDirty = errors.New("database schema is dirty")
+
+// The upFileRX matches the names of the up migration files, capturing the version.
+var upFileRX = regexp.MustCompile(`^(\d+)_.+\.up\.sql$`)
+
+// A migration is a single up migration file.
+type migration struct {
+	version	int64
+	name	string
+}
+
+// The Version() function returns the version of the most recently applied migration
+// (zero if none have been applied) and whether that migration failed part way through.
+func Version(ctx context.Context, db *sql.DB) (int64, bool, error) {
+	var version int64
+	var dirty bool
+
+	err := db.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+		// The schema_migrations table doesn't exist until the first migration is applied.
+		case errors.As(err, &pqErr) && pqErr.Code == "42P01":
+		default:
+			return 0, false, err
+		}
+	}
+
+	return version, dirty, nil
+}
+
+// The Up() function applies every migration newer than the current version, in order,
+// and returns the resulting version along with the number of migrations applied. Each
+// migration is run in a transaction along with the update to the schema_migrations
+// table, so a failed migration leaves the database at the previous version. If the
+// database has been left dirty (by the migrate CLI), an ErrDirty error is returned.
+func Up(ctx context.Context, db *sql.DB) (int64, int, error) {
+	pending, err := upMigrations()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Use a single connection, as the advisory lock belongs to the session that took it.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockID)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockID)
+
+	// This is the same table that the migrate CLI uses.
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version bigint NOT NULL PRIMARY KEY,
+			dirty boolean NOT NULL
+		)`)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var version int64
+	var dirty bool
+
+	err = conn.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, err
+	}
+
+	if dirty {
+		return version, 0, fmt.Errorf("%w at version %d: fix the schema by hand, then clear the dirty flag with migrate force", ErrDirty, version)
+	}
+
+	applied := 0
+
+	for _, m := range pending {
+		if m.version <= version {
+			continue
+		}
+
+		err = apply(ctx, conn, m)
+		if err != nil {
+			return version, applied, fmt.Errorf("migration %s: %w", m.name, err)
+		}
+
+		version = m.version
+		applied++
+	}
+
+	return version, applied, nil
+}
+
+// The apply() function runs a migration and records its version in a transaction.
+func apply(ctx context.Context, conn *sql.Conn, m migration) error {
+	script, err := files.ReadFile(m.name)
+	if err != nil {
+		return err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, string(script))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `TRUNCATE schema_migrations`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, m.version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// The upMigrations() function returns the embedded up migrations, ordered by version.
+func upMigrations() ([]migration, error) {
+	names, err := fs.Glob(files, "*.up.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+
+	for _, name := range names {
+		match := upFileRX.FindStringSubmatch(name)
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", name)
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration file name %q", name)
+		}
+
+		migrations = append(migrations, migration{version: version, name: name})
+	}
+
+	slices.SortFunc(migrations, func(a, b migration) int {
+		return int(a.version - b.version)
+	})
+
+	return migrations, nil
+}